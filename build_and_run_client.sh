@@ -10,5 +10,8 @@ echo "正在构建客户端..."
 go build -o icmptun_client ./client
 
 echo "构建成功。"
-echo "你现在可以运行 ./icmptun_client"
+echo "你现在可以运行 ./icmptun_client -server <服务器地址> -key <预共享密钥>"
+echo "或者使用配置文件: ./icmptun_client -config config.example.json"
+echo "没有 root 权限时客户端改用非特权 ping 套接字，需要当前用户的组位于 net.ipv4.ping_group_range 之内，"
+echo "例如: sudo sysctl -w net.ipv4.ping_group_range=\"0 2147483647\""
 echo "请记得在另一个终端中使用 'sudo ./build_and_run_server.sh' 运行服务端"
\ No newline at end of file
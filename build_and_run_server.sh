@@ -10,11 +10,18 @@ echo "Building the server..."
 # The -o flag places the output binary in the project root for convenience.
 go build -o icmptun_server ./server
 
+if [ -z "$ICMPTUN_PSK" ]; then
+    echo "Please set ICMPTUN_PSK to the pre-shared key shared with the client."
+    exit 1
+fi
+
 echo "Build successful. Running server with sudo..."
 echo "You may be prompted for your password."
 
-# Run the server with sudo.
-sudo ./icmptun_server
+# Run the server with sudo, passing the pre-shared key through explicitly
+# because sudo does not keep the caller's environment. The kernel's own echo
+# replies are switched off while the server runs and restored when it stops.
+sudo ICMPTUN_PSK="$ICMPTUN_PSK" ./icmptun_server -suppress-kernel-echo
 
 # Clean up the binary after the server is stopped (e.g., with Ctrl+C)
 echo "Server stopped. Cleaning up..."
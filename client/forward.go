@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"icmptun/pkg/compress"
+	"icmptun/pkg/config"
+	"icmptun/pkg/logging"
+	"io"
+	"log"
+	"net"
+	"net/http"
+)
+
+// serveForward accepts connections on ln and tunnels each one to the
+// forward's target until ln is closed.
+func serveForward(ln net.Listener, fw config.Forward) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handleForward(c, fw)
+	}
+}
+
+// handleForward asks the server to dial the forward's target and relays
+// bytes both ways. A failed dial simply closes the local connection.
+func handleForward(c net.Conn, fw config.Forward) {
+	defer c.Close()
+	conn, tbr, requestID, err := openTunnel(http.MethodConnect, fw.Target, fw.Target)
+	if err != nil {
+		log.Printf("端口转发 %s -> %s 失败: %v", fw.Listen, fw.Target, err)
+		return
+	}
+	defer conn.Close()
+	logging.Infof("端口转发隧道 %d 已建立: %s -> %s", requestID, c.RemoteAddr(), fw.Target)
+
+	if err := relay(c, c, conn, tbr); err != nil {
+		log.Printf("端口转发隧道 %d 异常结束: %v", requestID, err)
+		return
+	}
+	logging.Infof("端口转发隧道 %d 已被服务器关闭", requestID)
+}
+
+// relay copies local input into the session and session output, read
+// through tbr, back to the local side. It returns once the server has
+// finished sending; the local read side only half-closes the session.
+func relay(w io.Writer, r io.Reader, conn *compress.Conn, tbr *bufio.Reader) error {
+	go func() {
+		io.Copy(conn, r)
+		conn.CloseWrite()
+	}()
+	_, err := io.Copy(w, tbr)
+	return err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"icmptun/pkg/compress"
+	"icmptun/pkg/config"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestForward 验证端口转发会为每个本地连接打开隧道，请求服务端连接配置的目标并双向转发数据。
+func TestForward(t *testing.T) {
+	serverConn := startMockClient(t)
+	go serveMock(t, serverConn, func(session *compress.Conn) {
+		defer session.Close()
+		br := bufio.NewReader(session)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect || req.Host != "10.0.0.5:22" {
+			t.Errorf("模拟服务器收到了意外的请求: %v %v", req, err)
+			return
+		}
+		session.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		up, _ := io.ReadAll(br)
+		session.Write(append([]byte("pong:"), up...))
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	defer ln.Close()
+	go serveForward(ln, config.Forward{Listen: ln.Addr().String(), Target: "10.0.0.5:22"})
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("连接转发端口失败: %v", err)
+	}
+	defer c.Close()
+	c.Write([]byte("ping"))
+	c.(*net.TCPConn).CloseWrite()
+	got, _ := io.ReadAll(c)
+	if string(got) != "pong:ping" {
+		t.Errorf("期望隧道返回 'pong:ping'，但得到 '%s'", got)
+	}
+}
+
+// TestForwardIdle 验证转发的连接空闲超过 IdleTimeout 后隧道仍然可用，例如长时间没有输入的 SSH 会话。
+func TestForwardIdle(t *testing.T) {
+	old := conf.IdleTimeout
+	t.Cleanup(func() { conf.IdleTimeout = old })
+	conf.IdleTimeout = 300 * time.Millisecond
+
+	serverConn := startMockClient(t)
+	go serveMock(t, serverConn, func(session *compress.Conn) {
+		defer session.Close()
+		br := bufio.NewReader(session)
+		if _, err := http.ReadRequest(br); err != nil {
+			return
+		}
+		session.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		io.Copy(session, br)
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	defer ln.Close()
+	go serveForward(ln, config.Forward{Listen: ln.Addr().String(), Target: "10.0.0.5:22"})
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("连接转发端口失败: %v", err)
+	}
+	defer c.Close()
+	buf := make([]byte, 5)
+	for _, msg := range []string{"hello", "again"} {
+		c.Write([]byte(msg))
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != msg {
+			t.Fatalf("期望隧道回显 '%s'，但得到 '%s' (%v)", msg, buf, err)
+		}
+		time.Sleep(3 * conf.IdleTimeout)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"icmptun/pkg/logging"
+	"icmptun/pkg/poll"
+	"icmptun/pkg/protocol"
+	"icmptun/pkg/tunnel"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// pathError reports that an ICMP error came back for one of our requests,
+// i.e. the server cannot be reached over the current path. Sessions it hits
+// fail once the error is confirmed instead of waiting for the idle timeout.
+type pathError struct {
+	From   net.Addr // the router or host that sent the error
+	Reason string
+}
+
+func (e *pathError) Error() string {
+	return fmt.Sprintf("到服务器的路径不通: %s 报告%s", e.From, e.Reason)
+}
+
+// pathErrorConfirm is how long a session waits after an ICMP error for any
+// authenticated reply from the server before it fails. The errors are not
+// authenticated, and a live session hears from the server at least every
+// poll.Hold even when it is idle, so a forged error or a short routing blip
+// leaves it alone while a path that stays broken still fails it quickly.
+var pathErrorConfirm = poll.Hold + time.Second
+
+// pathErrorReason describes an ICMP error that means the server is not
+// reachable. It returns false for errors that do not, such as
+// fragmentation needed, which only asks for smaller packets.
+func pathErrorReason(msg *icmp.Message) (string, []byte, bool) {
+	switch body := msg.Body.(type) {
+	case *icmp.DstUnreach:
+		switch msg.Type {
+		case ipv4.ICMPTypeDestinationUnreachable:
+			switch msg.Code {
+			case 0:
+				return "网络不可达", body.Data, true
+			case 1:
+				return "主机不可达", body.Data, true
+			case 2:
+				return "协议不可达", body.Data, true
+			case 4:
+				return "", nil, false
+			case 9, 10, 13:
+				return "通信被管理性禁止", body.Data, true
+			}
+		case ipv6.ICMPTypeDestinationUnreachable:
+			switch msg.Code {
+			case 0:
+				return "没有到目的地址的路由", body.Data, true
+			case 1:
+				return "通信被管理性禁止", body.Data, true
+			case 3:
+				return "地址不可达", body.Data, true
+			}
+		}
+		return fmt.Sprintf("目的不可达（代码 %d）", msg.Code), body.Data, true
+	case *icmp.TimeExceeded:
+		// Code 1 is a reassembly timeout, which loses one packet but says
+		// nothing about the path.
+		if msg.Code == 0 {
+			return "传输中 TTL 耗尽，可能存在路由环路", body.Data, true
+		}
+	}
+	return "", nil, false
+}
+
+// handleICMPError fails the session an ICMP error was sent for, unless the
+// server is heard from within pathErrorConfirm; until then its streams keep
+// retransmitting as usual. The error is matched by the quoted destination,
+// which must be the session's server, and by the session header or, when the
+// router quoted too little, the Echo ID, which NATs translate back in quoted
+// headers. Packet too big messages only shrink the sessions' segments.
+func handleICMPError(from net.Addr, msg *icmp.Message) {
+	if mtu, data, ok := protocol.PacketTooBig(msg); ok {
+		handlePacketTooBig(from, mtu, data)
+		return
+	}
+	reason, data, ok := pathErrorReason(msg)
+	if !ok {
+		return
+	}
+	q, ok := family.ParseQuoted(data)
+	if !ok || q.Type != family.Request {
+		return
+	}
+	id := q.Echo.ID
+	if session, ok := q.Session(); ok {
+		id = int(session)
+	}
+	sess, found := sessions.Get(id)
+	if !found || !sess.dst.IP.Equal(q.Dst) {
+		logging.Debugf("忽略来自 %s 的 ICMP 差错（%s），不属于任何会话", from, reason)
+		return
+	}
+	err := &pathError{From: from, Reason: reason}
+	if sess.confirmPathError(id, err) {
+		logging.Infof("会话 %d 收到路径差错: %v (Seq=%d)，%v 内没有收到服务器的回复则失败", id, err, q.Echo.Seq, pathErrorConfirm)
+	}
+}
+
+// confirmPathError fails the session with err unless an authenticated reply
+// from the server arrives within pathErrorConfirm. It returns false when an
+// earlier error is already being confirmed.
+func (s *session) confirmPathError(id int, err error) bool {
+	if !s.suspect.CompareAndSwap(false, true) {
+		return false
+	}
+	at := time.Now().UnixNano()
+	time.AfterFunc(pathErrorConfirm, func() {
+		s.suspect.Store(false)
+		if s.heard.Load() > at {
+			logging.Infof("会话 %d 在路径差错之后仍收到服务器的回复，继续使用", id)
+			return
+		}
+		log.Printf("会话 %d 失败: %v", id, err)
+		s.Fail(err)
+	})
+	return true
+}
+
+// handlePacketTooBig lowers the segment size of every session to the
+// destination of the quoted request. The MTU belongs to the path rather than
+// to one session, so sessions that have not hit it yet shrink as well.
+// Only raw sockets see these messages; on a ping socket the kernel keeps
+// them to itself and the sessions rely on their own probing.
+func handlePacketTooBig(from net.Addr, mtu int, data []byte) {
+	q, ok := family.ParseQuoted(data)
+	if !ok || q.Type != family.Request {
+		return
+	}
+	// Routers predating RFC 1191 report no MTU; 0 makes the sessions fall
+	// back to the size every path is expected to carry.
+	mss := 0
+	if mtu > 0 {
+		mss = max(family.ChunkSize(mtu)-tunnel.PacketOverhead, 1)
+	}
+	logging.Infof("%s 报告到 %s 的路径 MTU 为 %d，减小报文", from, q.Dst, mtu)
+	sessions.Range(func(id int, sess *session) {
+		if sess.dst.IP.Equal(q.Dst) {
+			sess.LimitMSS(mss)
+		}
+	})
+}
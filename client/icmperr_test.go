@@ -0,0 +1,152 @@
+package main
+
+import (
+	"icmptun/internal/icmptest"
+	"icmptun/pkg/compress"
+	"icmptun/pkg/protocol"
+	"icmptun/pkg/tunnel"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// shortPathErrorConfirm 缩短路径差错的确认时间，在监听退出之后才恢复
+func shortPathErrorConfirm(t *testing.T) {
+	old := pathErrorConfirm
+	t.Cleanup(func() { pathErrorConfirm = old })
+	pathErrorConfirm = 300 * time.Millisecond
+}
+
+// TestClientFailsOnUnreachable 验证路由器报告服务器不可达、之后再也收不到服务器的回复时，
+// 请求在确认时间后失败而不是等到超时
+func TestClientFailsOnUnreachable(t *testing.T) {
+	shortPathErrorConfirm(t)
+	serverConn := startMockClient(t)
+
+	// 路径上的路由器对第一个请求回复主机不可达，并引用请求的全部内容
+	router := &net.IPAddr{IP: net.IPv4(192, 0, 2, 254)}
+	go func() {
+		buf := make([]byte, protocol.MaxPacketSize)
+		n, _, err := serverConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		unreach := &icmp.Message{
+			Type: ipv4.ICMPTypeDestinationUnreachable,
+			Code: 1,
+			Body: &icmp.DstUnreach{Data: icmptest.QuoteIPv4(net.ParseIP(conf.ServerAddr), 0, buf[:n])},
+		}
+		b, _ := unreach.Marshal()
+		serverConn.WriteTo(b, router)
+	}()
+
+	start := time.Now()
+	req := httptest.NewRequest("GET", "http://example.com/unreachable", nil)
+	rr := httptest.NewRecorder()
+	handleHTTPProxyRequest(rr, req)
+
+	if elapsed := time.Since(start); elapsed > pathErrorConfirm+2*time.Second {
+		t.Errorf("request failed after %v, want a failure soon after %v", elapsed, pathErrorConfirm)
+	}
+	if rr.Code != http.StatusBadGateway || !strings.Contains(rr.Body.String(), "主机不可达") || !strings.Contains(rr.Body.String(), router.String()) {
+		t.Errorf("期望 502 和路由器的报告，但得到 %d '%s'", rr.Code, rr.Body.String())
+	}
+}
+
+// blipConn 模拟一次短暂的路由故障：第一个请求到达服务器的同时，路由器还对它回复了主机不可达
+type blipConn struct {
+	packetConn
+	once sync.Once
+}
+
+func (b *blipConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := b.packetConn.ReadFrom(p)
+	if err == nil {
+		b.once.Do(func() {
+			unreach := &icmp.Message{
+				Type: ipv4.ICMPTypeDestinationUnreachable,
+				Code: 1,
+				Body: &icmp.DstUnreach{Data: icmptest.QuoteIPv4(net.ParseIP(conf.ServerAddr), 0, p[:n])},
+			}
+			msg, _ := unreach.Marshal()
+			b.WriteTo(msg, &net.IPAddr{IP: net.IPv4(192, 0, 2, 254)})
+		})
+	}
+	return n, addr, err
+}
+
+// TestClientSurvivesTransientUnreachable 验证不可达通知之后仍收到服务器的回复时，会话和请求都不受影响
+func TestClientSurvivesTransientUnreachable(t *testing.T) {
+	shortPathErrorConfirm(t)
+	serverConn := startMockClient(t)
+	go serveMock(t, &blipConn{packetConn: serverConn}, func(session *compress.Conn) {
+		simulateRequestAndResponse(t, session)
+	})
+
+	req := httptest.NewRequest("POST", "http://example.com/blip", strings.NewReader("still reachable"))
+	req.Header.Set("Content-Length", "15")
+	rr := httptest.NewRecorder()
+	handleHTTPProxyRequest(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "still reachable" {
+		t.Fatalf("期望 200 和 'still reachable'，但得到 %d '%s'", rr.Code, rr.Body.String())
+	}
+
+	sess, _, err := currentSession()
+	if err != nil {
+		t.Fatalf("currentSession failed: %v", err)
+	}
+	select {
+	case <-sess.Done():
+		t.Errorf("session failed after a transient error: %v", sess.Err())
+	case <-time.After(2 * pathErrorConfirm):
+	}
+}
+
+// TestClientPacketTooBigLowersMSS 验证需要分片的通知会把到服务器的会话降到路由器报告的 MTU 以内
+func TestClientPacketTooBigLowersMSS(t *testing.T) {
+	serverConn := startMockClient(t)
+
+	conn, _, err := openSession(conf.Tunnel())
+	if err != nil {
+		t.Fatalf("openSession failed: %v", err)
+	}
+	// 没有服务器完成握手，直接结束会话，免得它拖到空闲超时
+	defer conn.Fail(io.EOF)
+	before := conn.MSS()
+	conn.Write([]byte("GET ")) // 握手随第一次写入发出
+
+	buf := make([]byte, protocol.MaxPacketSize)
+	n, _, err := serverConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("reading the handshake failed: %v", err)
+	}
+	tooBig := &icmp.Message{
+		Type: ipv4.ICMPTypeDestinationUnreachable,
+		Code: 4,
+		Body: &icmp.DstUnreach{NextHopMTU: 1000, Data: icmptest.QuoteIPv4(net.ParseIP(conf.ServerAddr), 0, buf[:n])},
+	}
+	b, _ := tooBig.Marshal()
+	serverConn.WriteTo(b, &net.IPAddr{IP: net.IPv4(192, 0, 2, 254)})
+
+	want := protocol.IPv4.ChunkSize(1000) - tunnel.PacketOverhead
+	deadline := time.Now().Add(2 * time.Second)
+	for conn.MSS() != want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mss := conn.MSS(); mss != want {
+		t.Errorf("MSS = %d (was %d), want %d for a 1000-byte MTU", mss, before, want)
+	}
+	select {
+	case <-conn.Done():
+		t.Error("a packet too big message should not fail the session")
+	default:
+	}
+}
@@ -2,20 +2,28 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"errors"
+	"flag"
 	"fmt"
+	"icmptun/pkg/compress"
+	"icmptun/pkg/config"
+	"icmptun/pkg/logging"
+	"icmptun/pkg/poll"
 	"icmptun/pkg/protocol"
+	"icmptun/pkg/secure"
+	"icmptun/pkg/tunnel"
 	"io"
 	"log"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"sort"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
 )
 
 // packetConn 抽象了我们需要的最小连接接口，便于在测试中替换实现。
@@ -25,62 +33,222 @@ type packetConn interface {
 	Close() error
 }
 
-// responseMap safely stores and retrieves response channels for concurrent requests.
-type responseMap struct {
+// maxSessions is the number of distinct IDs the 16-bit ICMP ID field can hold.
+const maxSessions = 1 << 16
+
+// errSessionsExhausted is returned when every ICMP ID is held by a live or
+// lingering session.
+var errSessionsExhausted = errors.New("没有可用的会话 ID: 所有 ICMP ID 都在使用中")
+
+// sessionLinger is how long a session without streams stays open for the
+// next request before it is closed.
+const sessionLinger = 30 * time.Second
+
+// session pairs the streams multiplexed over one session ID with the
+// encrypted channel their frames travel through and the poller that lets the
+// server reply.
+type session struct {
+	*tunnel.Mux
+	channel *secure.Channel
+	poller  *poll.Poller
+	dst     *net.IPAddr // the server address the session sends to
+
+	// heard is the time, in Unix nanoseconds, of the last authenticated
+	// reply from the server; suspect is set while a path error is being
+	// confirmed, see confirmPathError.
+	heard   atomic.Int64
+	suspect atomic.Bool
+}
+
+// input decrypts a packet from the server and feeds the frame inside it to
+// its stream. Handshake packets are consumed by the channel.
+func (s *session) input(b []byte) error {
+	frame, err := s.channel.Open(b)
+	if err != nil || frame == nil {
+		return err
+	}
+	return s.Input(frame)
+}
+
+// sessionMap safely stores and retrieves the reliable sessions of concurrent requests.
+// It also allocates their IDs, so two live sessions never share one.
+type sessionMap struct {
 	sync.RWMutex
-	m map[int]chan *icmp.Echo
+	m map[int]*session
+	// next is the ID the next allocation starts searching from.
+	next int
 }
 
-func (r *responseMap) Get(id int) (chan *icmp.Echo, bool) {
-	r.RLock()
-	defer r.RUnlock()
-	ch, ok := r.m[id]
-	return ch, ok
+// newSessionMap starts allocating at a random ID so a restarted client does
+// not reuse the IDs its previous run may still have open on the server.
+func newSessionMap() *sessionMap {
+	return &sessionMap{m: make(map[int]*session), next: rand.IntN(maxSessions)}
+}
+
+func (s *sessionMap) Get(id int) (*session, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	sess, ok := s.m[id]
+	return sess, ok
+}
+
+// Open allocates an ID that no registered session uses and registers the
+// session newSession creates for it. IDs are handed out round-robin, so an ID
+// whose session just finished is the last one to be reused.
+func (s *sessionMap) Open(newSession func(id int) (*session, error)) (*session, int, error) {
+	s.Lock()
+	defer s.Unlock()
+	for i := 0; i < maxSessions; i++ {
+		id := (s.next + i) % maxSessions
+		if _, used := s.m[id]; used {
+			continue
+		}
+		sess, err := newSession(id)
+		if err != nil {
+			return nil, 0, err
+		}
+		s.next = (id + 1) % maxSessions
+		s.m[id] = sess
+		return sess, id, nil
+	}
+	return nil, 0, errSessionsExhausted
 }
 
-func (r *responseMap) Set(id int, ch chan *icmp.Echo) {
-	r.Lock()
-	defer r.Unlock()
-	r.m[id] = ch
+// Range calls f for every registered session.
+func (s *sessionMap) Range(f func(id int, sess *session)) {
+	s.RLock()
+	defer s.RUnlock()
+	for id, sess := range s.m {
+		f(id, sess)
+	}
 }
 
-func (r *responseMap) Delete(id int) {
-	r.Lock()
-	defer r.Unlock()
-	delete(r.m, id)
+// Remove deletes the session only if id still refers to sess.
+func (s *sessionMap) Remove(id int, sess *session) {
+	s.Lock()
+	defer s.Unlock()
+	if s.m[id] == sess {
+		delete(s.m, id)
+	}
 }
 
 var (
-	respChannels = &responseMap{m: make(map[int]chan *icmp.Echo)}
+	sessions = newSessionMap()
+	// current is the session new streams are opened on. All requests share
+	// it, and with it one handshake and one set of polls, until it ends.
+	current struct {
+		sync.Mutex
+		sess *session
+		id   int
+	}
 	// Global shared ICMP connection. Using a minimal interface
 	// so tests can provide a mock implementation.
 	icmpConn packetConn
+	// authenticator signs outgoing frames and verifies replies with the pre-shared key.
+	authenticator *protocol.Authenticator
+	// conf holds the settings from flags and the config file.
+	conf = config.Default(config.Client)
+	// family is the ICMP flavour spoken to the server, chosen by the
+	// address family of the server address.
+	family = protocol.IPv4
 )
 
 func main() {
 	var err error
+	conf, err = config.Load(config.Client, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("严重错误: %v", err)
+	}
+	logging.SetLevel(conf.LogLevel)
+	authenticator, err = protocol.NewAuthenticator([]byte(conf.Key))
+	if err != nil {
+		log.Fatalf("严重错误: %v", err)
+	}
+
+	// An IPv6 server address switches the tunnel to ICMPv6.
+	if _, family, err = protocol.ResolveFamily(conf.ServerAddr); err != nil {
+		log.Fatalf("严重错误: 解析服务器地址 %s 失败: %v", conf.ServerAddr, err)
+	}
+
 	// Initialize the global ICMP connection.
-	icmpConn, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	conn, err := listenICMP()
 	if err != nil {
-		log.Fatalf("严重错误: 监听 ICMP 失败: %v. (可能需要 root 权限)", err)
+		log.Fatalf("严重错误: 监听 ICMP 失败: %v. (需要 root 权限，或让当前用户的组位于 net.ipv4.ping_group_range 之内)", err)
 	}
+	icmpConn = conn
 	defer icmpConn.Close()
 
+	// Probing needs oversized packets dropped rather than fragmented,
+	// otherwise it finds the reassembly limit instead of the path MTU.
+	if conf.PMTUDiscovery {
+		if err := family.SetDontFragment(conn); err != nil {
+			logging.Infof("无法禁止 ICMP 报文分片 (%v)，探测到的报文大小可能依赖分片", err)
+		}
+	}
+
 	// Start the ICMP response listener in the background.
-	go listenForICMPResponses()
+	go listenForICMPResponses(conn)
+	if len(conf.Compression) > 0 {
+		go logCompressTotals(10 * time.Minute)
+	}
+
+	// Start the optional SOCKS5 listener.
+	if conf.SocksAddr != "" {
+		ln, err := net.Listen("tcp", conf.SocksAddr)
+		if err != nil {
+			log.Fatalf("启动 SOCKS5 代理失败: %v", err)
+		}
+		log.Printf("SOCKS5 代理已在 %s 启动", conf.SocksAddr)
+		go serveSOCKS(ln)
+	}
+
+	// Start the static port forwards.
+	for _, fw := range conf.Forwards {
+		ln, err := net.Listen("tcp", fw.Listen)
+		if err != nil {
+			log.Fatalf("启动端口转发 %s 失败: %v", fw.Listen, err)
+		}
+		log.Printf("端口转发已在 %s 启动，目标 %s", fw.Listen, fw.Target)
+		go serveForward(ln, fw)
+	}
+
+	// Ask the server to listen for the remote forwards.
+	for _, fw := range conf.RemoteForwards {
+		go serveRemoteForward(fw)
+	}
 
 	// Start the local HTTP proxy server.
 	http.HandleFunc("/", handleHTTPProxyRequest)
-	log.Printf("HTTP 代理已在 %s 启动", protocol.LocalProxyAddr)
-	log.Printf("请将您的浏览器或系统配置使用 HTTP 代理: %s", protocol.LocalProxyAddr)
-	if err := http.ListenAndServe(protocol.LocalProxyAddr, nil); err != nil {
+	log.Printf("HTTP 代理已在 %s 启动，服务器 %s", conf.ListenAddr, conf.ServerAddr)
+	log.Printf("请将您的浏览器或系统配置使用 HTTP 代理: %s", conf.ListenAddr)
+	if err := http.ListenAndServe(conf.ListenAddr, nil); err != nil {
 		log.Fatalf("启动 HTTP 代理失败: %v", err)
 	}
 }
 
+// logCompressTotals periodically logs how much compression has saved across
+// all sessions, skipping intervals without traffic.
+func logCompressTotals(interval time.Duration) {
+	var last compress.Stats
+	for range time.Tick(interval) {
+		if s := compress.Totals(); s != last {
+			logging.Infof("压缩统计: %v", s)
+			last = s
+		}
+	}
+}
+
 // handleHTTPProxyRequest is the handler for our local HTTP proxy.
 func handleHTTPProxyRequest(w http.ResponseWriter, r *http.Request) {
-	log.Printf("代理请求: %s %s", r.Method, r.URL)
+	logging.Infof("代理请求: %s %s", r.Method, r.URL)
+
+	if r.Method == http.MethodConnect {
+		handleConnect(w, r)
+		return
+	}
 
 	reqBytes, err := httputil.DumpRequest(r, true)
 	if err != nil {
@@ -88,18 +256,18 @@ func handleHTTPProxyRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// ICMP ID 字段只有 16 位，因此我们只取时间戳的低 16 位作为请求 ID
-	requestID := int(time.Now().UnixNano() & 0xffff)
-	respBytes, err := sendICMPRequest(requestID, reqBytes)
+	conn, requestID, err := sendICMPRequest(reqBytes)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
+	defer conn.Close()
 
-	log.Printf("收到 %d 字节的代理响应", len(respBytes))
-	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respBytes)), r)
+	// The response is parsed straight from the session, so the browser sees
+	// the headers and the first bytes of the body as soon as they arrive.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), r)
 	if err != nil {
-		http.Error(w, "解析服务器响应失败", http.StatusInternalServerError)
+		writeTunnelError(w, requestID, err)
 		return
 	}
 	defer resp.Body.Close()
@@ -110,85 +278,350 @@ func handleHTTPProxyRequest(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	n, err := copyResponseBody(w, resp.Body)
+	if err != nil {
+		log.Printf("请求 %d 的响应中断: %v", requestID, err)
+		return
+	}
+	logging.Infof("请求 %d 的响应接收完毕，共 %d 字节", requestID, n)
+	logging.Debugf("请求 %d 的压缩统计: %v", requestID, conn.Stats())
 }
 
-// sendICMPRequest sends data using the global connection.
-func sendICMPRequest(requestID int, data []byte) ([]byte, error) {
-	dst, err := net.ResolveIPAddr("ip4", protocol.ServerAddr)
+// writeTunnelError replies to the browser with a status that matches why the
+// session failed: upstream failures reported by the server through an error
+// frame become 502/504 with the server's description, a silent server 504
+// and an ICMP error on the way to the server 502 with the router's report.
+func writeTunnelError(w http.ResponseWriter, requestID int, err error) {
+	var remote *tunnel.RemoteError
+	var path *pathError
+	switch {
+	case errors.As(err, &remote):
+		status := http.StatusBadGateway
+		switch remote.Code {
+		case tunnel.ErrCodeTimeout:
+			status = http.StatusGatewayTimeout
+		case tunnel.ErrCodeBadRequest:
+			status = http.StatusBadRequest
+		}
+		log.Printf("请求 %d 被服务器报告失败: %v", requestID, remote)
+		http.Error(w, fmt.Sprintf("代理服务器报告%s: %s", remote.Code, remote.Message), status)
+	case errors.Is(err, tunnel.ErrTimeout):
+		http.Error(w, fmt.Sprintf("请求 %d 超时: 代理服务器无响应", requestID), http.StatusGatewayTimeout)
+	case errors.As(err, &path):
+		http.Error(w, fmt.Sprintf("请求 %d 失败: %v", requestID, path), http.StatusBadGateway)
+	default:
+		http.Error(w, fmt.Sprintf("请求 %d 失败: %v", requestID, err), http.StatusServiceUnavailable)
+	}
+}
+
+// copyResponseBody writes each chunk of the body to the browser and flushes
+// it immediately instead of waiting for the whole response.
+func copyResponseBody(w http.ResponseWriter, body io.Reader) (int64, error) {
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	var total int64
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return total, werr
+			}
+			rc.Flush()
+			total += int64(n)
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// handleConnect handles HTTPS tunneling: it asks the server to dial the
+// target, hijacks the browser connection and relays raw bytes both ways.
+func handleConnect(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "不支持连接劫持", http.StatusInternalServerError)
+		return
+	}
+	reqBytes, err := httputil.DumpRequest(r, false)
 	if err != nil {
-		return nil, fmt.Errorf("解析服务器地址失败: %w", err)
+		http.Error(w, "请求转储失败", http.StatusInternalServerError)
+		return
 	}
 
-	ch := make(chan *icmp.Echo, 100)
-	respChannels.Set(requestID, ch)
-	defer respChannels.Delete(requestID)
+	conn, requestID, err := openSession(conf.Tunnel())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer conn.Close()
+
+	// The session starts with the CONNECT request; the server answers with a status line.
+	if _, err := conn.Write(reqBytes); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, r)
+	if err != nil {
+		writeTunnelError(w, requestID, err)
+		return
+	}
+	// A 2xx reply to CONNECT has no body, everything after the header is tunnel data,
+	// so resp.Body must not be read or closed here.
+	if resp.StatusCode != http.StatusOK {
+		http.Error(w, resp.Status, resp.StatusCode)
+		return
+	}
+
+	clientConn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("劫持连接失败: %v", err)
+		return
+	}
+	defer clientConn.Close()
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+	logging.Infof("隧道 %d 已建立: %s", requestID, r.Host)
 
+	// Uplink: browser bytes go into the session until the browser closes.
+	go func() {
+		io.Copy(conn, bufrw)
+		conn.CloseWrite()
+	}()
+
+	// Downlink: session bytes go to the browser until the server closes.
+	if _, err := io.Copy(clientConn, br); err != nil {
+		log.Printf("隧道 %d 异常结束: %v", requestID, err)
+		return
+	}
+	logging.Infof("隧道 %d 已被服务器关闭", requestID)
+}
+
+// listenICMP opens a raw ICMP socket, falling back to an unprivileged ping
+// socket when the process may not open raw sockets. The kernel rewrites the
+// Echo ID of a ping socket, which is harmless because sessions are told
+// apart by the session header in the payload.
+func listenICMP() (net.PacketConn, error) {
+	conn, err := icmp.ListenPacket(family.Network, family.Unspecified)
+	if err == nil || !errors.Is(err, os.ErrPermission) {
+		return conn, err
+	}
+	logging.Infof("没有创建原始 ICMP 套接字的权限 (%v)，改用非特权 ping 套接字", err)
+	return icmp.ListenPacket(family.Datagram, family.Unspecified)
+}
+
+// openSession opens a stream to the server on the current session, starting
+// a session first when there is none. The payload is compressed with a codec
+// negotiated with the server. The returned request ID is the stream ID, which
+// the server logs as well.
+func openSession(cfg tunnel.Config) (*compress.Conn, int, error) {
+	sess, sessionID, err := currentSession()
+	if err != nil {
+		return nil, 0, err
+	}
+	stream, err := sess.Open(cfg)
+	if err != nil {
+		// The session ended or ran out of stream IDs after it was looked
+		// up, e.g. it just went idle; a fresh one takes the stream.
+		dropSession(sess)
+		if sess, sessionID, err = currentSession(); err != nil {
+			return nil, 0, err
+		}
+		if stream, err = sess.Open(cfg); err != nil {
+			return nil, 0, err
+		}
+	}
+	logging.Debugf("请求 %d 使用会话 %d", stream.ID(), sessionID)
+	return compress.NewConn(stream, conf.Compression), int(stream.ID()), nil
+}
+
+// currentSession returns the session new streams are opened on, starting one
+// when there is none or the previous one has ended.
+func currentSession() (*session, int, error) {
+	current.Lock()
+	defer current.Unlock()
+	if current.sess != nil && current.sess.Err() == nil {
+		return current.sess, current.id, nil
+	}
+	sess, id, err := startSession()
+	if err != nil {
+		return nil, 0, err
+	}
+	current.sess, current.id = sess, id
+	return sess, id, nil
+}
+
+// dropSession stops opening streams on sess. Streams already open on it
+// carry on until they finish.
+func dropSession(sess *session) {
+	current.Lock()
+	defer current.Unlock()
+	if current.sess == sess {
+		current.sess = nil
+	}
+}
+
+// startSession allocates a session ID and starts a session to the server,
+// encrypted with keys negotiated for this session alone. The session closes
+// after lingering idle for sessionLinger. It, and with it the ID, is released
+// some time after it ends, so late replies are not delivered to a newer session.
+func startSession() (*session, int, error) {
+	dst, err := net.ResolveIPAddr(family.IPNetwork, conf.ServerAddr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("解析服务器地址失败: %w", err)
+	}
+
+	// The session keeps sending through the socket and family it started
+	// with, even if the globals are replaced while it winds down.
+	conn, family := icmpConn, family
+	sess, sessionID, err := sessions.Open(func(id int) (*session, error) {
+		var seq atomic.Uint32
+		nextSeq := func() int { return int(uint16(seq.Add(1) - 1)) }
+		// Polls are empty authenticated requests. They start after the
+		// handshake packet, so the server never sees a poll for a session
+		// it does not know.
+		poller := poll.NewPoller(conf.Polls, nextSeq, func(seq int) error {
+			return sendEcho(conn, family, dst, id, seq, authenticator.Seal(protocol.ClientToServer, protocol.AppendSession(nil, uint32(id), nil)))
+		})
+		channel, err := secure.NewInitiator(uint32(id), func(b []byte) error {
+			err := sendEcho(conn, family, dst, id, nextSeq(), authenticator.Seal(protocol.ClientToServer, protocol.AppendSession(nil, uint32(id), b)))
+			poller.Start()
+			return err
+		})
+		if err != nil {
+			poller.Close()
+			return nil, fmt.Errorf("创建加密通道失败: %w", err)
+		}
+		return &session{Mux: tunnel.NewMux(conf.Tunnel(), true, sessionLinger, channel.Seal), channel: channel, poller: poller, dst: dst}, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	logging.Debugf("会话 %d 已创建", sessionID)
+	go func() {
+		<-sess.Done()
+		logging.Debugf("会话 %d 结束: %v", sessionID, sess.Err())
+		time.Sleep(tunnel.TimeWait)
+		sessions.Remove(sessionID, sess)
+		sess.poller.Close()
+	}()
+	return sess, sessionID, nil
+}
+
+// sendEcho writes a single Echo request carrying one session segment to conn.
+func sendEcho(conn packetConn, family *protocol.Family, dst net.Addr, requestID, seq int, data []byte) error {
 	msg := &icmp.Message{
-		Type: ipv4.ICMPTypeEcho,
+		Type: family.Request,
 		Code: 0,
 		Body: &icmp.Echo{
-			ID:   requestID, // Use the unique request ID as the session identifier.
-			Seq:  0,         // Sequence for the request itself is 0.
+			ID:   requestID,
+			Seq:  seq,
 			Data: data,
 		},
 	}
-	msgBytes, err := msg.Marshal(nil)
+	msgBytes, err := msg.Marshal()
 	if err != nil {
-		return nil, fmt.Errorf("ICMP 请求封包失败: %w", err)
+		return fmt.Errorf("ICMP 请求封包失败: %w", err)
 	}
-	if _, err := icmpConn.WriteTo(msgBytes, dst); err != nil {
-		return nil, fmt.Errorf("ICMP 请求写入失败: %w", err)
+	if _, err := conn.WriteTo(msgBytes, dst); err != nil {
+		return fmt.Errorf("ICMP 请求写入失败: %w", err)
 	}
+	return nil
+}
 
-	var responsePackets []*icmp.Echo
-	timeout := time.After(30 * time.Second)
-	for {
-		select {
-		case packet := <-ch:
-			if len(packet.Data) == 0 {
-				log.Printf("请求 %d 的响应接收完毕", requestID)
-				// Sort packets by sequence number before joining
-				sort.Slice(responsePackets, func(i, j int) bool {
-					return responsePackets[i].Seq < responsePackets[j].Seq
-				})
-				// Join the data from the sorted packets
-				var responseChunks [][]byte
-				for _, p := range responsePackets {
-					responseChunks = append(responseChunks, p.Data)
-				}
-				return bytes.Join(responseChunks, nil), nil
-			}
-			responsePackets = append(responsePackets, packet)
-		case <-timeout:
-			return nil, fmt.Errorf("请求 %d 超时", requestID)
-		}
+// sendICMPRequest opens a new stream and sends the request through it.
+// The caller reads the response from the returned stream.
+func sendICMPRequest(data []byte) (*compress.Conn, int, error) {
+	cfg := conf.Tunnel()
+	cfg.IdleTimeout = conf.RequestTimeout
+	conn, requestID, err := openSession(cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// The stream fragments the request into Echo requests of the session's
+	// current MSS, which path MTU discovery and compression keep changing,
+	// so only the request size is logged.
+	logging.Infof("请求 %d 共 %d 字节", requestID, len(data))
+	if _, err := conn.Write(data); err != nil {
+		conn.Close()
+		return nil, 0, fmt.Errorf("请求 %d 发送失败: %w", requestID, err)
 	}
+	return conn, requestID, nil
 }
 
-// listenForICMPResponses uses the global connection.
-func listenForICMPResponses() {
+// kernelEchoOnce limits the kernel echo warning to one per run.
+var kernelEchoOnce sync.Once
+
+// isKernelEcho reports whether an Echo reply carries one of our own requests,
+// which is what the server's kernel sends back when it answers pings itself.
+// Requests are sealed for the client-to-server direction, so they never pass
+// as a server reply.
+func isKernelEcho(data []byte) bool {
+	_, err := authenticator.Open(protocol.ClientToServer, data)
+	return err == nil
+}
+
+// listenForICMPResponses reads server replies and ICMP errors from conn
+// until it is closed.
+func listenForICMPResponses(conn packetConn) {
+	// ParseMessage copies the payload, so the read buffer can be reused.
+	buf := make([]byte, protocol.MaxPacketSize)
 	for {
-		buf := make([]byte, 1500)
-		n, addr, err := icmpConn.ReadFrom(buf)
+		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && !netErr.Temporary() {
-				log.Printf("ICMP 监听器关闭: %v", err)
-				break
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				log.Printf("从 ICMP (监听器) 读取错误: %v", err)
+				continue
 			}
-			log.Printf("从 ICMP (监听器) 读取错误: %v", err)
-			continue
+			log.Printf("ICMP 监听器关闭: %v", err)
+			return
 		}
 
-		msg, err := icmp.ParseMessage(ipv4.ICMPTypeEchoReply.Protocol(), buf[:n])
+		msg, err := icmp.ParseMessage(family.Protocol, buf[:n])
 		if err != nil {
 			continue
 		}
 
-		if reply, ok := msg.Body.(*icmp.Echo); ok && msg.Type == ipv4.ICMPTypeEchoReply {
-			log.Printf("收到来自 %s 的响应包 ID=%d Seq=%d 长度=%d", addr, reply.ID, reply.Seq, len(reply.Data))
-			if ch, found := respChannels.Get(reply.ID); found {
-				ch <- reply
+		switch msg.Body.(type) {
+		case *icmp.DstUnreach, *icmp.TimeExceeded, *icmp.PacketTooBig:
+			handleICMPError(addr, msg)
+			continue
+		}
+
+		if reply, ok := msg.Body.(*icmp.Echo); ok && msg.Type == family.Reply {
+			// Replies that fail verification are not from our server, e.g. answers to ordinary pings.
+			data, err := authenticator.Open(protocol.ServerToClient, reply.Data)
+			if err != nil {
+				if isKernelEcho(reply.Data) {
+					kernelEchoOnce.Do(func() {
+						log.Printf("警告: 服务器内核在自动回复 Echo 请求，这些重复的回复会被丢弃；建议在服务端使用 -suppress-kernel-echo")
+					})
+					logging.Debugf("丢弃内核自动回复的 Echo ID=%d Seq=%d", reply.ID, reply.Seq)
+				}
+				continue
+			}
+			// NAT may rewrite the Echo ID, so the session is taken from the payload.
+			sessionID, packet, err := protocol.SplitSession(data)
+			if err != nil {
+				continue
+			}
+			logging.Debugf("收到来自 %s 的响应包 会话=%d ID=%d Seq=%d 长度=%d", addr, sessionID, reply.ID, reply.Seq, len(reply.Data))
+			// Every reply answers one of our requests; empty ones only return a poll.
+			if sess, found := sessions.Get(int(sessionID)); found {
+				sess.poller.Received(reply.Seq)
+				sess.heard.Store(time.Now().UnixNano())
+				if len(packet) == 0 {
+					continue
+				}
+				if err := sess.input(packet); err != nil {
+					log.Printf("会话 %d 丢弃无效帧: %v", sessionID, err)
+				}
 			}
 		}
 	}
@@ -3,13 +3,25 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"fmt"
+	"icmptun/pkg/compress"
+	"icmptun/pkg/poll"
+	"icmptun/pkg/protocol"
+	"icmptun/pkg/secure"
+	"icmptun/pkg/tunnel"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+	"net/url"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
@@ -22,6 +34,7 @@ type mockPacket struct {
 }
 
 type mockPacketConn struct {
+	mu   sync.Mutex
 	recv chan mockPacket
 	peer chan mockPacket
 }
@@ -32,6 +45,26 @@ func newMockPair() (*mockPacketConn, *mockPacketConn) {
 	return &mockPacketConn{recv: s2c, peer: c2s}, &mockPacketConn{recv: c2s, peer: s2c}
 }
 
+// startMockClient 把模拟连接对的一端设为客户端的 ICMP 连接并启动响应监听，返回模拟服务器的一端。
+// 测试结束时关闭两端、等待监听退出并结束当前会话，之后的测试才能替换全局变量；
+// 修改全局变量的测试要在调用它之前用 t.Cleanup 登记恢复，让恢复发生在监听退出之后
+func startMockClient(t *testing.T) *mockPacketConn {
+	clientConn, serverConn := newMockPair()
+	icmpConn = clientConn
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		listenForICMPResponses(clientConn)
+	}()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+		<-done
+		resetSession()
+	})
+	return serverConn
+}
+
 func (m *mockPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
 	p, ok := <-m.recv
 	if !ok {
@@ -41,15 +74,23 @@ func (m *mockPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
 	return len(p.data), p.addr, nil
 }
 
+// WriteTo 在对端队列已满时丢弃数据包，与真实网络一样由会话层负责重传
 func (m *mockPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.peer == nil {
 		return 0, io.ErrClosedPipe
 	}
-	m.peer <- mockPacket{data: append([]byte(nil), b...), addr: addr}
+	select {
+	case m.peer <- mockPacket{data: append([]byte(nil), b...), addr: addr}:
+	default:
+	}
 	return len(b), nil
 }
 
 func (m *mockPacketConn) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.peer != nil {
 		close(m.peer)
 		m.peer = nil
@@ -57,30 +98,119 @@ func (m *mockPacketConn) Close() error {
 	return nil
 }
 
+// serveMock mimics the server: every handshake from a new session ID opens an
+// encrypted session whose replies go back through conn, and handler runs on
+// each stream the client opens on it.
+// Like the server, it only sends replies to pending requests, using their Seq.
+func serveMock(t *testing.T, conn packetConn, handler func(*compress.Conn)) {
+	// 前一个测试的模拟服务器可能仍在读取残留的报文，因此在启动时固定地址族
+	family := family
+	sessions := make(map[uint32]*serverSession)
+	buf := make([]byte, protocol.MaxPacketSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		msg, err := icmp.ParseMessage(family.Protocol, buf[:n])
+		if err != nil {
+			t.Errorf("模拟服务器解析 ICMP 消息失败: %v", err)
+			return
+		}
+		reqEcho, ok := msg.Body.(*icmp.Echo)
+		if !ok || msg.Type != family.Request {
+			t.Errorf("模拟服务器收到了非 ECHO 请求")
+			return
+		}
+		if len(reqEcho.Data) > protocol.MaxChunkSize {
+			t.Errorf("请求分片长度 %d 超过了 MaxChunkSize", len(reqEcho.Data))
+		}
+		data, err := authenticator.Open(protocol.ClientToServer, reqEcho.Data)
+		if err != nil {
+			t.Errorf("模拟服务器校验请求失败: %v", err)
+			continue
+		}
+		sessionID, packet, err := protocol.SplitSession(data)
+		if err != nil {
+			t.Errorf("模拟服务器收到缺少会话 ID 的请求: %v", err)
+			continue
+		}
+		sess, found := sessions[sessionID]
+		if !found {
+			// 之前测试中残留会话的轮询请求会到达这里，和真实服务端一样忽略
+			if len(packet) == 0 {
+				continue
+			}
+			if hello, ok := secure.HelloSession(packet); !ok || hello != sessionID {
+				t.Errorf("新会话的第一个报文不是握手报文")
+				continue
+			}
+			// 回复包原样使用请求的 ID 和 Seq，会话 ID 放在负载中
+			queue := poll.NewQueue(func(id, seq int, b []byte) error {
+				data := authenticator.Seal(protocol.ServerToClient, protocol.AppendSession(nil, sessionID, b))
+				reply := &icmp.Message{
+					Type: family.Reply,
+					Body: &icmp.Echo{ID: id, Seq: seq, Data: data},
+				}
+				rb, err := reply.Marshal()
+				if err != nil {
+					return err
+				}
+				_, err = conn.WriteTo(rb, addr)
+				return err
+			})
+			channel, _ := secure.NewResponder(sessionID, queue.Send)
+			sess = &serverSession{session: session{Mux: tunnel.NewMux(tunnel.DefaultConfig(), false, time.Minute, channel.Seal), channel: channel}, queue: queue}
+			sessions[sessionID] = sess
+			go func() {
+				for {
+					stream, err := sess.Accept()
+					if err != nil {
+						return
+					}
+					go handler(compress.NewConn(stream, conf.Compression))
+				}
+			}()
+		}
+		if len(packet) > 0 {
+			sess.input(packet)
+		}
+		sess.queue.Request(reqEcho.ID, reqEcho.Seq)
+	}
+}
+
+// serverSession is a session on the mock server together with its downlink queue.
+type serverSession struct {
+	session
+	queue *poll.Queue
+}
+
+func TestMain(m *testing.M) {
+	authenticator, _ = protocol.NewAuthenticator([]byte("test-key"))
+	os.Exit(m.Run())
+}
+
 // TestClientProxyWorkflow simulates the entire client-side process using a shared connection.
 func TestClientProxyWorkflow(t *testing.T) {
 	// 1. 使用模拟连接对进行测试，避免需要 root 权限
-	clientConn, serverConn := newMockPair()
-	icmpConn = clientConn
-	defer icmpConn.Close()
-
-	// 2. Start the client's main response listener in the background.
-	go listenForICMPResponses()
+	serverConn := startMockClient(t)
 
-	// 3. Run the request and response simulation in a separate goroutine using the server side of the pair.
-	go simulateRequestAndResponse(t, serverConn)
+	// 2. Run the request and response simulation in a separate goroutine using the server side of the pair.
+	go serveMock(t, serverConn, func(session *compress.Conn) {
+		simulateRequestAndResponse(t, session)
+	})
 
-	// 4. Create a mock HTTP request, as if from a browser.
+	// 3. Create a mock HTTP request, as if from a browser.
 	requestPayload := "你好，服务器！"
 	req := httptest.NewRequest("POST", "http://example.com/foo", bytes.NewBufferString(requestPayload))
 	req.Header.Set("Content-Type", "text/plain")
 	req.Header.Set("Content-Length", strconv.Itoa(len(requestPayload)))
 	rr := httptest.NewRecorder()
 
-	// 5. Call the proxy handler. This will trigger the simulation.
+	// 4. Call the proxy handler. This will trigger the simulation.
 	handleHTTPProxyRequest(rr, req)
 
-	// 6. Verify the final response.
+	// 5. Verify the final response.
 	resp := rr.Result()
 	defer resp.Body.Close()
 
@@ -101,37 +231,253 @@ func TestClientProxyWorkflow(t *testing.T) {
 	t.Log("成功接收并验证了代理的响应。")
 }
 
-// simulateRequestAndResponse mimics the server's behavior using the server side connection.
-func simulateRequestAndResponse(t *testing.T, conn *mockPacketConn) {
-	// Read one packet from the shared connection (the client's request)
-	buf := make([]byte, 1500)
-	n, addr, err := conn.ReadFrom(buf)
+// TestClientIPv6 验证服务器地址是 IPv6 时，客户端改用 ICMPv6 Echo 请求并接受 ICMPv6 Echo Reply。
+func TestClientIPv6(t *testing.T) {
+	// 在监听退出之后才恢复地址族
+	old := conf.ServerAddr
+	t.Cleanup(func() { family, conf.ServerAddr = protocol.IPv4, old })
+	family = protocol.IPv6
+	conf.ServerAddr = "::1"
+
+	serverConn := startMockClient(t)
+	go serveMock(t, serverConn, func(session *compress.Conn) {
+		simulateRequestAndResponse(t, session)
+	})
+
+	req := httptest.NewRequest("POST", "http://example.com/v6", strings.NewReader("over icmpv6"))
+	req.Header.Set("Content-Length", "11")
+	rr := httptest.NewRecorder()
+	handleHTTPProxyRequest(rr, req)
+
+	resp := rr.Result()
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "over icmpv6" {
+		t.Errorf("期望 200 和 'over icmpv6'，但得到 %d '%s'", resp.StatusCode, body)
+	}
+}
+
+// natConn 模拟改写 Echo ID 的 NAT：服务端收到的每个请求 ID 都被替换，
+// 回复带着替换后的 ID 原样回到客户端
+type natConn struct {
+	packetConn
+	id int
+}
+
+func (n *natConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	size, addr, err := n.packetConn.ReadFrom(b)
 	if err != nil {
-		t.Errorf("模拟服务器读取 ICMP 包失败: %v", err)
-		return
+		return size, addr, err
+	}
+	msg, err := icmp.ParseMessage(ipv4.ICMPTypeEcho.Protocol(), b[:size])
+	if err != nil {
+		return size, addr, nil
+	}
+	msg.Body.(*icmp.Echo).ID = n.id
+	rewritten, _ := msg.Marshal()
+	return copy(b, rewritten), addr, nil
+}
+
+// TestClientBehindNAT 验证 Echo ID 被改写后，双方仍按负载中的会话 ID 找到会话。
+func TestClientBehindNAT(t *testing.T) {
+	serverConn := startMockClient(t)
+	go serveMock(t, &natConn{packetConn: serverConn, id: 0xbeef}, func(session *compress.Conn) {
+		simulateRequestAndResponse(t, session)
+	})
+
+	req := httptest.NewRequest("POST", "http://example.com/nat", strings.NewReader("behind nat"))
+	req.Header.Set("Content-Length", "10")
+	rr := httptest.NewRecorder()
+	handleHTTPProxyRequest(rr, req)
+
+	resp := rr.Result()
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "behind nat" {
+		t.Errorf("期望 200 和 'behind nat'，但得到 %d '%s'", resp.StatusCode, body)
 	}
-	t.Logf("服务器收到 %d 字节请求", n)
+}
+
+// kernelConn 模拟没有关闭 Echo 自动回复的服务器内核：每个请求都被原样回复一次
+type kernelConn struct {
+	packetConn
+}
 
-	msg, err := icmp.ParseMessage(ipv4.ICMPTypeEcho.Protocol(), buf[:n])
+func (k *kernelConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := k.packetConn.ReadFrom(b)
 	if err != nil {
-		t.Errorf("模拟服务器解析 ICMP 消息失败: %v", err)
-		return
+		return n, addr, err
+	}
+	if msg, err := icmp.ParseMessage(ipv4.ICMPTypeEcho.Protocol(), b[:n]); err == nil {
+		msg.Type = ipv4.ICMPTypeEchoReply
+		reflected, _ := msg.Marshal()
+		k.WriteTo(reflected, addr)
 	}
+	return n, addr, nil
+}
 
-	reqEcho, ok := msg.Body.(*icmp.Echo)
-	if !ok {
-		t.Errorf("模拟服务器收到了非 ECHO 请求")
-		return
+// TestClientDiscardsKernelEcho 验证内核原样回复的请求会被识别并丢弃，不会被当成响应数据。
+func TestClientDiscardsKernelEcho(t *testing.T) {
+	request := authenticator.Seal(protocol.ClientToServer, protocol.AppendSession(nil, 1, []byte("frame")))
+	reply := authenticator.Seal(protocol.ServerToClient, protocol.AppendSession(nil, 1, []byte("frame")))
+	if !isKernelEcho(request) || isKernelEcho(reply) || isKernelEcho([]byte("ordinary ping")) {
+		t.Fatal("isKernelEcho 应只识别客户端自己发出的请求")
 	}
 
-	// 回复包必须使用请求的 ID 作为会话标识
-	responseID := reqEcho.ID
+	serverConn := startMockClient(t)
+	go serveMock(t, &kernelConn{packetConn: serverConn}, func(session *compress.Conn) {
+		simulateRequestAndResponse(t, session)
+	})
 
-	// Create a fake HTTP response.
-	t.Logf("原始请求包:\n%s", string(reqEcho.Data))
-	httpReq, _ := http.ReadRequest(bufio.NewReader(bytes.NewReader(reqEcho.Data)))
+	req := httptest.NewRequest("POST", "http://example.com/echo", strings.NewReader("not a reflection"))
+	req.Header.Set("Content-Length", "16")
+	rr := httptest.NewRecorder()
+	handleHTTPProxyRequest(rr, req)
+
+	resp := rr.Result()
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "not a reflection" {
+		t.Errorf("期望 200 和 'not a reflection'，但得到 %d '%s'", resp.StatusCode, body)
+	}
+}
+
+// resetSession 结束客户端的所有会话，之后的请求在新会话上打开流
+func resetSession() {
+	current.Lock()
+	current.sess = nil
+	current.Unlock()
+	sessions.Range(func(_ int, sess *session) { sess.Fail(tunnel.ErrClosed) })
+}
+
+// TestClientLargeUpload 验证远大于 MTU 的请求体会被拆成多个 Echo 请求，并在服务端完整重组。
+func TestClientLargeUpload(t *testing.T) {
+	serverConn := startMockClient(t)
+	go serveMock(t, serverConn, func(session *compress.Conn) {
+		simulateRequestAndResponse(t, session)
+	})
+
+	payload := bytes.Repeat([]byte("upload-body-"), 4000) // 48000 字节，远超单个分片
+	req := httptest.NewRequest("POST", "http://example.com/upload", bytes.NewReader(payload))
+	req.Header.Set("Content-Length", strconv.Itoa(len(payload)))
+	rr := httptest.NewRecorder()
+
+	handleHTTPProxyRequest(rr, req)
+
+	resp := rr.Result()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("期望状态码为 OK (200)，但得到 %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(body, payload) {
+		t.Errorf("上传的请求体没有被完整重组: 得到 %d 字节，期望 %d 字节", len(body), len(payload))
+	}
+}
+
+// TestClientStreamingResponse 验证浏览器无需等待整个响应结束，就能读到已经到达的响应数据。
+func TestClientStreamingResponse(t *testing.T) {
+	serverConn := startMockClient(t)
+
+	release := make(chan struct{})
+	go serveMock(t, serverConn, func(session *compress.Conn) {
+		defer session.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(session)); err != nil {
+			t.Errorf("模拟服务器读取请求失败: %v", err)
+			return
+		}
+		session.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 22\r\n\r\nfirst-part;"))
+		<-release
+		session.Write([]byte("second-part"))
+	})
+
+	proxy := httptest.NewServer(http.HandlerFunc(handleHTTPProxyRequest))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	httpClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := httpClient.Get("http://example.com/stream")
+	if err != nil {
+		close(release)
+		t.Fatalf("通过代理请求失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	first := make([]byte, len("first-part;"))
+	readDone := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(resp.Body, first)
+		readDone <- err
+	}()
+	select {
+	case err := <-readDone:
+		if err != nil {
+			t.Fatalf("读取第一部分响应失败: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		close(release)
+		t.Fatal("响应没有被流式转发给浏览器")
+	}
+
+	close(release)
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("读取剩余响应失败: %v", err)
+	}
+	if got := string(first) + string(rest); got != "first-part;second-part" {
+		t.Errorf("期望响应体为 'first-part;second-part'，但得到 '%s'", got)
+	}
+}
+
+// TestClientErrorFrame 验证服务器通过错误帧报告的失败会立即转换为相应的状态码和描述。
+func TestClientErrorFrame(t *testing.T) {
+	tests := []struct {
+		code   tunnel.ErrorCode
+		status int
+	}{
+		{tunnel.ErrCodeDNS, http.StatusBadGateway},
+		{tunnel.ErrCodeConnect, http.StatusBadGateway},
+		{tunnel.ErrCodeTimeout, http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code.String(), func(t *testing.T) {
+			serverConn := startMockClient(t)
+			go serveMock(t, serverConn, func(session *compress.Conn) {
+				http.ReadRequest(bufio.NewReader(session))
+				session.CloseWithError(tt.code, "upstream detail")
+			})
+
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			rr := httptest.NewRecorder()
+			start := time.Now()
+			handleHTTPProxyRequest(rr, req)
+
+			if rr.Code != tt.status {
+				t.Errorf("期望状态码 %d，但得到 %d", tt.status, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), "upstream detail") {
+				t.Errorf("响应体应包含服务器报告的原因，但得到 %q", rr.Body.String())
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("错误响应耗时 %v，应当立即返回", elapsed)
+			}
+		})
+	}
+}
+
+// simulateRequestAndResponse mimics the server's behavior on one session:
+// it echoes the request body back in a complete HTTP response.
+func simulateRequestAndResponse(t *testing.T, session *compress.Conn) {
+	defer session.Close()
+	httpReq, err := http.ReadRequest(bufio.NewReader(session))
+	if err != nil {
+		t.Errorf("模拟服务器读取请求失败: %v", err)
+		return
+	}
 	reqBody, _ := io.ReadAll(httpReq.Body)
 	t.Logf("重建的请求体长度: %d", len(reqBody))
+
+	// Create a fake HTTP response.
 	httpResp := &http.Response{
 		Status:        "200 OK",
 		StatusCode:    http.StatusOK,
@@ -145,33 +491,175 @@ func simulateRequestAndResponse(t *testing.T, conn *mockPacketConn) {
 	httpResp.Header.Set("X-Test-Header", "true")
 	respBytes, _ := httputil.DumpResponse(httpResp, true)
 
-	// Send the response back in chunks.
-	chunk1 := respBytes[:len(respBytes)/2]
-	chunk2 := respBytes[len(respBytes)/2:]
-
-	// 响应包需要与请求 ID 匹配，每个分片使用递增的 Seq 编号。
-	sendChunk(t, conn, addr, responseID, 0, chunk1)
-	sendChunk(t, conn, addr, responseID, 1, chunk2)
-	sendChunk(t, conn, addr, responseID, 2, []byte{}) // Final packet
-	t.Log("服务器已发送所有分片")
+	// The session layer splits, acknowledges and retransmits the response.
+	if _, err := session.Write(respBytes); err != nil {
+		t.Errorf("模拟服务器发送响应失败: %v", err)
+		return
+	}
+	t.Log("服务器已发送完整响应")
 }
 
-func sendChunk(t *testing.T, conn *mockPacketConn, addr net.Addr, id, seq int, data []byte) {
-	reply := &icmp.Message{
-		Type: ipv4.ICMPTypeEchoReply,
-		Code: 0,
-		Body: &icmp.Echo{
-			ID:   id,  // 与请求 ID 一致
-			Seq:  seq, // 分片序号
-			Data: data,
-		},
+// TestClientConnectTunnel 验证 CONNECT 请求被劫持后，原始字节能通过模拟的 ICMP 隧道双向转发。
+func TestClientConnectTunnel(t *testing.T) {
+	serverConn := startMockClient(t)
+
+	proxy := httptest.NewServer(http.HandlerFunc(handleHTTPProxyRequest))
+	defer proxy.Close()
+
+	// 模拟服务端：确认 CONNECT，回显一段数据后关闭隧道
+	go serveMock(t, serverConn, func(session *compress.Conn) {
+		defer session.Close()
+		br := bufio.NewReader(session)
+		httpReq, err := http.ReadRequest(br)
+		if err != nil || httpReq.Method != http.MethodConnect || httpReq.Host != "example.com:443" {
+			t.Errorf("模拟服务器收到了意外的请求: %v %v", httpReq, err)
+			return
+		}
+		session.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+		up := make([]byte, 4)
+		if _, err := io.ReadFull(br, up); err != nil {
+			t.Errorf("模拟服务器读取上行数据失败: %v", err)
+			return
+		}
+		session.Write(append([]byte("pong:"), up...))
+	})
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("连接代理失败: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")); err != nil {
+		t.Fatalf("发送 CONNECT 失败: %v", err)
 	}
-	rb, err := reply.Marshal(nil)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
 	if err != nil {
-		t.Fatalf("封包块 %d 失败: %v", seq, err)
+		t.Fatalf("读取 CONNECT 响应失败: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("期望状态码 200，但得到 %d", resp.StatusCode)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("写入隧道数据失败: %v", err)
+	}
+	got, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatalf("读取隧道数据失败: %v", err)
+	}
+	if string(got) != "pong:ping" {
+		t.Errorf("期望隧道返回 'pong:ping'，但得到 '%s'", got)
+	}
+}
+
+// TestClientReusesSession 验证并发和先后发出的请求在同一个会话上各自打开流，
+// 会话结束后的请求会建立新会话
+func TestClientReusesSession(t *testing.T) {
+	serverConn := startMockClient(t)
+	var handshakes atomic.Int32
+	go serveMock(t, &handshakeCounter{packetConn: serverConn, n: &handshakes}, func(session *compress.Conn) {
+		simulateRequestAndResponse(t, session)
+	})
+
+	get := func(body string) {
+		req := httptest.NewRequest("POST", "http://example.com/reuse", strings.NewReader(body))
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		rr := httptest.NewRecorder()
+		handleHTTPProxyRequest(rr, req)
+		if rr.Code != http.StatusOK || rr.Body.String() != body {
+			t.Errorf("期望 200 和 '%s'，但得到 %d '%s'", body, rr.Code, rr.Body.String())
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get(fmt.Sprintf("concurrent %d", i))
+		}()
 	}
-	// Use the global icmpConn to write the response.
-	if _, err := conn.WriteTo(rb, addr); err != nil {
-		t.Fatalf("写入块 %d 失败: %v", seq, err)
+	wg.Wait()
+	get("sequential")
+	if n := handshakes.Load(); n != 1 {
+		t.Errorf("5 个请求进行了 %d 次握手，期望共用 1 个会话", n)
+	}
+
+	current.Lock()
+	first := current.sess
+	current.Unlock()
+	first.Close()
+	get("after close")
+	if n := handshakes.Load(); n != 2 {
+		t.Errorf("会话关闭后的请求进行了 %d 次握手，期望新建 1 个会话", n-1)
+	}
+}
+
+// handshakeCounter 统计模拟服务器收到的握手报文
+type handshakeCounter struct {
+	packetConn
+	n *atomic.Int32
+}
+
+func (h *handshakeCounter) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := h.packetConn.ReadFrom(b)
+	if err == nil {
+		if msg, err := icmp.ParseMessage(family.Protocol, b[:n]); err == nil {
+			if echo, ok := msg.Body.(*icmp.Echo); ok {
+				data, _ := authenticator.Open(protocol.ClientToServer, echo.Data)
+				if _, packet, err := protocol.SplitSession(data); err == nil {
+					if _, ok := secure.HelloSession(packet); ok {
+						h.n.Add(1)
+					}
+				}
+			}
+		}
+	}
+	return n, addr, err
+}
+
+// TestSessionMapUniqueIDs 验证并发打开的会话总是得到互不相同的 ID。
+func TestSessionMapUniqueIDs(t *testing.T) {
+	s := newSessionMap()
+	var mu sync.Mutex
+	seen := make(map[int]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, id, err := s.Open(func(int) (*session, error) { return &session{}, nil })
+			if err != nil {
+				t.Errorf("分配会话 ID 失败: %v", err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if seen[id] {
+				t.Errorf("会话 ID %d 被重复分配", id)
+			}
+			seen[id] = true
+		}()
+	}
+	wg.Wait()
+}
+
+// TestSessionMapExhaustion 验证 16 位 ID 用尽时返回错误，释放后可以重新分配。
+func TestSessionMapExhaustion(t *testing.T) {
+	s := newSessionMap()
+	conns := make([]*session, maxSessions)
+	for i := range conns {
+		conns[i] = &session{}
+		s.m[i] = conns[i]
+	}
+	if _, _, err := s.Open(func(int) (*session, error) { return &session{}, nil }); err != errSessionsExhausted {
+		t.Fatalf("期望 errSessionsExhausted，但得到 %v", err)
+	}
+
+	s.Remove(4242, conns[4242])
+	_, id, err := s.Open(func(int) (*session, error) { return &session{}, nil })
+	if err != nil || id != 4242 {
+		t.Errorf("期望重新分配已释放的 ID 4242，但得到 %d, %v", id, err)
 	}
 }
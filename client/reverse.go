@@ -0,0 +1,73 @@
+package main
+
+import (
+	"icmptun/pkg/config"
+	"icmptun/pkg/logging"
+	"icmptun/pkg/protocol"
+	"icmptun/pkg/tunnel"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// remoteForwardRetry is how long to wait before re-binding a remote forward
+// whose control session failed.
+const remoteForwardRetry = 5 * time.Second
+
+// serveRemoteForward keeps the server listening for fw, opening a new bind
+// session whenever the previous one ends.
+func serveRemoteForward(fw config.Forward) {
+	for {
+		err := bindRemoteForward(fw)
+		log.Printf("反向转发 %s 已断开: %v，%s 后重试", fw.Listen, err, remoteForwardRetry)
+		time.Sleep(remoteForwardRetry)
+	}
+}
+
+// bindRemoteForward asks the server to listen on fw.Listen and, for every
+// token it announces, takes over the accepted connection. The otherwise
+// quiet control session keeps itself alive with pings.
+func bindRemoteForward(fw config.Forward) error {
+	conn, tbr, requestID, err := openTunnel(protocol.MethodBind, "*", fw.Listen)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Printf("反向转发 %d 已建立: 服务端 %s -> %s", requestID, fw.Listen, fw.Target)
+
+	for {
+		line, err := tbr.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		go acceptRemoteForward(strings.TrimSpace(line), fw)
+	}
+}
+
+// acceptRemoteForward claims the server-side connection named by token and
+// relays it to fw.Target. If the target cannot be reached the session ends
+// with an error frame and the server closes its connection.
+func acceptRemoteForward(token string, fw config.Forward) {
+	conn, tbr, requestID, err := openTunnel(protocol.MethodAccept, "*", token)
+	if err != nil {
+		log.Printf("接管反向转发连接失败: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	c, err := net.DialTimeout("tcp", fw.Target, conf.RequestTimeout)
+	if err != nil {
+		log.Printf("反向转发连接 %s 失败: %v", fw.Target, err)
+		conn.CloseWithError(tunnel.ErrCodeConnect, err.Error())
+		return
+	}
+	defer c.Close()
+	logging.Infof("反向转发隧道 %d 已建立: %s -> %s", requestID, fw.Listen, fw.Target)
+
+	if err := relay(c, c, conn, tbr); err != nil {
+		log.Printf("反向转发隧道 %d 异常结束: %v", requestID, err)
+		return
+	}
+	logging.Infof("反向转发隧道 %d 已被服务器关闭", requestID)
+}
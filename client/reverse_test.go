@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"icmptun/pkg/compress"
+	"icmptun/pkg/config"
+	"icmptun/pkg/protocol"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestRemoteForward 验证客户端通过 BIND 会话收到令牌后，用 ACCEPT 会话接管连接并转发到本地目标。
+func TestRemoteForward(t *testing.T) {
+	// 本地目标读到 "hello" 后回复 "world" 并关闭连接
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		c, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 5)
+		io.ReadFull(c, buf)
+		if string(buf) == "hello" {
+			c.Write([]byte("world"))
+		}
+	}()
+
+	serverConn := startMockClient(t)
+
+	result := make(chan string, 1)
+	done := make(chan struct{})
+	go serveMock(t, serverConn, func(session *compress.Conn) {
+		defer session.Close()
+		br := bufio.NewReader(session)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			t.Errorf("模拟服务器读取请求失败: %v", err)
+			return
+		}
+		switch {
+		case req.Method == protocol.MethodBind && req.Host == "0.0.0.0:8022":
+			session.Write([]byte("HTTP/1.1 200 OK\r\n\r\ntoken-1\n"))
+			<-done
+		case req.Method == protocol.MethodAccept && req.Host == "token-1":
+			session.Write([]byte("HTTP/1.1 200 OK\r\n\r\nhello"))
+			got, _ := io.ReadAll(br)
+			result <- string(got)
+		default:
+			t.Errorf("模拟服务器收到了意外的请求: %s %s", req.Method, req.Host)
+		}
+	})
+
+	bound := make(chan error, 1)
+	go func() {
+		bound <- bindRemoteForward(config.Forward{Listen: "0.0.0.0:8022", Target: target.Addr().String()})
+	}()
+	select {
+	case got := <-result:
+		if got != "world" {
+			t.Errorf("期望本地目标返回 'world'，但得到 '%s'", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("反向转发连接没有被接管")
+	}
+
+	// 服务端关闭控制会话后 bindRemoteForward 应返回，由调用方负责重新建立
+	close(done)
+	select {
+	case <-bound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("控制会话关闭后 bindRemoteForward 没有返回")
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"icmptun/pkg/compress"
+	"icmptun/pkg/logging"
+	"icmptun/pkg/protocol"
+	"icmptun/pkg/socks"
+	"icmptun/pkg/tunnel"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// SOCKS5 protocol constants from RFC 1928 and RFC 1929.
+const (
+	socksVersion         = 5
+	socksAuthNone        = 0x00
+	socksAuthPassword    = 0x02
+	socksAuthUnavailable = 0xff
+	socksPasswordVersion = 1
+
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+
+	socksRepSucceeded          = 0x00
+	socksRepGeneralFailure     = 0x01
+	socksRepNetworkUnreachable = 0x03
+	socksRepHostUnreachable    = 0x04
+	socksRepConnectionRefused  = 0x05
+	socksRepCommandUnsupported = 0x07
+	socksRepAddrUnsupported    = 0x08
+)
+
+// serveSOCKS accepts SOCKS5 clients on ln until it is closed.
+func serveSOCKS(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handleSOCKS(c)
+	}
+}
+
+// handleSOCKS negotiates authentication, reads the request and serves
+// CONNECT or UDP ASSOCIATE through a tunnel session.
+func handleSOCKS(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	if err := socksAuthenticate(br, c); err != nil {
+		log.Printf("SOCKS5 握手失败 (%s): %v", c.RemoteAddr(), err)
+		return
+	}
+
+	var hdr [3]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return
+	}
+	if hdr[0] != socksVersion {
+		log.Printf("SOCKS5 请求版本错误 (%s): %d", c.RemoteAddr(), hdr[0])
+		return
+	}
+	host, port, err := socks.ReadAddr(br)
+	if errors.Is(err, socks.ErrAddrType) {
+		writeSOCKSReply(c, socksRepAddrUnsupported, nil)
+		return
+	}
+	if err != nil {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+
+	switch hdr[1] {
+	case socksCmdConnect:
+		socksConnect(c, br, target)
+	case socksCmdUDPAssociate:
+		socksUDPAssociate(c, br)
+	default:
+		writeSOCKSReply(c, socksRepCommandUnsupported, nil)
+	}
+}
+
+// socksAuthenticate picks username/password authentication when it is
+// configured and no authentication otherwise.
+func socksAuthenticate(br *bufio.Reader, w io.Writer) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socksVersion {
+		return fmt.Errorf("不支持的版本 %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return err
+	}
+	want := byte(socksAuthNone)
+	if conf.SocksUser != "" {
+		want = socksAuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == want
+	}
+	if !offered {
+		w.Write([]byte{socksVersion, socksAuthUnavailable})
+		return errors.New("客户端不支持所需的认证方式")
+	}
+	if _, err := w.Write([]byte{socksVersion, want}); err != nil {
+		return err
+	}
+	if want == socksAuthNone {
+		return nil
+	}
+
+	// RFC 1929: VER | ULEN | UNAME | PLEN | PASSWD
+	readField := func() ([]byte, error) {
+		n, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(br, b)
+		return b, err
+	}
+	ver, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	user, err := readField()
+	if err != nil {
+		return err
+	}
+	pass, err := readField()
+	if err != nil {
+		return err
+	}
+	userOK := subtle.ConstantTimeCompare(user, []byte(conf.SocksUser)) == 1
+	passOK := subtle.ConstantTimeCompare(pass, []byte(conf.SocksPassword)) == 1
+	if ver != socksPasswordVersion || !userOK || !passOK {
+		w.Write([]byte{socksPasswordVersion, 1})
+		return errors.New("用户名或密码错误")
+	}
+	_, err = w.Write([]byte{socksPasswordVersion, 0})
+	return err
+}
+
+// writeSOCKSReply sends a reply with the given code and bound address.
+func writeSOCKSReply(w io.Writer, rep byte, bound net.Addr) error {
+	host, port := "0.0.0.0", 0
+	if ua, ok := bound.(*net.UDPAddr); ok {
+		host, port = ua.IP.String(), ua.Port
+	}
+	b, err := socks.AppendAddr([]byte{socksVersion, rep, 0}, host, port)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// socksReplyCode maps a failure to open a tunnel to the closest SOCKS5 reply.
+func socksReplyCode(err error) byte {
+	var remote *tunnel.RemoteError
+	switch {
+	case errors.As(err, &remote) && (remote.Code == tunnel.ErrCodeDNS || remote.Code == tunnel.ErrCodeTimeout):
+		return socksRepHostUnreachable
+	case errors.As(err, &remote) && remote.Code == tunnel.ErrCodeConnect:
+		return socksRepConnectionRefused
+	case errors.Is(err, tunnel.ErrTimeout), errors.As(err, new(*pathError)):
+		return socksRepNetworkUnreachable
+	default:
+		return socksRepGeneralFailure
+	}
+}
+
+// openTunnel opens a session whose first bytes are a request with the given
+// method, request URI and Host header, and waits for the server to accept
+// it. The returned reader holds any tunnel bytes buffered after the
+// server's reply.
+func openTunnel(method, uri, host string) (*compress.Conn, *bufio.Reader, int, error) {
+	conn, requestID, err := openSession(conf.Tunnel())
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	req := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\n\r\n", method, uri, host)
+	if _, err := conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, nil, 0, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, nil, 0, fmt.Errorf("服务器拒绝了请求: %s", resp.Status)
+	}
+	return conn, br, requestID, nil
+}
+
+// socksConnect asks the server to dial target and relays bytes both ways.
+func socksConnect(c net.Conn, br *bufio.Reader, target string) {
+	conn, tbr, requestID, err := openTunnel(http.MethodConnect, target, target)
+	if err != nil {
+		log.Printf("SOCKS5 连接 %s 失败: %v", target, err)
+		writeSOCKSReply(c, socksReplyCode(err), nil)
+		return
+	}
+	defer conn.Close()
+	if err := writeSOCKSReply(c, socksRepSucceeded, nil); err != nil {
+		return
+	}
+	logging.Infof("SOCKS5 隧道 %d 已建立: %s", requestID, target)
+
+	if err := relay(c, br, conn, tbr); err != nil {
+		log.Printf("SOCKS5 隧道 %d 异常结束: %v", requestID, err)
+		return
+	}
+	logging.Infof("SOCKS5 隧道 %d 已被服务器关闭", requestID)
+}
+
+// socksUDPAssociate relays datagrams between a local UDP socket and a tunnel
+// session. Only datagrams from the client's IP are accepted, replies go to
+// the address the client last sent from, and the association ends when the
+// control connection closes.
+func socksUDPAssociate(c net.Conn, br *bufio.Reader) {
+	localHost, _, _ := net.SplitHostPort(c.LocalAddr().String())
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(localHost, "0"))
+	if err != nil {
+		log.Printf("SOCKS5 创建 UDP 套接字失败: %v", err)
+		writeSOCKSReply(c, socksRepGeneralFailure, nil)
+		return
+	}
+	defer pc.Close()
+
+	conn, tbr, requestID, err := openTunnel(socks.MethodUDPAssociate, "*", "*")
+	if err != nil {
+		log.Printf("SOCKS5 建立 UDP 中继失败: %v", err)
+		writeSOCKSReply(c, socksReplyCode(err), nil)
+		return
+	}
+	defer conn.Close()
+	if err := writeSOCKSReply(c, socksRepSucceeded, pc.LocalAddr()); err != nil {
+		return
+	}
+	logging.Infof("SOCKS5 UDP 中继 %d 已建立: %s", requestID, pc.LocalAddr())
+
+	// The control connection carries no data; closing it ends the association.
+	go func() {
+		io.Copy(io.Discard, br)
+		pc.Close()
+	}()
+
+	clientIP := c.RemoteAddr().(*net.TCPAddr).IP
+	var peer atomic.Pointer[net.UDPAddr]
+
+	// Downlink: datagrams from the server go back to the client with a SOCKS header.
+	go func() {
+		defer pc.Close()
+		for {
+			d, err := socks.ReadDatagram(tbr)
+			if err != nil {
+				return
+			}
+			to := peer.Load()
+			if to == nil {
+				continue
+			}
+			b, err := socks.AppendUDPHeader(nil, d)
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(b, to)
+		}
+	}()
+
+	// Uplink: client datagrams go into the session with their destination.
+	buf := make([]byte, protocol.MaxPacketSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		ua, ok := from.(*net.UDPAddr)
+		if !ok || !ua.IP.Equal(clientIP) {
+			continue
+		}
+		peer.Store(ua)
+		d, err := socks.ParseUDPHeader(buf[:n])
+		if err != nil {
+			logging.Debugf("SOCKS5 UDP 中继 %d 丢弃无效数据报: %v", requestID, err)
+			continue
+		}
+		if err := socks.WriteDatagram(conn, d); err != nil {
+			break
+		}
+	}
+	conn.CloseWrite()
+	logging.Infof("SOCKS5 UDP 中继 %d 已结束", requestID)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"icmptun/pkg/compress"
+	"icmptun/pkg/socks"
+	"icmptun/pkg/tunnel"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startSOCKS 启动一个经由模拟 ICMP 连接转发的 SOCKS5 代理，handler 扮演服务端
+func startSOCKS(t *testing.T, handler func(*compress.Conn)) net.Addr {
+	serverConn := startMockClient(t)
+	go serveMock(t, serverConn, handler)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go serveSOCKS(ln)
+	return ln.Addr()
+}
+
+// socksRequest 完成无认证握手并发送一个请求，返回服务端的回复码和绑定地址
+func socksRequest(t *testing.T, c net.Conn, cmd byte, host string, port int) (byte, string, int) {
+	c.Write([]byte{socksVersion, 1, socksAuthNone})
+	var method [2]byte
+	if _, err := io.ReadFull(c, method[:]); err != nil || method[1] != socksAuthNone {
+		t.Fatalf("认证协商失败: %v %v", method, err)
+	}
+	req, _ := socks.AppendAddr([]byte{socksVersion, cmd, 0}, host, port)
+	c.Write(req)
+	var hdr [3]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		t.Fatalf("读取 SOCKS5 回复失败: %v", err)
+	}
+	boundHost, boundPort, err := socks.ReadAddr(c)
+	if err != nil {
+		t.Fatalf("读取绑定地址失败: %v", err)
+	}
+	return hdr[1], boundHost, boundPort
+}
+
+// TestSOCKSConnect 验证 SOCKS5 CONNECT 会通过隧道请求服务端连接目标并双向转发数据。
+func TestSOCKSConnect(t *testing.T) {
+	addr := startSOCKS(t, func(session *compress.Conn) {
+		defer session.Close()
+		br := bufio.NewReader(session)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect || req.Host != "example.com:443" {
+			t.Errorf("模拟服务器收到了意外的请求: %v %v", req, err)
+			return
+		}
+		session.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		up := make([]byte, 4)
+		io.ReadFull(br, up)
+		session.Write(append([]byte("pong:"), up...))
+	})
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("连接 SOCKS5 代理失败: %v", err)
+	}
+	defer c.Close()
+	if rep, _, _ := socksRequest(t, c, socksCmdConnect, "example.com", 443); rep != socksRepSucceeded {
+		t.Fatalf("期望回复码 0，但得到 %d", rep)
+	}
+	c.Write([]byte("ping"))
+	got, _ := io.ReadAll(c)
+	if string(got) != "pong:ping" {
+		t.Errorf("期望隧道返回 'pong:ping'，但得到 '%s'", got)
+	}
+}
+
+// TestSOCKSConnectIdle 验证 SOCKS5 CONNECT 隧道空闲超过 IdleTimeout 后仍然可用。
+func TestSOCKSConnectIdle(t *testing.T) {
+	old := conf.IdleTimeout
+	t.Cleanup(func() { conf.IdleTimeout = old })
+	conf.IdleTimeout = 300 * time.Millisecond
+
+	addr := startSOCKS(t, func(session *compress.Conn) {
+		defer session.Close()
+		br := bufio.NewReader(session)
+		if _, err := http.ReadRequest(br); err != nil {
+			return
+		}
+		session.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		io.Copy(session, br)
+	})
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("连接 SOCKS5 代理失败: %v", err)
+	}
+	defer c.Close()
+	if rep, _, _ := socksRequest(t, c, socksCmdConnect, "example.com", 22); rep != socksRepSucceeded {
+		t.Fatalf("期望回复码 0，但得到 %d", rep)
+	}
+	time.Sleep(3 * conf.IdleTimeout)
+	c.Write([]byte("still"))
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "still" {
+		t.Errorf("期望空闲后隧道回显 'still'，但得到 '%s' (%v)", buf, err)
+	}
+}
+
+// TestSOCKSConnectFailure 验证服务端报告的连接失败会转换为对应的 SOCKS5 回复码。
+func TestSOCKSConnectFailure(t *testing.T) {
+	addr := startSOCKS(t, func(session *compress.Conn) {
+		http.ReadRequest(bufio.NewReader(session))
+		session.CloseWithError(tunnel.ErrCodeConnect, "connection refused")
+	})
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("连接 SOCKS5 代理失败: %v", err)
+	}
+	defer c.Close()
+	if rep, _, _ := socksRequest(t, c, socksCmdConnect, "10.0.0.1", 22); rep != socksRepConnectionRefused {
+		t.Errorf("期望回复码 %d，但得到 %d", socksRepConnectionRefused, rep)
+	}
+}
+
+// TestSOCKSUDPAssociate 验证 UDP 数据报经由隧道转发，回复带着来源地址返回给客户端。
+func TestSOCKSUDPAssociate(t *testing.T) {
+	addr := startSOCKS(t, func(session *compress.Conn) {
+		defer session.Close()
+		br := bufio.NewReader(session)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != socks.MethodUDPAssociate {
+			t.Errorf("模拟服务器收到了意外的请求: %v %v", req, err)
+			return
+		}
+		session.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		for {
+			d, err := socks.ReadDatagram(br)
+			if err != nil {
+				return
+			}
+			d.Data = append([]byte("echo:"), d.Data...)
+			socks.WriteDatagram(session, d)
+		}
+	})
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("连接 SOCKS5 代理失败: %v", err)
+	}
+	defer c.Close()
+	rep, host, port := socksRequest(t, c, socksCmdUDPAssociate, "0.0.0.0", 0)
+	if rep != socksRepSucceeded {
+		t.Fatalf("期望回复码 0，但得到 %d", rep)
+	}
+
+	uc, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("连接 UDP 中继失败: %v", err)
+	}
+	defer uc.Close()
+	pkt, _ := socks.AppendUDPHeader(nil, &socks.Datagram{Host: "198.51.100.7", Port: 53, Data: []byte("query")})
+	uc.Write(pkt)
+
+	uc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, err := uc.Read(buf)
+	if err != nil {
+		t.Fatalf("读取 UDP 回复失败: %v", err)
+	}
+	d, err := socks.ParseUDPHeader(buf[:n])
+	if err != nil {
+		t.Fatalf("解析 UDP 回复失败: %v", err)
+	}
+	if d.Addr() != "198.51.100.7:53" || string(d.Data) != "echo:query" {
+		t.Errorf("期望来自 198.51.100.7:53 的 'echo:query'，但得到 %s '%s'", d.Addr(), d.Data)
+	}
+}
+
+// TestSOCKSPasswordAuth 验证配置了用户名密码后，只有凭据正确的客户端能通过认证。
+func TestSOCKSPasswordAuth(t *testing.T) {
+	old := *conf
+	defer func() { *conf = old }()
+	conf.SocksUser, conf.SocksPassword = "alice", "s3cret"
+
+	auth := func(greeting []byte, user, pass string) ([]byte, error) {
+		in := append([]byte(nil), greeting...)
+		in = append(in, socksPasswordVersion, byte(len(user)))
+		in = append(append(in, user...), byte(len(pass)))
+		in = append(in, pass...)
+		var out bytes.Buffer
+		err := socksAuthenticate(bufio.NewReader(bytes.NewReader(in)), &out)
+		return out.Bytes(), err
+	}
+
+	out, err := auth([]byte{socksVersion, 2, socksAuthNone, socksAuthPassword}, "alice", "s3cret")
+	if err != nil || !bytes.Equal(out, []byte{socksVersion, socksAuthPassword, socksPasswordVersion, 0}) {
+		t.Errorf("正确的凭据应通过认证: %v %v", out, err)
+	}
+	out, err = auth([]byte{socksVersion, 1, socksAuthPassword}, "alice", "wrong")
+	if err == nil || !bytes.Equal(out, []byte{socksVersion, socksAuthPassword, socksPasswordVersion, 1}) {
+		t.Errorf("错误的密码应被拒绝: %v %v", out, err)
+	}
+	out, err = auth([]byte{socksVersion, 1, socksAuthNone}, "", "")
+	if err == nil || !bytes.Equal(out, []byte{socksVersion, socksAuthUnavailable}) {
+		t.Errorf("不支持密码认证的客户端应被拒绝: %v %v", out, err)
+	}
+}
@@ -0,0 +1,32 @@
+// Package icmptest 提供测试 ICMP 差错处理时共用的辅助函数。
+package icmptest
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// QuoteIPv4 构造差错报文引用的原始报文：发往 dst、带 optLen 字节选项的 IPv4 头，
+// 随后是 icmpMsg。只引用 ICMP 报文开头时传入截断的 icmpMsg。
+func QuoteIPv4(dst net.IP, optLen int, icmpMsg []byte) []byte {
+	b := make([]byte, ipv4.HeaderLen+optLen)
+	b[0] = 0x40 | byte(len(b)/4)
+	b[8] = 64
+	b[9] = ipv4.ProtocolICMP
+	copy(b[12:16], net.IPv4(192, 0, 2, 10).To4())
+	copy(b[16:20], dst.To4())
+	return append(b, icmpMsg...)
+}
+
+// QuoteIPv6 构造差错报文引用的原始报文：发往 dst 的 IPv6 头，随后是 icmpMsg
+func QuoteIPv6(dst net.IP, icmpMsg []byte) []byte {
+	b := make([]byte, ipv6.HeaderLen)
+	b[0] = 6 << 4
+	b[6] = ipv6.ProtocolIPv6ICMP
+	b[7] = 64
+	copy(b[8:24], net.ParseIP("2001:db8::10"))
+	copy(b[24:40], dst.To16())
+	return append(b, icmpMsg...)
+}
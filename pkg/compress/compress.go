@@ -0,0 +1,333 @@
+// Package compress 在会话的可靠字节流上压缩负载，节省 ICMP 路径上有限的带宽。
+//
+// 流被切分成记录（大端序）：
+//
+//	+------+--------+-------------+
+//	| kind | length | body        |
+//	+------+--------+-------------+
+//	   1       2      length 字节
+//
+// kind 为 0 时 body 是原始数据，为 0xff 时是 hello，其余值是压缩 body 所用的算法。
+// 会话双方在开始时各自发送 hello，body 是本端能解压的算法编号，按偏好排序。
+// 收到对端的 hello 后，本端选用对端列表中第一个自己也支持的算法；在此之前发送的记录不压缩，
+// 因此双方都不必等待对方就能开始写入。
+//
+// 每条记录独立压缩，压缩后没有变小的记录原样发送。TLS 这类压不动的流连续失败时暂停尝试，
+// 已知压缩过的内容由调用方用 SetCompress 关闭压缩。
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"icmptun/pkg/tunnel"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Codec 是压缩算法在 hello 和记录头中的编号
+type Codec uint8
+
+const (
+	// Deflate 是 RFC 1951 的 DEFLATE
+	Deflate Codec = 1
+)
+
+func (c Codec) String() string {
+	switch c {
+	case Deflate:
+		return "deflate"
+	default:
+		return fmt.Sprintf("Codec(%d)", uint8(c))
+	}
+}
+
+const (
+	kindRaw   = 0
+	kindHello = 0xff
+
+	headerLen = 3
+	// maxRecord 是一条记录携带的最大原始字节数，压缩失败时 body 也不会超过 length 字段的范围
+	maxRecord = 32 * 1024
+	// minCompress 是值得尝试压缩的最小记录，更短的记录省下的字节抵不上压缩的开销
+	minCompress = 64
+	// maxBackoff 是连续压缩失败后最多跳过的记录数
+	maxBackoff = 64
+)
+
+// ErrMalformed 表示对端发来的记录无法解析
+var ErrMalformed = errors.New("compress: 记录格式错误")
+
+// Codecs 是本端支持的算法，按偏好排序
+type Codecs []Codec
+
+// DefaultCodecs 返回默认启用的算法
+func DefaultCodecs() Codecs { return Codecs{Deflate} }
+
+func (cs *Codecs) String() string {
+	if cs == nil || len(*cs) == 0 {
+		return "none"
+	}
+	names := make([]string, len(*cs))
+	for i, c := range *cs {
+		names[i] = c.String()
+	}
+	return strings.Join(names, ",")
+}
+
+// Set 解析逗号分隔的算法名，none 表示不压缩
+func (cs *Codecs) Set(s string) error {
+	var list Codecs
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(strings.ToLower(name)) {
+		case "deflate":
+			list = append(list, Deflate)
+		case "none", "":
+		default:
+			return fmt.Errorf("未知的压缩算法 %q，可选 deflate 或 none", name)
+		}
+	}
+	*cs = list
+	return nil
+}
+
+// UnmarshalText 让配置文件可以用字符串指定算法
+func (cs *Codecs) UnmarshalText(b []byte) error { return cs.Set(string(b)) }
+
+func (cs Codecs) supports(c Codec) bool {
+	for _, v := range cs {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats 是压缩前后的字节数，Raw 是应用读写的字节数，Wire 是会话中实际传输的字节数
+type Stats struct {
+	RawOut, WireOut int64
+	RawIn, WireIn   int64
+}
+
+// Ratio 返回传输的字节数占原始字节数的比例，没有数据时为 1
+func (s Stats) Ratio() float64 {
+	if s.RawOut+s.RawIn == 0 {
+		return 1
+	}
+	return float64(s.WireOut+s.WireIn) / float64(s.RawOut+s.RawIn)
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("发送 %d 字节（传输 %d），接收 %d 字节（传输 %d），压缩比 %.1f%%",
+		s.RawOut, s.WireOut, s.RawIn, s.WireIn, s.Ratio()*100)
+}
+
+// counters 是可以并发累加的 Stats
+type counters struct {
+	rawOut, wireOut atomic.Int64
+	rawIn, wireIn   atomic.Int64
+}
+
+func (c *counters) load() Stats {
+	return Stats{RawOut: c.rawOut.Load(), WireOut: c.wireOut.Load(), RawIn: c.rawIn.Load(), WireIn: c.wireIn.Load()}
+}
+
+// totals 累计所有会话的字节数
+var totals counters
+
+// Totals 返回进程启动以来所有会话的压缩统计
+func Totals() Stats { return totals.load() }
+
+var (
+	writers = sync.Pool{New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+	readers = sync.Pool{New: func() any { return flate.NewReader(nil) }}
+)
+
+// Conn 在 tunnel.Conn 的 Read 和 Write 上压缩和解压记录，其余方法直接使用会话的
+type Conn struct {
+	*tunnel.Conn
+	codecs Codecs
+
+	send     atomic.Uint32 // 发送使用的算法，收到对端的 hello 之前为 0
+	disabled atomic.Bool   // SetCompress(false) 关闭了压缩
+	stats    counters
+
+	wmu     sync.Mutex
+	wbuf    bytes.Buffer
+	skip    int // 还要跳过压缩的记录数
+	backoff int // 下一次压缩失败后跳过的记录数
+
+	rmu  sync.Mutex
+	body []byte
+	rbuf []byte // 已解出还没有读走的数据
+}
+
+// NewConn 包装会话并发送 hello，codecs 为空时本端既不压缩也不通知对端，对端按原始数据发送
+func NewConn(conn *tunnel.Conn, codecs Codecs) *Conn {
+	c := &Conn{Conn: conn, codecs: codecs, backoff: 1}
+	if len(codecs) > 0 {
+		hello := make([]byte, headerLen+len(codecs))
+		hello[0] = kindHello
+		binary.BigEndian.PutUint16(hello[1:], uint16(len(codecs)))
+		for i, codec := range codecs {
+			hello[headerLen+i] = byte(codec)
+		}
+		// 写入失败说明会话已经结束，之后的读写会返回同样的错误
+		if _, err := conn.Write(hello); err == nil {
+			c.stats.wireOut.Add(int64(len(hello)))
+			totals.wireOut.Add(int64(len(hello)))
+		}
+	}
+	return c
+}
+
+// SetCompress 打开或关闭之后写入数据的压缩，用于跳过图片、视频等已经压缩过的内容
+func (c *Conn) SetCompress(on bool) { c.disabled.Store(!on) }
+
+// Codec 返回发送使用的算法，还没有协商好或对端不支持时为 0
+func (c *Conn) Codec() Codec { return Codec(c.send.Load()) }
+
+// Stats 返回这个会话的压缩统计
+func (c *Conn) Stats() Stats { return c.stats.load() }
+
+// Write 把 p 切分成记录写入会话，只有全部写完的记录计入返回的字节数
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), maxRecord)
+		if err := c.writeRecord(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *Conn) writeRecord(p []byte) error {
+	c.wbuf.Reset()
+	c.wbuf.Write([]byte{kindRaw, 0, 0})
+	codec := c.Codec()
+	switch {
+	case codec == 0 || c.disabled.Load() || len(p) < minCompress:
+	case c.skip > 0:
+		c.skip--
+	case c.compress(codec, p):
+		c.backoff = 1
+	default:
+		// 压缩失败的次数越多，跳过的记录越多，流中的内容变得可压缩后再逐渐恢复
+		c.skip = c.backoff
+		c.backoff = min(c.backoff*2, maxBackoff)
+	}
+	if c.wbuf.Len() == headerLen {
+		c.wbuf.Write(p)
+	}
+	b := c.wbuf.Bytes()
+	binary.BigEndian.PutUint16(b[1:], uint16(len(b)-headerLen))
+	if _, err := c.Conn.Write(b); err != nil {
+		return err
+	}
+	c.stats.rawOut.Add(int64(len(p)))
+	c.stats.wireOut.Add(int64(len(b)))
+	totals.rawOut.Add(int64(len(p)))
+	totals.wireOut.Add(int64(len(b)))
+	return nil
+}
+
+// compress 把 p 压缩后追加到 wbuf，没有变小时丢弃结果并返回 false
+func (c *Conn) compress(codec Codec, p []byte) bool {
+	w := writers.Get().(*flate.Writer)
+	defer writers.Put(w)
+	w.Reset(&c.wbuf)
+	if _, err := w.Write(p); err != nil || w.Close() != nil || c.wbuf.Len()-headerLen >= len(p) {
+		c.wbuf.Truncate(headerLen)
+		return false
+	}
+	c.wbuf.Bytes()[0] = byte(codec)
+	return true
+}
+
+// Read 从会话中读取记录，返回解压后的数据。hello 记录只用于选择发送的算法，不交给调用方
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.rbuf) == 0 {
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *Conn) readRecord() error {
+	var hdr [headerLen]byte
+	if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+		return err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[1:]))
+	if cap(c.body) < n {
+		c.body = make([]byte, n)
+	}
+	body := c.body[:n]
+	if _, err := io.ReadFull(c.Conn, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	c.stats.wireIn.Add(int64(headerLen + n))
+	totals.wireIn.Add(int64(headerLen + n))
+
+	switch hdr[0] {
+	case kindRaw:
+		c.rbuf = body
+	case kindHello:
+		for _, b := range body {
+			if codec := Codec(b); c.codecs.supports(codec) {
+				c.send.Store(uint32(codec))
+				break
+			}
+		}
+		return nil
+	case byte(Deflate):
+		if !c.codecs.supports(Deflate) {
+			return fmt.Errorf("%w: 对端使用了没有协商的算法 %v", ErrMalformed, Deflate)
+		}
+		data, err := inflate(body)
+		if err != nil {
+			return err
+		}
+		c.rbuf = data
+	default:
+		return fmt.Errorf("%w: 未知的记录类型 %d", ErrMalformed, hdr[0])
+	}
+	c.stats.rawIn.Add(int64(len(c.rbuf)))
+	totals.rawIn.Add(int64(len(c.rbuf)))
+	return nil
+}
+
+// inflate 解压一条记录，解压后超过 maxRecord 的记录视为错误，防止对端用极高压缩比的数据耗尽内存
+func inflate(body []byte) ([]byte, error) {
+	r := readers.Get().(io.ReadCloser)
+	defer readers.Put(r)
+	r.(flate.Resetter).Reset(bytes.NewReader(body), nil)
+	data, err := io.ReadAll(io.LimitReader(r, maxRecord+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if len(data) > maxRecord {
+		return nil, fmt.Errorf("%w: 解压后超过 %d 字节", ErrMalformed, maxRecord)
+	}
+	return data, nil
+}
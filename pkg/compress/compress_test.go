@@ -0,0 +1,188 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"icmptun/pkg/tunnel"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPair 创建一对互相连接的会话，报文异步交给对端
+func newPair(t *testing.T) (a, b *tunnel.Conn) {
+	link := func(dst **tunnel.Conn) func([]byte) error {
+		return func(pkt []byte) error {
+			time.AfterFunc(0, func() { (*dst).Input(pkt) })
+			return nil
+		}
+	}
+	a = tunnel.NewConn(tunnel.DefaultConfig(), 1, link(&b))
+	b = tunnel.NewConn(tunnel.DefaultConfig(), 1, link(&a))
+	t.Cleanup(func() {
+		a.Abort()
+		b.Abort()
+	})
+	return a, b
+}
+
+// exchange 让 client 发送一行请求，server 读到请求后写回 response 并关闭，返回 client 读到的数据
+func exchange(t *testing.T, client, server *Conn, response []byte) []byte {
+	t.Helper()
+	if _, err := client.Write([]byte("GET\n")); err != nil {
+		t.Fatalf("client write failed: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(server, buf); err != nil {
+			t.Errorf("server read failed: %v", err)
+			return
+		}
+		server.Write(response)
+		server.Close()
+	}()
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("client read failed: %v", err)
+	}
+	return got
+}
+
+func TestConnCompressesAfterHello(t *testing.T) {
+	a, b := newPair(t)
+	client, server := NewConn(a, DefaultCodecs()), NewConn(b, DefaultCodecs())
+
+	page := []byte(strings.Repeat("<div class=\"item\">hello, tunnel</div>\n", 3000))
+	if got := exchange(t, client, server, page); !bytes.Equal(got, page) {
+		t.Fatalf("received %d bytes, want %d", len(got), len(page))
+	}
+	if server.Codec() != Deflate {
+		t.Errorf("server codec = %v, want deflate", server.Codec())
+	}
+	s := server.Stats()
+	if s.RawOut != int64(len(page)) || s.WireOut*10 > s.RawOut {
+		t.Errorf("server stats %v: expected the page to shrink tenfold", s)
+	}
+	if c := client.Stats(); c.RawIn != s.RawOut || c.WireIn != s.WireOut {
+		t.Errorf("client stats %v do not mirror server stats %v", c, s)
+	}
+}
+
+func TestConnPeerWithoutCodecs(t *testing.T) {
+	a, b := newPair(t)
+	client, server := NewConn(a, nil), NewConn(b, DefaultCodecs())
+
+	page := bytes.Repeat([]byte("aaaa"), 10000)
+	if got := exchange(t, client, server, page); !bytes.Equal(got, page) {
+		t.Fatalf("received %d bytes, want %d", len(got), len(page))
+	}
+	if server.Codec() != 0 {
+		t.Errorf("server should not compress for a peer without codecs, got %v", server.Codec())
+	}
+	if s := server.Stats(); s.WireOut < s.RawOut {
+		t.Errorf("server stats %v: nothing should be compressed", s)
+	}
+}
+
+func TestConnSkipsIncompressible(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+		on   bool
+	}{
+		{"random", randomBytes(t, 200000), true},
+		{"disabled", bytes.Repeat([]byte("x"), 200000), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := newPair(t)
+			client, server := NewConn(a, DefaultCodecs()), NewConn(b, DefaultCodecs())
+			server.SetCompress(tc.on)
+			if got := exchange(t, client, server, tc.data); !bytes.Equal(got, tc.data) {
+				t.Fatalf("received %d bytes, want %d", len(got), len(tc.data))
+			}
+			// 只多出 hello 和每条记录的头
+			s := server.Stats()
+			records := (len(tc.data) + maxRecord - 1) / maxRecord
+			if s.WireOut != s.RawOut+int64(headerLen*(records+1)+1) {
+				t.Errorf("server stats %v: expected %d raw records", s, records)
+			}
+		})
+	}
+}
+
+func TestConnRejectsOversizedRecord(t *testing.T) {
+	a, b := newPair(t)
+	client := NewConn(a, DefaultCodecs())
+
+	// 解压后超过 maxRecord 的记录不能被接受
+	var body bytes.Buffer
+	w, _ := flate.NewWriter(&body, flate.BestCompression)
+	w.Write(make([]byte, 2*maxRecord))
+	w.Close()
+	record := binary.BigEndian.AppendUint16([]byte{byte(Deflate)}, uint16(body.Len()))
+	b.Write(append(record, body.Bytes()...))
+
+	if _, err := client.Read(make([]byte, 10)); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("Read error = %v, want ErrMalformed", err)
+	}
+}
+
+func TestCodecsSet(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{"deflate", "deflate"},
+		{" Deflate ", "deflate"},
+		{"none", "none"},
+		{"", "none"},
+	} {
+		var cs Codecs
+		if err := cs.Set(tc.in); err != nil {
+			t.Errorf("Set(%q) failed: %v", tc.in, err)
+			continue
+		}
+		if got := cs.String(); got != tc.want {
+			t.Errorf("Set(%q) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+	var cs Codecs
+	if err := cs.Set("lz4"); err == nil {
+		t.Error("Set(lz4) should fail")
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	for _, tc := range []struct {
+		contentType, encoding string
+		want                  bool
+	}{
+		{"text/html; charset=utf-8", "", true},
+		{"application/json", "identity", true},
+		{"application/javascript", "", true},
+		{"image/svg+xml", "", true},
+		{"", "", true},
+		{"text/html", "gzip", false},
+		{"text/css", "br", false},
+		{"image/png", "", false},
+		{"video/mp4", "", false},
+		{"application/zip", "", false},
+		{"font/woff2", "", false},
+	} {
+		if got := Compressible(tc.contentType, tc.encoding); got != tc.want {
+			t.Errorf("Compressible(%q, %q) = %v, want %v", tc.contentType, tc.encoding, got, tc.want)
+		}
+	}
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
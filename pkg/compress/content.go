@@ -0,0 +1,42 @@
+package compress
+
+import (
+	"mime"
+	"strings"
+)
+
+// compressedTypes 是本身已经压缩过的媒体类型，再压缩只会浪费 CPU
+var compressedTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/zip":              true,
+	"application/zstd":             true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/vnd.rar":          true,
+	"application/pdf":              true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+}
+
+// Compressible 根据 HTTP 响应的 Content-Type 和 Content-Encoding 判断内容是否值得压缩。
+// 带有内容编码（gzip、br 等）的响应、图片、音视频和压缩包都不再压缩；SVG 和 BMP 是例外
+func Compressible(contentType, contentEncoding string) bool {
+	if enc := strings.TrimSpace(strings.ToLower(contentEncoding)); enc != "" && enc != "identity" {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// 缺少或无法解析的类型交给按记录的判断
+		return true
+	}
+	switch {
+	case mt == "image/svg+xml" || mt == "image/bmp":
+		return true
+	case strings.HasPrefix(mt, "image/"), strings.HasPrefix(mt, "video/"), strings.HasPrefix(mt, "audio/"):
+		return false
+	}
+	return !compressedTypes[mt]
+}
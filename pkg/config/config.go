@@ -0,0 +1,369 @@
+// Package config 解析客户端和服务端的命令行参数和可选的 JSON 配置文件。
+//
+// 取值的优先级从高到低是：命令行参数、配置文件、默认值。
+// 预共享密钥在参数和文件中都没有设置时，从环境变量 ICMPTUN_PSK 读取。
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"icmptun/pkg/compress"
+	"icmptun/pkg/logging"
+	"icmptun/pkg/protocol"
+	"icmptun/pkg/tunnel"
+	"io"
+	"os"
+	"time"
+)
+
+// Role 区分客户端和服务端，两者接受的参数不同
+type Role int
+
+const (
+	// Client 是本地代理一侧
+	Client Role = iota
+	// Server 是执行请求的一侧
+	Server
+)
+
+func (r Role) String() string {
+	if r == Server {
+		return "server"
+	}
+	return "client"
+}
+
+const (
+	// DefaultServerAddr 是客户端默认连接的服务器地址
+	DefaultServerAddr = "127.0.0.1"
+	// DefaultProxyAddr 是客户端默认的 HTTP 代理监听地址
+	DefaultProxyAddr = "localhost:8888"
+	// DefaultICMPAddr 是服务端默认监听 ICMP 的地址
+	DefaultICMPAddr = "0.0.0.0"
+	// DefaultPolls 是客户端默认为每个会话保持的轮询请求数
+	DefaultPolls = 8
+	// DefaultRateBurst 是限速时默认允许连续突发的报文数，与 Linux icmp_ratelimit 的突发相同
+	DefaultRateBurst = 50
+
+	// minChunkSize 保证每个报文除去各层开销后还能携带一定量的数据
+	minChunkSize = tunnel.PacketOverhead + 64
+	// maxChunkSize 是一个 IPv4 报文去掉 IP 头和 ICMP 头后的上限
+	maxChunkSize = protocol.MaxPacketSize - 20 - 8
+	// maxPolls 限制空闲会话因轮询产生的报文数
+	maxPolls = 256
+)
+
+// Config 是客户端和服务端的运行参数
+type Config struct {
+	// ServerAddr 是客户端发送 ICMP 报文的服务器地址，仅客户端使用
+	ServerAddr string
+	// ListenAddr 在客户端是 HTTP 代理的监听地址，在服务端是 ICMP 的监听地址
+	ListenAddr string
+	// SocksAddr 是客户端 SOCKS5 代理的监听地址，为空时不启用，仅客户端使用
+	SocksAddr string
+	// SocksUser 和 SocksPassword 不为空时，SOCKS5 代理要求用户名/密码认证
+	SocksUser     string
+	SocksPassword string
+	// Forwards 是静态 TCP 端口转发规则，仅客户端使用
+	Forwards Forwards
+	// RemoteForwards 是反向端口转发规则：服务端监听 Listen，连接经隧道转发到客户端能访问的 Target，仅客户端使用
+	RemoteForwards Forwards
+	// ChunkSize 是单个 ICMP 报文 Data 的最大字节数，开启路径 MTU 探测时是探测的上限
+	ChunkSize int
+	// PMTUDiscovery 让会话从 protocol.BaseChunkSize 开始，探测路径能通过的最大报文
+	PMTUDiscovery bool
+	// Polls 是客户端为每个会话保持的未应答轮询请求数，服务端只能用这些请求的回复下发数据，仅客户端使用
+	Polls int
+	// RequestTimeout 是普通 HTTP 请求收不到服务器任何报文时等待的最长时间，仅客户端使用
+	RequestTimeout time.Duration
+	// IdleTimeout 是会话没有收到任何报文时保持的最长时间
+	IdleTimeout time.Duration
+	// UpstreamTimeout 是服务端连接目标和等待目标响应的超时，仅服务端使用
+	UpstreamTimeout time.Duration
+	// RateLimit 是本端所有会话每秒最多发送的数据报文数，包括重传和 FEC 校验报文，
+	// 不包括确认、保活、探测和轮询报文。0 表示不限速
+	RateLimit int
+	// RateBurst 是限速时允许连续突发的报文数
+	RateBurst int
+	// FECData 和 FECParity 开启前向纠错：每 FECData 个数据报文附带 FECParity 个 XOR 校验报文，
+	// 丢失的报文不必等待重传就能还原。都为 0 时不发送校验报文
+	FECData   int
+	FECParity int
+	// Compression 是本端能解压的压缩算法，按偏好排序，为空时不压缩。双方都支持的算法在会话开始时协商
+	Compression compress.Codecs
+	// Limiter 是按 RateLimit 创建的限速器，由 Load 创建，所有会话共享
+	Limiter *tunnel.Limiter
+	// SuppressKernelEcho 让服务端运行期间关闭内核对 Echo 请求的自动回复，退出时恢复，仅服务端使用
+	SuppressKernelEcho bool
+	// Key 是客户端和服务端共享的认证密钥
+	Key string
+	// LogLevel 控制日志的详细程度
+	LogLevel logging.Level
+}
+
+// Default 返回 role 对应的默认参数
+func Default(role Role) *Config {
+	c := &Config{
+		ServerAddr:      DefaultServerAddr,
+		ListenAddr:      DefaultProxyAddr,
+		ChunkSize:       protocol.MaxChunkSize,
+		PMTUDiscovery:   true,
+		Polls:           DefaultPolls,
+		RateBurst:       DefaultRateBurst,
+		Compression:     compress.DefaultCodecs(),
+		RequestTimeout:  30 * time.Second,
+		IdleTimeout:     tunnel.DefaultConfig().IdleTimeout,
+		UpstreamTimeout: 30 * time.Second,
+		LogLevel:        logging.Info,
+	}
+	if role == Server {
+		c.ListenAddr = DefaultICMPAddr
+	}
+	return c
+}
+
+// Load 按优先级合并默认值、配置文件和命令行参数，并校验结果
+func Load(role Role, args []string) (*Config, error) {
+	// 第一遍解析只为找到配置文件，第二遍让命令行参数覆盖文件中的值
+	probe := newFlagSet(role, Default(role))
+	probe.SetOutput(io.Discard)
+	probe.Parse(args) // 参数错误留给第二遍解析报告
+
+	c := Default(role)
+	if path := probe.Lookup("config").Value.String(); path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	// -L 和 -R 可以重复指定，命令行上出现时整个替换文件中的列表，而不是追加在文件的规则后面
+	probe.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "L":
+			c.Forwards = nil
+		case "R":
+			c.RemoteForwards = nil
+		}
+	})
+	if err := newFlagSet(role, c).Parse(args); err != nil {
+		return nil, err
+	}
+	if c.Key == "" {
+		c.Key = os.Getenv(protocol.KeyEnv)
+	}
+	if err := c.Validate(role); err != nil {
+		return nil, err
+	}
+	c.Limiter = tunnel.NewLimiter(c.RateLimit, c.RateBurst)
+	return c, nil
+}
+
+func newFlagSet(role Role, c *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet("icmptun "+role.String(), flag.ContinueOnError)
+	fs.String("config", "", "JSON 配置文件路径，命令行参数优先于文件中的值")
+	if role == Client {
+		fs.StringVar(&c.ServerAddr, "server", c.ServerAddr, "ICMP 代理服务器地址")
+		fs.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "本地 HTTP 代理监听地址")
+		fs.DurationVar(&c.RequestTimeout, "request-timeout", c.RequestTimeout, "HTTP 请求等待服务器响应的超时")
+		fs.StringVar(&c.SocksAddr, "socks", c.SocksAddr, "本地 SOCKS5 代理监听地址，为空时不启用")
+		fs.StringVar(&c.SocksUser, "socks-user", c.SocksUser, "SOCKS5 用户名，为空时不要求认证")
+		fs.StringVar(&c.SocksPassword, "socks-password", c.SocksPassword, "SOCKS5 密码")
+		fs.Var(&c.Forwards, "L", "端口转发 [本地地址:]本地端口:目标主机:目标端口，可重复指定")
+		fs.IntVar(&c.Polls, "polls", c.Polls, "每个会话保持的未应答轮询请求数")
+		fs.Var(&c.RemoteForwards, "R", "反向端口转发 [服务端地址:]服务端端口:目标主机:目标端口，可重复指定")
+	} else {
+		fs.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "ICMP 监听地址")
+		fs.DurationVar(&c.UpstreamTimeout, "upstream-timeout", c.UpstreamTimeout, "连接目标和等待目标响应的超时")
+		fs.BoolVar(&c.SuppressKernelEcho, "suppress-kernel-echo", c.SuppressKernelEcho, "运行期间关闭内核的 Echo 自动回复（icmp_echo_ignore_all=1），退出时恢复")
+	}
+	fs.IntVar(&c.ChunkSize, "chunk-size", c.ChunkSize, "单个 ICMP 报文携带的最大字节数，开启路径 MTU 探测时是探测的上限")
+	fs.BoolVar(&c.PMTUDiscovery, "pmtud", c.PMTUDiscovery, "探测路径 MTU，从 "+fmt.Sprint(protocol.BaseChunkSize)+" 字节开始调整报文大小")
+	fs.IntVar(&c.RateLimit, "rate-limit", c.RateLimit, "所有会话每秒最多发送的数据报文数（含重传和前向纠错校验报文，不含确认、保活、探测和轮询报文），0 表示不限速")
+	fs.IntVar(&c.RateBurst, "rate-burst", c.RateBurst, "限速时允许连续突发的报文数")
+	fs.IntVar(&c.FECData, "fec-data", c.FECData, fmt.Sprintf("前向纠错每组的数据报文数（1 到 %d），0 表示不使用", tunnel.MaxFECData))
+	fs.IntVar(&c.FECParity, "fec-parity", c.FECParity, "前向纠错每组的校验报文数，每个校验报文能还原组内一个丢失的报文")
+	fs.Var(&c.Compression, "compress", "会话负载的压缩算法，逗号分隔按偏好排序: deflate 或 none")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "会话空闲超时")
+	fs.StringVar(&c.Key, "key", c.Key, "预共享密钥，未设置时读取环境变量 "+protocol.KeyEnv)
+	fs.Var(&c.LogLevel, "log-level", "日志级别: debug、info 或 error")
+	return fs
+}
+
+// fileConfig 是配置文件的格式，未出现的字段保留原值
+type fileConfig struct {
+	ServerAddr         *string          `json:"server_addr"`
+	ListenAddr         *string          `json:"listen_addr"`
+	SocksAddr          *string          `json:"socks_addr"`
+	SocksUser          *string          `json:"socks_user"`
+	SocksPassword      *string          `json:"socks_password"`
+	Forwards           []string         `json:"forwards"`
+	RemoteForwards     []string         `json:"remote_forwards"`
+	ChunkSize          *int             `json:"chunk_size"`
+	PMTUDiscovery      *bool            `json:"pmtu_discovery"`
+	Polls              *int             `json:"polls"`
+	RateLimit          *int             `json:"rate_limit"`
+	RateBurst          *int             `json:"rate_burst"`
+	FECData            *int             `json:"fec_data"`
+	FECParity          *int             `json:"fec_parity"`
+	Compression        *compress.Codecs `json:"compress"`
+	RequestTimeout     *string          `json:"request_timeout"`
+	IdleTimeout        *string          `json:"idle_timeout"`
+	UpstreamTimeout    *string          `json:"upstream_timeout"`
+	SuppressKernelEcho *bool            `json:"suppress_kernel_echo"`
+	Key                *string          `json:"key"`
+	LogLevel           *logging.Level   `json:"log_level"`
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("读取配置文件失败: %w", err)
+	}
+	defer f.Close()
+
+	var fc fileConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fc); err != nil {
+		return fmt.Errorf("解析配置文件 %s 失败: %w", path, err)
+	}
+	setString(&c.ServerAddr, fc.ServerAddr)
+	setString(&c.ListenAddr, fc.ListenAddr)
+	setString(&c.SocksAddr, fc.SocksAddr)
+	setString(&c.SocksUser, fc.SocksUser)
+	setString(&c.SocksPassword, fc.SocksPassword)
+	for _, f := range fc.Forwards {
+		if err := c.Forwards.Set(f); err != nil {
+			return fmt.Errorf("配置文件 %s 中的 forwards 无效: %w", path, err)
+		}
+	}
+	for _, f := range fc.RemoteForwards {
+		if err := c.RemoteForwards.Set(f); err != nil {
+			return fmt.Errorf("配置文件 %s 中的 remote_forwards 无效: %w", path, err)
+		}
+	}
+	setString(&c.Key, fc.Key)
+	if fc.ChunkSize != nil {
+		c.ChunkSize = *fc.ChunkSize
+	}
+	if fc.PMTUDiscovery != nil {
+		c.PMTUDiscovery = *fc.PMTUDiscovery
+	}
+	if fc.SuppressKernelEcho != nil {
+		c.SuppressKernelEcho = *fc.SuppressKernelEcho
+	}
+	if fc.Polls != nil {
+		c.Polls = *fc.Polls
+	}
+	if fc.RateLimit != nil {
+		c.RateLimit = *fc.RateLimit
+	}
+	if fc.RateBurst != nil {
+		c.RateBurst = *fc.RateBurst
+	}
+	if fc.FECData != nil {
+		c.FECData = *fc.FECData
+	}
+	if fc.FECParity != nil {
+		c.FECParity = *fc.FECParity
+	}
+	if fc.Compression != nil {
+		c.Compression = *fc.Compression
+	}
+	if fc.LogLevel != nil {
+		c.LogLevel = *fc.LogLevel
+	}
+	for _, d := range []struct {
+		name string
+		src  *string
+		dst  *time.Duration
+	}{
+		{"request_timeout", fc.RequestTimeout, &c.RequestTimeout},
+		{"idle_timeout", fc.IdleTimeout, &c.IdleTimeout},
+		{"upstream_timeout", fc.UpstreamTimeout, &c.UpstreamTimeout},
+	} {
+		if d.src == nil {
+			continue
+		}
+		v, err := time.ParseDuration(*d.src)
+		if err != nil {
+			return fmt.Errorf("配置文件 %s 中的 %s 无效: %w", path, d.name, err)
+		}
+		*d.dst = v
+	}
+	return nil
+}
+
+func setString(dst *string, src *string) {
+	if src != nil {
+		*dst = *src
+	}
+}
+
+// Validate 检查参数是否可用
+func (c *Config) Validate(role Role) error {
+	if role == Client && c.ServerAddr == "" {
+		return errors.New("必须指定服务器地址")
+	}
+	if c.ListenAddr == "" {
+		return errors.New("必须指定监听地址")
+	}
+	if (c.SocksUser == "") != (c.SocksPassword == "") {
+		return errors.New("socks-user 和 socks-password 必须同时设置")
+	}
+	if len(c.SocksUser) > 255 || len(c.SocksPassword) > 255 {
+		return errors.New("SOCKS5 用户名和密码不能超过 255 字节")
+	}
+	if c.ChunkSize < minChunkSize || c.ChunkSize > maxChunkSize {
+		return fmt.Errorf("chunk-size 必须在 %d 到 %d 之间，当前为 %d", minChunkSize, maxChunkSize, c.ChunkSize)
+	}
+	if c.Polls < 1 || c.Polls > maxPolls {
+		return fmt.Errorf("polls 必须在 1 到 %d 之间，当前为 %d", maxPolls, c.Polls)
+	}
+	if c.RateLimit < 0 {
+		return fmt.Errorf("rate-limit 不能小于 0，当前为 %d", c.RateLimit)
+	}
+	if c.RateLimit > 0 && c.RateBurst < 1 {
+		return fmt.Errorf("rate-burst 必须大于 0，当前为 %d", c.RateBurst)
+	}
+	if c.FECData != 0 || c.FECParity != 0 {
+		if c.FECData < 1 || c.FECData > tunnel.MaxFECData {
+			return fmt.Errorf("fec-data 必须在 1 到 %d 之间，当前为 %d", tunnel.MaxFECData, c.FECData)
+		}
+		if c.FECParity < 1 || c.FECParity > c.FECData {
+			return fmt.Errorf("fec-parity 必须在 1 到 fec-data 之间，当前为 %d", c.FECParity)
+		}
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"request-timeout", c.RequestTimeout},
+		{"idle-timeout", c.IdleTimeout},
+		{"upstream-timeout", c.UpstreamTimeout},
+	} {
+		if d.value <= 0 {
+			return fmt.Errorf("%s 必须大于 0，当前为 %v", d.name, d.value)
+		}
+	}
+	if c.Key == "" {
+		return fmt.Errorf("%w，请通过 -key、配置文件或环境变量 %s 设置", protocol.ErrNoKey, protocol.KeyEnv)
+	}
+	return nil
+}
+
+// Tunnel 返回按这些参数调整后的会话参数
+func (c *Config) Tunnel() tunnel.Config {
+	cfg := tunnel.DefaultConfig()
+	cfg.MSS = c.ChunkSize - tunnel.PacketOverhead
+	if c.PMTUDiscovery && c.ChunkSize > protocol.BaseChunkSize {
+		// 从几乎所有路径都能通过的大小开始，向 chunk-size 探测
+		cfg.MaxMSS = cfg.MSS
+		cfg.MSS = protocol.BaseChunkSize - tunnel.PacketOverhead
+	}
+	cfg.IdleTimeout = c.IdleTimeout
+	cfg.FECData, cfg.FECParity = c.FECData, c.FECParity
+	cfg.Limiter = c.Limiter
+	return cfg
+}
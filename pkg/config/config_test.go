@@ -0,0 +1,210 @@
+package config
+
+import (
+	"icmptun/pkg/logging"
+	"icmptun/pkg/protocol"
+	"icmptun/pkg/tunnel"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	t.Setenv(protocol.KeyEnv, "env-key")
+	c, err := Load(Client, nil)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if c.ServerAddr != DefaultServerAddr || c.ListenAddr != DefaultProxyAddr || c.ChunkSize != protocol.MaxChunkSize {
+		t.Errorf("unexpected defaults: %+v", c)
+	}
+	if c.Key != "env-key" {
+		t.Errorf("key should fall back to %s, got %q", protocol.KeyEnv, c.Key)
+	}
+
+	s, err := Load(Server, nil)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if s.ListenAddr != DefaultICMPAddr {
+		t.Errorf("server should listen on %s by default, got %s", DefaultICMPAddr, s.ListenAddr)
+	}
+}
+
+func TestLoadFlagsOverrideFile(t *testing.T) {
+	t.Setenv(protocol.KeyEnv, "env-key")
+	path := writeFile(t, `{
+		"server_addr": "10.0.0.1",
+		"listen_addr": "127.0.0.1:9000",
+		"chunk_size": 1200,
+		"request_timeout": "5s",
+		"key": "file-key",
+		"compress": "none",
+		"log_level": "debug"
+	}`)
+
+	c, err := Load(Client, []string{"-config", path, "-server", "10.0.0.2", "-idle-timeout", "1m"})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if c.ServerAddr != "10.0.0.2" {
+		t.Errorf("flag should override file: server = %s", c.ServerAddr)
+	}
+	if c.ListenAddr != "127.0.0.1:9000" || c.ChunkSize != 1200 || c.RequestTimeout != 5*time.Second {
+		t.Errorf("file values not applied: %+v", c)
+	}
+	if c.IdleTimeout != time.Minute || c.Key != "file-key" || c.LogLevel != logging.Debug || len(c.Compression) != 0 {
+		t.Errorf("unexpected values: %+v", c)
+	}
+	if mss := c.Tunnel().MSS; mss != 1200-tunnel.PacketOverhead {
+		t.Errorf("Tunnel().MSS = %d", mss)
+	}
+}
+
+func TestTunnelPMTUDiscovery(t *testing.T) {
+	c := Default(Client)
+	cfg := c.Tunnel()
+	if cfg.MSS != protocol.BaseChunkSize-tunnel.PacketOverhead || cfg.MaxMSS != protocol.MaxChunkSize-tunnel.PacketOverhead {
+		t.Errorf("with discovery: MSS = %d, MaxMSS = %d", cfg.MSS, cfg.MaxMSS)
+	}
+
+	c.ChunkSize = 1000 // 不超过起始大小时无需探测
+	if cfg := c.Tunnel(); cfg.MSS != 1000-tunnel.PacketOverhead || cfg.MaxMSS != 0 {
+		t.Errorf("small chunk: MSS = %d, MaxMSS = %d", cfg.MSS, cfg.MaxMSS)
+	}
+
+	t.Setenv(protocol.KeyEnv, "k")
+	c, err := Load(Server, []string{"-pmtud=false", "-chunk-size", "8000"})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg := c.Tunnel(); cfg.MSS != 8000-tunnel.PacketOverhead || cfg.MaxMSS != 0 {
+		t.Errorf("without discovery: MSS = %d, MaxMSS = %d", cfg.MSS, cfg.MaxMSS)
+	}
+}
+
+func TestTunnelSharesLimiter(t *testing.T) {
+	t.Setenv(protocol.KeyEnv, "k")
+	c, err := Load(Client, nil)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if c.Tunnel().Limiter != nil {
+		t.Error("sessions should not be rate limited by default")
+	}
+
+	c, err = Load(Client, []string{"-rate-limit", "500", "-rate-burst", "20"})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if l := c.Tunnel().Limiter; l == nil || l != c.Tunnel().Limiter {
+		t.Error("all sessions should share one limiter")
+	}
+}
+
+func TestLoadRejectsInvalid(t *testing.T) {
+	t.Setenv(protocol.KeyEnv, "")
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"missing key", nil, "密钥"},
+		{"tiny chunk", []string{"-key", "k", "-chunk-size", "100"}, "chunk-size"},
+		{"no polls", []string{"-key", "k", "-polls", "0"}, "polls"},
+		{"negative rate", []string{"-key", "k", "-rate-limit", "-1"}, "rate-limit"},
+		{"rate without burst", []string{"-key", "k", "-rate-limit", "100", "-rate-burst", "0"}, "rate-burst"},
+		{"fec without parity", []string{"-key", "k", "-fec-data", "8"}, "fec-parity"},
+		{"fec group too large", []string{"-key", "k", "-fec-data", "64", "-fec-parity", "1"}, "fec-data"},
+		{"more parity than data", []string{"-key", "k", "-config", writeFile(t, `{"fec_data": 2, "fec_parity": 3}`)}, "fec-parity"},
+		{"unknown compression", []string{"-key", "k", "-compress", "zstd"}, "压缩算法"},
+		{"zero timeout", []string{"-key", "k", "-request-timeout", "0s"}, "request-timeout"},
+		{"socks user without password", []string{"-key", "k", "-socks-user", "alice"}, "socks-password"},
+		{"bad level", []string{"-key", "k", "-log-level", "verbose"}, "log-level"},
+		{"bad forward", []string{"-key", "k", "-L", "8080:intranet"}, "转发规则"},
+		{"unknown field", []string{"-key", "k", "-config", writeFile(t, `{"serverr": "x"}`)}, "serverr"},
+		{"bad duration", []string{"-key", "k", "-config", writeFile(t, `{"idle_timeout": "soon"}`)}, "idle_timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(Client, tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error mentioning %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Forward
+	}{
+		{"8080:intranet:80", Forward{"localhost:8080", "intranet:80"}},
+		{"0.0.0.0:2222:10.0.0.5:22", Forward{"0.0.0.0:2222", "10.0.0.5:22"}},
+		{"[::1]:5432:[2001:db8::7]:5432", Forward{"[::1]:5432", "[2001:db8::7]:5432"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseForward(tt.spec)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseForward(%q) = %+v, %v; want %+v", tt.spec, got, err, tt.want)
+		}
+	}
+	for _, spec := range []string{"", "8080", "8080:host", "x:host:80", "8080:host:70000", "8080::80", "a:b:c:d:e"} {
+		if _, err := ParseForward(spec); err == nil {
+			t.Errorf("ParseForward(%q) should fail", spec)
+		}
+	}
+}
+
+// TestLoadForwards 验证命令行上的 -L 替换文件中的转发规则，没有 -L 时使用文件中的规则
+func TestLoadForwards(t *testing.T) {
+	path := writeFile(t, `{"forwards": ["2222:10.0.0.5:22"]}`)
+	c, err := Load(Client, []string{"-key", "k", "-config", path})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(c.Forwards) != 1 || c.Forwards[0] != (Forward{"localhost:2222", "10.0.0.5:22"}) {
+		t.Errorf("Forwards from the file = %v", c.Forwards)
+	}
+
+	c, err = Load(Client, []string{"-key", "k", "-config", path, "-L", "8080:intranet:80", "-L", "0.0.0.0:5432:db:5432"})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	want := Forwards{
+		{"localhost:8080", "intranet:80"},
+		{"0.0.0.0:5432", "db:5432"},
+	}
+	if len(c.Forwards) != len(want) {
+		t.Fatalf("Forwards = %v, want %v", c.Forwards, want)
+	}
+	for i := range want {
+		if c.Forwards[i] != want[i] {
+			t.Errorf("Forwards[%d] = %+v, want %+v", i, c.Forwards[i], want[i])
+		}
+	}
+
+	// -L 和 -R 各自只替换自己的列表
+	path = writeFile(t, `{"forwards": ["2222:10.0.0.5:22"], "remote_forwards": ["8022:localhost:22"]}`)
+	c, err = Load(Client, []string{"-key", "k", "-config", path, "-R", "9022:localhost:22"})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(c.RemoteForwards) != 1 || c.RemoteForwards[0] != (Forward{"localhost:9022", "localhost:22"}) {
+		t.Errorf("RemoteForwards = %v, want only the -R rule", c.RemoteForwards)
+	}
+	if len(c.Forwards) != 1 {
+		t.Errorf("-R changed the forwards from the file: %v", c.Forwards)
+	}
+}
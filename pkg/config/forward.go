@@ -0,0 +1,87 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Forward 是一条端口转发规则：Listen 上接受的每个 TCP 连接都经隧道转发到 Target。
+// 正向转发由客户端监听、服务端连接；反向转发由服务端监听、客户端连接。
+type Forward struct {
+	Listen string
+	Target string
+}
+
+// Forwards 是可重复指定的 -L 参数
+type Forwards []Forward
+
+func (f *Forwards) String() string {
+	if f == nil {
+		return ""
+	}
+	specs := make([]string, len(*f))
+	for i, fw := range *f {
+		specs[i] = fw.Listen + "->" + fw.Target
+	}
+	return strings.Join(specs, ",")
+}
+
+// Set 解析一条 ssh -L 风格的规则并追加到列表
+func (f *Forwards) Set(spec string) error {
+	fw, err := ParseForward(spec)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, fw)
+	return nil
+}
+
+// ParseForward 解析 [本地地址:]本地端口:目标主机:目标端口，IPv6 地址需放在方括号中。
+// 省略本地地址时只监听 localhost。
+func ParseForward(spec string) (Forward, error) {
+	fields := splitForward(spec)
+	bind := "localhost"
+	switch len(fields) {
+	case 3:
+	case 4:
+		bind, fields = fields[0], fields[1:]
+	default:
+		return Forward{}, fmt.Errorf("转发规则 %q 格式应为 [本地地址:]本地端口:目标主机:目标端口", spec)
+	}
+	port, host, hostPort := fields[0], fields[1], fields[2]
+	for _, p := range []string{port, hostPort} {
+		if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+			return Forward{}, fmt.Errorf("转发规则 %q 中的端口 %q 无效", spec, p)
+		}
+	}
+	if host == "" {
+		return Forward{}, fmt.Errorf("转发规则 %q 缺少目标主机", spec)
+	}
+	return Forward{Listen: net.JoinHostPort(bind, port), Target: net.JoinHostPort(host, hostPort)}, nil
+}
+
+// splitForward 按冒号切分规则，方括号内的冒号不切分，切分后去掉方括号
+func splitForward(spec string) []string {
+	var fields []string
+	depth, start := 0, 0
+	for i, r := range spec {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				fields = append(fields, spec[start:i])
+				start = i + 1
+			}
+		}
+	}
+	fields = append(fields, spec[start:])
+	for i, f := range fields {
+		fields[i] = strings.TrimSuffix(strings.TrimPrefix(f, "["), "]")
+	}
+	return fields
+}
@@ -0,0 +1,78 @@
+// Package logging 在标准库 log 之上提供简单的日志级别控制。
+// 错误仍直接使用 log.Printf 输出，不受级别影响。
+package logging
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Level 是日志级别，数值越小输出越详细
+type Level int32
+
+const (
+	// Debug 额外输出每个 ICMP 报文的收发情况
+	Debug Level = iota
+	// Info 输出请求和会话的开始与结束，是默认级别
+	Info
+	// Error 只输出错误
+	Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Error:
+		return "error"
+	default:
+		return fmt.Sprintf("Level(%d)", int32(l))
+	}
+}
+
+// ParseLevel 解析 debug、info、error 三种级别名称
+func ParseLevel(s string) (Level, error) {
+	for _, l := range []Level{Debug, Info, Error} {
+		if s == l.String() {
+			return l, nil
+		}
+	}
+	return Info, fmt.Errorf("未知的日志级别 %q，可选 debug、info、error", s)
+}
+
+var level atomic.Int32
+
+func init() { level.Store(int32(Info)) }
+
+// SetLevel 设置全局日志级别
+func SetLevel(l Level) { level.Store(int32(l)) }
+
+// Debugf 在 debug 级别输出日志
+func Debugf(format string, args ...any) {
+	if Level(level.Load()) <= Debug {
+		log.Printf(format, args...)
+	}
+}
+
+// Infof 在 info 及更详细的级别输出日志
+func Infof(format string, args ...any) {
+	if Level(level.Load()) <= Info {
+		log.Printf(format, args...)
+	}
+}
+
+// Set 实现 flag.Value，使级别可以直接用作命令行参数
+func (l *Level) Set(s string) error {
+	parsed, err := ParseLevel(s)
+	if err != nil {
+		return err
+	}
+	*l = parsed
+	return nil
+}
+
+// UnmarshalText 使级别可以在配置文件中以名称书写
+func (l *Level) UnmarshalText(b []byte) error { return l.Set(string(b)) }
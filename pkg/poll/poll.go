@@ -0,0 +1,218 @@
+// Package poll 让服务端只用 Echo Reply 应答客户端已经发出的 Echo 请求，从不主动发送报文。
+//
+// 状态防火墙和 NAT 通常只放行和请求一一对应的 Echo Reply，因此服务端把会话的下行报文
+// 排队，每收到客户端的一个请求（数据、确认或空的轮询请求）就用排在最前面的报文回复，
+// 回复原样使用请求的 ID 和 Seq，经过 NAT 时才能被匹配回客户端。没有数据可回时请求最多被挂起 Hold，之后用空报文回复。
+// 客户端为每个会话保持固定数量的未应答轮询请求，保证服务端随时有请求可用。
+package poll
+
+import (
+	"sync"
+	"time"
+)
+
+// Hold 是服务端挂起一个请求的最长时间，超时后用空报文回复，让客户端发出新的轮询
+const Hold = 2 * time.Second
+
+// lostAfter 是客户端认为一个轮询请求或它的回复已经丢失、不再等待的时间
+const lostAfter = 2 * Hold
+
+// maxQueued 是服务端一个会话最多排队的下行报文数，超出的报文被丢弃，由可靠流重传
+const maxQueued = 1024
+
+// request 是一个挂起等待下行报文的客户端请求
+type request struct {
+	id, seq int
+	timer   *time.Timer
+}
+
+// Queue 是服务端一个会话的下行队列
+type Queue struct {
+	reply func(id, seq int, b []byte) error
+	hold  time.Duration
+
+	mu      sync.Mutex
+	packets [][]byte
+	waiting []*request // 挂起的请求，最早的在前
+	closed  bool
+}
+
+// NewQueue 创建下行队列，reply 用 b 回复 ID 和序号为 id、seq 的请求，b 为空表示空报文
+func NewQueue(reply func(id, seq int, b []byte) error) *Queue {
+	return &Queue{reply: reply, hold: Hold}
+}
+
+// Request 登记客户端的一个请求：有排队的报文时立即用它回复，否则挂起直到有报文或超过 Hold
+func (q *Queue) Request(id, seq int) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		q.reply(id, seq, nil)
+		return
+	}
+	if len(q.packets) > 0 {
+		b := q.packets[0]
+		q.packets = q.packets[1:]
+		q.mu.Unlock()
+		q.reply(id, seq, b)
+		return
+	}
+	r := &request{id: id, seq: seq}
+	r.timer = time.AfterFunc(q.hold, func() { q.expire(r) })
+	q.waiting = append(q.waiting, r)
+	q.mu.Unlock()
+}
+
+// expire 用空报文回复一个挂起超时的请求
+func (q *Queue) expire(r *request) {
+	q.mu.Lock()
+	for i, w := range q.waiting {
+		if w == r {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			q.mu.Unlock()
+			q.reply(r.id, r.seq, nil)
+			return
+		}
+	}
+	q.mu.Unlock()
+}
+
+// Send 发送一个下行报文：有挂起的请求时用最早的一个立即回复，否则排队等待下一个请求。
+// 队列已满或已关闭时丢弃报文，和网络丢包一样由可靠流处理。
+func (q *Queue) Send(b []byte) error {
+	q.mu.Lock()
+	if q.closed || (len(q.waiting) == 0 && len(q.packets) >= maxQueued) {
+		q.mu.Unlock()
+		return nil
+	}
+	if len(q.waiting) == 0 {
+		q.packets = append(q.packets, b)
+		q.mu.Unlock()
+		return nil
+	}
+	r := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	r.timer.Stop()
+	q.mu.Unlock()
+	return q.reply(r.id, r.seq, b)
+}
+
+// Close 用空报文回复所有挂起的请求并丢弃排队的报文，之后的请求立即得到空回复
+func (q *Queue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.packets = nil
+	waiting := q.waiting
+	q.waiting = nil
+	q.mu.Unlock()
+	for _, r := range waiting {
+		r.timer.Stop()
+		q.reply(r.id, r.seq, nil)
+	}
+}
+
+// Poller 在客户端为一个会话保持 n 个未应答的轮询请求
+type Poller struct {
+	n       int
+	nextSeq func() int
+	send    func(seq int) error
+
+	mu          sync.Mutex
+	outstanding map[int]time.Time // 未应答的轮询请求序号和发送时间
+	sending     int               // 已决定发送但还没登记的轮询请求数
+	started     bool
+	closed      bool
+	done        chan struct{}
+}
+
+// NewPoller 创建轮询器。nextSeq 分配会话的下一个 Echo 序号，send 发出一个空的轮询请求。
+// 轮询在 Start 之后才开始，保证会话的第一个报文是握手报文。
+func NewPoller(n int, nextSeq func() int, send func(seq int) error) *Poller {
+	p := &Poller{n: n, nextSeq: nextSeq, send: send, outstanding: make(map[int]time.Time), done: make(chan struct{})}
+	go p.loop()
+	return p
+}
+
+// Start 开始轮询，可以重复调用
+func (p *Poller) Start() {
+	p.mu.Lock()
+	started := p.started
+	p.started = true
+	p.mu.Unlock()
+	if !started {
+		p.topUp()
+	}
+}
+
+// Received 记录序号为 seq 的请求得到了回复，是轮询请求时补发一个新的
+func (p *Poller) Received(seq int) {
+	p.mu.Lock()
+	_, ok := p.outstanding[seq]
+	delete(p.outstanding, seq)
+	p.mu.Unlock()
+	if ok {
+		p.topUp()
+	}
+}
+
+// Close 停止轮询，已发出的请求不再补发
+func (p *Poller) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+	}
+}
+
+// loop 定期放弃等待过久的轮询请求并补足数量，防止请求或回复丢失后轮询逐渐停止
+func (p *Poller) loop() {
+	ticker := time.NewTicker(Hold / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			p.mu.Lock()
+			for seq, sent := range p.outstanding {
+				if now.Sub(sent) > lostAfter {
+					delete(p.outstanding, seq)
+				}
+			}
+			p.mu.Unlock()
+			p.topUp()
+		}
+	}
+}
+
+// topUp 发出轮询请求，直到未应答的数量达到 n
+func (p *Poller) topUp() {
+	p.mu.Lock()
+	if !p.started || p.closed {
+		p.mu.Unlock()
+		return
+	}
+	need := p.n - len(p.outstanding) - p.sending
+	if need <= 0 {
+		p.mu.Unlock()
+		return
+	}
+	p.sending += need
+	p.mu.Unlock()
+
+	for i := 0; i < need; i++ {
+		seq := p.nextSeq()
+		p.mu.Lock()
+		p.sending--
+		p.outstanding[seq] = time.Now()
+		p.mu.Unlock()
+		if err := p.send(seq); err != nil {
+			// 发送失败的请求留在表中，超时后再补发，避免在网络故障时忙等
+			p.mu.Lock()
+			p.sending -= need - i - 1
+			p.mu.Unlock()
+			return
+		}
+	}
+}
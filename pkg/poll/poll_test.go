@@ -0,0 +1,131 @@
+package poll
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type replyLog struct {
+	mu      sync.Mutex
+	seqs    []int
+	packets []string
+}
+
+// reply 记录回复，ID 固定为 Seq 加 1000，用来检查回复原样使用了请求的 ID
+func (l *replyLog) reply(id, seq int, b []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if id != seq+1000 {
+		l.seqs = append(l.seqs, -1)
+		l.packets = append(l.packets, "wrong id")
+		return nil
+	}
+	l.seqs = append(l.seqs, seq)
+	l.packets = append(l.packets, string(b))
+	return nil
+}
+
+func (l *replyLog) get() ([]int, []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]int(nil), l.seqs...), append([]string(nil), l.packets...)
+}
+
+func TestQueuePairsPacketsWithRequests(t *testing.T) {
+	var l replyLog
+	q := NewQueue(l.reply)
+
+	// 没有请求时报文排队，下一个请求立即带走最早的报文
+	q.Send([]byte("a"))
+	q.Send([]byte("b"))
+	q.Request(1010, 10)
+	// 请求按到达顺序被挂起，报文到来时回复最早的请求
+	q.Request(1011, 11)
+	q.Request(1012, 12)
+	q.Send([]byte("c"))
+
+	seqs, packets := l.get()
+	wantSeqs, wantPackets := []int{10, 11, 12}, []string{"a", "b", "c"}
+	if len(seqs) != 3 {
+		t.Fatalf("got replies %v %q, want %v %q", seqs, packets, wantSeqs, wantPackets)
+	}
+	for i := range wantSeqs {
+		if seqs[i] != wantSeqs[i] || packets[i] != wantPackets[i] {
+			t.Errorf("reply %d = seq %d %q, want seq %d %q", i, seqs[i], packets[i], wantSeqs[i], wantPackets[i])
+		}
+	}
+}
+
+func TestQueueHoldExpires(t *testing.T) {
+	var l replyLog
+	q := NewQueue(l.reply)
+	q.hold = 20 * time.Millisecond
+
+	q.Request(1007, 7)
+	time.Sleep(100 * time.Millisecond)
+	seqs, packets := l.get()
+	if len(seqs) != 1 || seqs[0] != 7 || packets[0] != "" {
+		t.Fatalf("expected an empty reply to seq 7, got %v %q", seqs, packets)
+	}
+
+	// 超时回复后的报文应排队而不是再次回复同一个请求
+	q.Send([]byte("late"))
+	if seqs, _ := l.get(); len(seqs) != 1 {
+		t.Errorf("expired request answered twice: %v", seqs)
+	}
+}
+
+func TestQueueClose(t *testing.T) {
+	var l replyLog
+	q := NewQueue(l.reply)
+	q.Request(1001, 1)
+	q.Close()
+	q.Send([]byte("dropped"))
+	q.Request(1002, 2)
+
+	seqs, packets := l.get()
+	if len(seqs) != 2 || seqs[0] != 1 || seqs[1] != 2 || packets[0] != "" || packets[1] != "" {
+		t.Errorf("expected empty replies to 1 and 2, got %v %q", seqs, packets)
+	}
+}
+
+func TestPollerKeepsRequestsOutstanding(t *testing.T) {
+	var mu sync.Mutex
+	next := 0
+	var sent []int
+	p := NewPoller(3,
+		func() int { mu.Lock(); defer mu.Unlock(); next++; return next },
+		func(seq int) error { mu.Lock(); defer mu.Unlock(); sent = append(sent, seq); return nil })
+	defer p.Close()
+
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sent)
+	}
+	if n := count(); n != 0 {
+		t.Fatalf("poller sent %d requests before Start", n)
+	}
+	p.Start()
+	p.Start()
+	if n := count(); n != 3 {
+		t.Fatalf("expected 3 outstanding polls after Start, got %d", n)
+	}
+
+	// 非轮询请求的回复不触发补发，轮询请求的回复补发一个
+	p.Received(100)
+	if n := count(); n != 3 {
+		t.Errorf("reply to a non-poll request should not trigger a poll, sent %d", n)
+	}
+	p.Received(2)
+	if n := count(); n != 4 {
+		t.Errorf("expected a new poll after a reply, sent %d", n)
+	}
+
+	p.Close()
+	p.Received(1)
+	if n := count(); n != 4 {
+		t.Errorf("closed poller should not poll, sent %d", n)
+	}
+}
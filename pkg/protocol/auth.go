@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// KeyEnv 是保存预共享密钥的环境变量，客户端和服务端必须配置相同的值
+const KeyEnv = "ICMPTUN_PSK"
+
+// TagLen 是附加在每个帧之后的认证标签长度（截断的 HMAC-SHA256）
+const TagLen = 16
+
+// Direction 区分帧的发送方向，参与标签计算。
+// 这样被反射回来的报文（例如内核自动回复的 Echo Reply）无法通过对端的校验。
+type Direction uint8
+
+const (
+	// ClientToServer 是客户端发往服务端的帧
+	ClientToServer Direction = iota + 1
+	// ServerToClient 是服务端发往客户端的帧
+	ServerToClient
+)
+
+var (
+	// ErrNoKey 表示没有配置预共享密钥
+	ErrNoKey = errors.New("protocol: 未配置预共享密钥")
+	// ErrAuth 表示报文缺少认证标签或标签校验失败
+	ErrAuth = errors.New("protocol: 认证失败")
+)
+
+// Authenticator 用预共享密钥为帧计算和校验 HMAC 标签
+type Authenticator struct {
+	key []byte
+}
+
+// NewAuthenticator 使用预共享密钥创建 Authenticator，密钥不能为空
+func NewAuthenticator(key []byte) (*Authenticator, error) {
+	if len(key) == 0 {
+		return nil, ErrNoKey
+	}
+	return &Authenticator{key: append([]byte(nil), key...)}, nil
+}
+
+// Seal 在编码好的帧后面附加认证标签
+func (a *Authenticator) Seal(dir Direction, frame []byte) []byte {
+	b := make([]byte, len(frame), len(frame)+TagLen)
+	copy(b, frame)
+	return append(b, a.tag(dir, frame)...)
+}
+
+// Open 校验并去掉认证标签，返回其中的帧。校验失败时返回 ErrAuth。
+func (a *Authenticator) Open(dir Direction, b []byte) ([]byte, error) {
+	if len(b) < TagLen {
+		return nil, ErrAuth
+	}
+	frame, tag := b[:len(b)-TagLen], b[len(b)-TagLen:]
+	if !hmac.Equal(tag, a.tag(dir, frame)) {
+		return nil, ErrAuth
+	}
+	return frame, nil
+}
+
+func (a *Authenticator) tag(dir Direction, frame []byte) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte{byte(dir)})
+	mac.Write(frame)
+	return mac.Sum(nil)[:TagLen]
+}
@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestAuthenticatorSealOpen(t *testing.T) {
+	a, err := NewAuthenticator([]byte("secret"))
+	if err != nil {
+		t.Fatalf("NewAuthenticator failed: %v", err)
+	}
+	frame, _ := (&Frame{Type: FrameData, Session: 9, Payload: []byte("GET / HTTP/1.1\r\n\r\n")}).Marshal()
+
+	sealed := a.Seal(ClientToServer, frame)
+	if len(sealed) != len(frame)+TagLen {
+		t.Fatalf("sealed length = %d, want %d", len(sealed), len(frame)+TagLen)
+	}
+	got, err := a.Open(ClientToServer, sealed)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if !bytes.Equal(got, frame) {
+		t.Error("Open returned a different frame")
+	}
+
+	if _, err := a.Open(ServerToClient, sealed); !errors.Is(err, ErrAuth) {
+		t.Errorf("reflected frame: expected ErrAuth, got %v", err)
+	}
+	tampered := append([]byte(nil), sealed...)
+	tampered[10] ^= 1
+	if _, err := a.Open(ClientToServer, tampered); !errors.Is(err, ErrAuth) {
+		t.Errorf("tampered frame: expected ErrAuth, got %v", err)
+	}
+	other, _ := NewAuthenticator([]byte("other"))
+	if _, err := other.Open(ClientToServer, sealed); !errors.Is(err, ErrAuth) {
+		t.Errorf("wrong key: expected ErrAuth, got %v", err)
+	}
+	if _, err := a.Open(ClientToServer, []byte("ping")); !errors.Is(err, ErrAuth) {
+		t.Errorf("plain ping: expected ErrAuth, got %v", err)
+	}
+}
+
+func TestNewAuthenticatorRequiresKey(t *testing.T) {
+	if _, err := NewAuthenticator(nil); !errors.Is(err, ErrNoKey) {
+		t.Errorf("expected ErrNoKey, got %v", err)
+	}
+}
+
+func TestSessionHeader(t *testing.T) {
+	b := AppendSession(nil, 0xdeadbeef, []byte("payload"))
+	session, payload, err := SplitSession(b)
+	if err != nil || session != 0xdeadbeef || string(payload) != "payload" {
+		t.Errorf("SplitSession = %#x %q %v", session, payload, err)
+	}
+	if _, payload, err := SplitSession(AppendSession(nil, 1, nil)); err != nil || len(payload) != 0 {
+		t.Errorf("empty payload: %q %v", payload, err)
+	}
+	if _, _, err := SplitSession([]byte{1, 2, 3}); !errors.Is(err, ErrMalformed) {
+		t.Errorf("short header: expected ErrMalformed, got %v", err)
+	}
+}
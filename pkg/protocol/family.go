@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Family 描述隧道在某个地址族上使用的 ICMP 协议：IPv4 上是 ICMP，IPv6 上是 ICMPv6。
+// 两者的报文格式相同，只有监听的网络、协议号和 Echo 类型值不同。
+type Family struct {
+	Network     string // icmp.ListenPacket 使用的网络，原始套接字，需要 root
+	Datagram    string // 非特权 ping 套接字使用的网络，只能收到自己请求的回复，仅适用于客户端
+	IPNetwork   string // net.ResolveIPAddr 使用的网络
+	Unspecified string // 监听所有地址时使用的地址
+	Protocol    int    // icmp.ParseMessage 使用的协议号
+	HeaderLen   int    // 不含选项和扩展头的 IP 头长度
+	Request     icmp.Type
+	Reply       icmp.Type
+}
+
+var (
+	IPv4 = &Family{
+		Network:     "ip4:icmp",
+		Datagram:    "udp4",
+		IPNetwork:   "ip4",
+		Unspecified: "0.0.0.0",
+		Protocol:    ipv4.ICMPTypeEcho.Protocol(),
+		HeaderLen:   ipv4.HeaderLen,
+		Request:     ipv4.ICMPTypeEcho,
+		Reply:       ipv4.ICMPTypeEchoReply,
+	}
+	IPv6 = &Family{
+		Network:     "ip6:ipv6-icmp",
+		Datagram:    "udp6",
+		IPNetwork:   "ip6",
+		Unspecified: "::",
+		Protocol:    ipv6.ProtocolIPv6ICMP,
+		HeaderLen:   ipv6.HeaderLen,
+		Request:     ipv6.ICMPTypeEchoRequest,
+		Reply:       ipv6.ICMPTypeEchoReply,
+	}
+)
+
+// FamilyOf 返回 ip 所属地址族的 Family，IPv4 映射的 IPv6 地址按 IPv4 处理
+func FamilyOf(ip net.IP) *Family {
+	if ip.To4() == nil && ip.To16() != nil {
+		return IPv6
+	}
+	return IPv4
+}
+
+// ResolveFamily 解析 host，返回解析出的地址和它所属的 Family。
+// 域名同时有 A 和 AAAA 记录时优先使用 IPv4。
+func ResolveFamily(host string) (*net.IPAddr, *Family, error) {
+	addr, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, nil, err
+	}
+	return addr, FamilyOf(addr.IP), nil
+}
+
+// echoHeaderLen 是 Echo 报文 Data 之前的 ICMP 头长度
+const echoHeaderLen = 8
+
+// ChunkSize 返回 MTU 为 mtu 的路径上单个 Echo 报文最多能携带的 Data 字节数
+func (f *Family) ChunkSize(mtu int) int {
+	return mtu - f.HeaderLen - echoHeaderLen
+}
+
+// Quoted 是 ICMP 差错报文引用的原始 Echo 报文
+type Quoted struct {
+	Dst  net.IP    // 原始报文的目的地址
+	Type icmp.Type // Echo 请求或回复
+	// Echo 的 Data 是引用到的那部分负载，路由器只需引用 ICMP 头的 8 个字节，因此可能为空
+	Echo *icmp.Echo
+}
+
+// Session 返回引用的负载开头的会话 ID，引用的负载太短时返回 false
+func (q *Quoted) Session() (uint32, bool) {
+	session, _, err := SplitSession(q.Echo.Data)
+	return session, err == nil
+}
+
+// ParseQuoted 从差错报文引用的原始报文（IP 头和随后的 ICMP 报文开头）中取出 Echo 报文。
+// 不是 f 的 Echo 请求或回复时返回 false。
+func (f *Family) ParseQuoted(b []byte) (*Quoted, bool) {
+	var dst net.IP
+	switch f {
+	case IPv6:
+		// 不解析扩展头，隧道发出的报文不带扩展头
+		if len(b) < ipv6.HeaderLen || b[0]>>4 != 6 || b[6] != ipv6.ProtocolIPv6ICMP {
+			return nil, false
+		}
+		dst, b = net.IP(b[24:40]), b[ipv6.HeaderLen:]
+	default:
+		if len(b) < ipv4.HeaderLen || b[0]>>4 != 4 || b[9] != ipv4.ProtocolICMP {
+			return nil, false
+		}
+		ihl := int(b[0]&0x0f) * 4
+		if ihl < ipv4.HeaderLen || len(b) < ihl {
+			return nil, false
+		}
+		dst, b = net.IP(b[16:20]), b[ihl:]
+	}
+	msg, err := icmp.ParseMessage(f.Protocol, b)
+	if err != nil || (msg.Type != f.Request && msg.Type != f.Reply) {
+		return nil, false
+	}
+	echo, ok := msg.Body.(*icmp.Echo)
+	if !ok {
+		return nil, false
+	}
+	return &Quoted{Dst: append(net.IP(nil), dst...), Type: msg.Type, Echo: echo}, true
+}
+
+// PacketTooBig 判断 msg 是否是路径上的报文过大通知：ICMPv4 的需要分片或 ICMPv6 的报文过大。
+// 返回下一跳 MTU 和引用的原始报文；不支持 RFC 1191 的老路由器报告的 MTU 为 0。
+func PacketTooBig(msg *icmp.Message) (mtu int, quoted []byte, ok bool) {
+	switch body := msg.Body.(type) {
+	case *icmp.DstUnreach:
+		if msg.Type == ipv4.ICMPTypeDestinationUnreachable && msg.Code == 4 {
+			return body.NextHopMTU, body.Data, true
+		}
+	case *icmp.PacketTooBig:
+		return body.MTU, body.Data, true
+	}
+	return 0, nil, false
+}
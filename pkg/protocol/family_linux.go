@@ -0,0 +1,30 @@
+package protocol
+
+import (
+	"net"
+	"syscall"
+)
+
+// SetDontFragment 让 conn 发出的报文都带上禁止分片标志，并且不受内核缓存的路径 MTU 限制，
+// 超过路径 MTU 的报文由路由器丢弃并回复报文过大通知，路径 MTU 由隧道自己探测。
+func (f *Family) SetDontFragment(conn net.PacketConn) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return syscall.EINVAL
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	level, opt, val := syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE
+	if f == IPv6 {
+		level, opt, val = syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), level, opt, val)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package protocol
+
+import (
+	"errors"
+	"net"
+)
+
+// SetDontFragment 只在 Linux 上受支持，其他系统上报文仍可能被分片，探测到的是分片后的上限
+func (f *Family) SetDontFragment(conn net.PacketConn) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"icmptun/internal/icmptest"
+	"net"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestFamilyOf(t *testing.T) {
+	cases := []struct {
+		ip   string
+		want *Family
+	}{
+		{"192.0.2.1", IPv4},
+		{"::ffff:192.0.2.1", IPv4},
+		{"2001:db8::1", IPv6},
+		{"::", IPv6},
+	}
+	for _, c := range cases {
+		if got := FamilyOf(net.ParseIP(c.ip)); got != c.want {
+			t.Errorf("FamilyOf(%s) = %s, want %s", c.ip, got.Network, c.want.Network)
+		}
+	}
+
+	addr, f, err := ResolveFamily("::1")
+	if err != nil {
+		t.Fatalf("ResolveFamily failed: %v", err)
+	}
+	if f != IPv6 || !addr.IP.Equal(net.IPv6loopback) {
+		t.Errorf("ResolveFamily(::1) = %v %s", addr, f.Network)
+	}
+}
+
+func TestParseQuoted(t *testing.T) {
+	data := AppendSession(nil, 77, []byte("sealed"))
+	req, _ := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 77, Seq: 5, Data: data}}).Marshal()
+	server := net.IPv4(203, 0, 113, 1)
+
+	q, ok := IPv4.ParseQuoted(icmptest.QuoteIPv4(server, 4, req))
+	if !ok || !q.Dst.Equal(server) || q.Type != IPv4.Request || q.Echo.ID != 77 || q.Echo.Seq != 5 {
+		t.Errorf("full quote: got %+v, %v", q, ok)
+	}
+	if session, ok := q.Session(); !ok || session != 77 {
+		t.Errorf("full quote: session %d, %v", session, ok)
+	}
+	// RFC 792 只要求引用 8 个字节，在会话头之前就结束了
+	q, ok = IPv4.ParseQuoted(icmptest.QuoteIPv4(server, 0, req[:8]))
+	if !ok || q.Echo.ID != 77 {
+		t.Errorf("8-byte quote: got %+v, %v", q, ok)
+	}
+	if _, ok := q.Session(); ok {
+		t.Error("8-byte quote should not carry a session")
+	}
+
+	reply, _ := (&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 77, Seq: 5}}).Marshal()
+	if q, ok := IPv4.ParseQuoted(icmptest.QuoteIPv4(server, 0, reply)); !ok || q.Type != IPv4.Reply {
+		t.Errorf("reply quote: got %+v, %v", q, ok)
+	}
+	unreach, _ := (&icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Body: &icmp.DstUnreach{}}).Marshal()
+	for name, b := range map[string][]byte{
+		"not echo":     icmptest.QuoteIPv4(server, 0, unreach),
+		"truncated":    icmptest.QuoteIPv4(server, 0, req[:6]),
+		"bad ihl":      append([]byte{0x42}, icmptest.QuoteIPv4(server, 0, req)[1:]...),
+		"short header": icmptest.QuoteIPv4(server, 0, req)[:ipv4.HeaderLen-1],
+	} {
+		if q, ok := IPv4.ParseQuoted(b); ok {
+			t.Errorf("%s: accepted %+v", name, q)
+		}
+	}
+
+	req6, _ := (&icmp.Message{Type: ipv6.ICMPTypeEchoRequest, Body: &icmp.Echo{ID: 1, Seq: 2, Data: data}}).Marshal()
+	server6 := net.ParseIP("2001:db8::1")
+	q, ok = IPv6.ParseQuoted(icmptest.QuoteIPv6(server6, req6))
+	if !ok || !q.Dst.Equal(server6) || q.Echo.Seq != 2 {
+		t.Errorf("ipv6 quote: got %+v, %v", q, ok)
+	}
+	if session, ok := q.Session(); !ok || session != 77 {
+		t.Errorf("ipv6 quote: session %d, %v", session, ok)
+	}
+}
+
+func TestPacketTooBig(t *testing.T) {
+	cases := []struct {
+		name string
+		msg  *icmp.Message
+		mtu  int
+		ok   bool
+	}{
+		{"frag needed", &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 4, Body: &icmp.DstUnreach{NextHopMTU: 1400, Data: []byte{1}}}, 1400, true},
+		{"host unreachable", &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 1, Body: &icmp.DstUnreach{Data: []byte{1}}}, 0, false},
+		{"packet too big", &icmp.Message{Type: ipv6.ICMPTypePacketTooBig, Body: &icmp.PacketTooBig{MTU: 1280, Data: []byte{1}}}, 1280, true},
+		{"ipv6 unreachable", &icmp.Message{Type: ipv6.ICMPTypeDestinationUnreachable, Code: 4, Body: &icmp.DstUnreach{Data: []byte{1}}}, 0, false},
+	}
+	for _, c := range cases {
+		mtu, quoted, ok := PacketTooBig(c.msg)
+		if ok != c.ok || mtu != c.mtu || (ok && len(quoted) != 1) {
+			t.Errorf("%s: got %d, %v, %v", c.name, mtu, quoted, ok)
+		}
+	}
+	if n := IPv4.ChunkSize(1500); n != 1472 {
+		t.Errorf("IPv4.ChunkSize(1500) = %d", n)
+	}
+	if n := IPv6.ChunkSize(1280); n != BaseChunkSize {
+		t.Errorf("IPv6.ChunkSize(1280) = %d, want BaseChunkSize", n)
+	}
+}
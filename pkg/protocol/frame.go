@@ -0,0 +1,176 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// 隧道帧格式（大端序），放在 ICMP Echo 的 Data 中：
+//
+//	 0      2       3      4       5       6        8         12       16    20       24
+//	+------+-------+------+-------+-------+--------+---------+--------+-----+--------+
+//	|magic |version| type | flags | nsack | length | session | offset | ack | window |
+//	+------+-------+------+-------+-------+--------+---------+--------+-----+--------+
+//	| nsack 个 SACK 块（start, end 各 4 字节） | length 字节负载 |
+//
+// offset 是负载第一个字节的流偏移；ack 是期望收到的下一个偏移（累积确认）；
+// window 是从 ack 开始还能接收的字节数。所有类型的帧都携带 ack 和 window。
+const (
+	// Magic 标识隧道帧，用来区分普通 ping 和隧道数据
+	Magic uint16 = 0x4954 // "IT"
+	// Version 是当前的帧格式版本
+	Version uint8 = 1
+
+	// FrameHeaderLen 是不含 SACK 块的帧头长度
+	FrameHeaderLen = 24
+	// MaxSACKBlocks 是单个帧最多携带的 SACK 块数量
+	MaxSACKBlocks = 3
+	// MaxFrameHeaderLen 是帧头可能占用的最大字节数
+	MaxFrameHeaderLen = FrameHeaderLen + MaxSACKBlocks*8
+)
+
+// FrameType 表示帧的类型
+type FrameType uint8
+
+const (
+	// FrameData 携带流数据
+	FrameData FrameType = iota + 1
+	// FrameAck 只携带确认和窗口信息
+	FrameAck
+	// FrameFIN 表示发送方不会再发送数据，占用一个流偏移
+	FrameFIN
+	// FrameRST 表示会话被立即中止
+	FrameRST
+	// FrameError 和 FIN 一样结束流并占用一个流偏移，负载是错误类别(1)和描述
+	FrameError
+	// FramePing 要求对端立即回复一个 ACK
+	FramePing
+	// FrameProbe 是路径 MTU 探测帧，不占用流偏移。offset 是探测的 MSS，帧的总长度
+	// 等于携带这么多数据的最大帧；负载开头 4 字节是发送方的 MSS 上限，其余为填充
+	FrameProbe
+	// FrameProbeAck 确认收到了探测帧，offset 是探测的 MSS，负载是确认方的 MSS 上限(4)
+	FrameProbeAck
+	// FrameFEC 是一组数据帧的 XOR 校验，不占用流偏移，也不可靠送达。
+	// offset 是组内第一个数据帧的偏移，负载格式见 tunnel 包
+	FrameFEC
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameData:
+		return "DATA"
+	case FrameAck:
+		return "ACK"
+	case FrameFIN:
+		return "FIN"
+	case FrameRST:
+		return "RST"
+	case FrameError:
+		return "ERROR"
+	case FramePing:
+		return "PING"
+	case FrameProbe:
+		return "PROBE"
+	case FrameProbeAck:
+		return "PROBE_ACK"
+	case FrameFEC:
+		return "FEC"
+	default:
+		return fmt.Sprintf("FrameType(%d)", uint8(t))
+	}
+}
+
+var (
+	// ErrNotFrame 表示数据不是隧道帧（魔数不匹配），通常是普通的 ping
+	ErrNotFrame = errors.New("protocol: 不是隧道帧")
+	// ErrVersion 表示帧使用了不支持的版本
+	ErrVersion = errors.New("protocol: 不支持的帧版本")
+	// ErrMalformed 表示帧长度或字段不合法
+	ErrMalformed = errors.New("protocol: 帧格式错误")
+)
+
+// SACKBlock 描述接收方已经收到的一段乱序数据 [Start, End)
+type SACKBlock struct {
+	Start, End uint32
+}
+
+// Frame 是隧道协议的基本单元
+type Frame struct {
+	Type    FrameType
+	Flags   uint8
+	Session uint32
+	Offset  uint32
+	Ack     uint32
+	Window  uint32
+	SACK    []SACKBlock
+	Payload []byte
+}
+
+// Marshal 编码帧
+func (f *Frame) Marshal() ([]byte, error) {
+	if len(f.SACK) > MaxSACKBlocks {
+		return nil, fmt.Errorf("%w: SACK 块过多 (%d)", ErrMalformed, len(f.SACK))
+	}
+	if len(f.Payload) > 0xffff {
+		return nil, fmt.Errorf("%w: 负载过长 (%d)", ErrMalformed, len(f.Payload))
+	}
+	b := make([]byte, FrameHeaderLen+len(f.SACK)*8+len(f.Payload))
+	binary.BigEndian.PutUint16(b[0:2], Magic)
+	b[2] = Version
+	b[3] = byte(f.Type)
+	b[4] = f.Flags
+	b[5] = byte(len(f.SACK))
+	binary.BigEndian.PutUint16(b[6:8], uint16(len(f.Payload)))
+	binary.BigEndian.PutUint32(b[8:12], f.Session)
+	binary.BigEndian.PutUint32(b[12:16], f.Offset)
+	binary.BigEndian.PutUint32(b[16:20], f.Ack)
+	binary.BigEndian.PutUint32(b[20:24], f.Window)
+	off := FrameHeaderLen
+	for _, blk := range f.SACK {
+		binary.BigEndian.PutUint32(b[off:], blk.Start)
+		binary.BigEndian.PutUint32(b[off+4:], blk.End)
+		off += 8
+	}
+	copy(b[off:], f.Payload)
+	return b, nil
+}
+
+// ParseFrame 解析帧，魔数不匹配时返回 ErrNotFrame
+func ParseFrame(b []byte) (*Frame, error) {
+	if len(b) < 2 || binary.BigEndian.Uint16(b[0:2]) != Magic {
+		return nil, ErrNotFrame
+	}
+	if len(b) < FrameHeaderLen {
+		return nil, fmt.Errorf("%w: 长度不足 (%d)", ErrMalformed, len(b))
+	}
+	if b[2] != Version {
+		return nil, fmt.Errorf("%w: %d", ErrVersion, b[2])
+	}
+	f := &Frame{
+		Type:    FrameType(b[3]),
+		Flags:   b[4],
+		Session: binary.BigEndian.Uint32(b[8:12]),
+		Offset:  binary.BigEndian.Uint32(b[12:16]),
+		Ack:     binary.BigEndian.Uint32(b[16:20]),
+		Window:  binary.BigEndian.Uint32(b[20:24]),
+	}
+	if f.Type < FrameData || f.Type > FrameFEC {
+		return nil, fmt.Errorf("%w: 未知帧类型 %d", ErrMalformed, b[3])
+	}
+	nsack := int(b[5])
+	length := int(binary.BigEndian.Uint16(b[6:8]))
+	if nsack > MaxSACKBlocks || len(b) != FrameHeaderLen+nsack*8+length {
+		return nil, fmt.Errorf("%w: 长度与帧头不符", ErrMalformed)
+	}
+	off := FrameHeaderLen
+	for i := 0; i < nsack; i++ {
+		f.SACK = append(f.SACK, SACKBlock{
+			Start: binary.BigEndian.Uint32(b[off:]),
+			End:   binary.BigEndian.Uint32(b[off+4:]),
+		})
+		off += 8
+	}
+	f.Payload = append([]byte(nil), b[off:]...)
+	return f, nil
+}
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []*Frame{
+		{Type: FrameData, Session: 0x1234, Offset: 1400, Ack: 99, Window: 65536, Payload: []byte("GET / HTTP/1.1\r\n\r\n")},
+		{Type: FrameAck, Session: 1, Ack: 2800, Window: 1024, SACK: []SACKBlock{{4200, 5600}, {7000, 8400}}},
+		{Type: FrameFIN, Session: 7, Offset: 0xfffffff0},
+		{Type: FrameRST, Session: 0xffffffff},
+		{Type: FrameError, Session: 3, Offset: 10, Payload: []byte{4, 'x'}},
+		{Type: FramePing, Flags: 0x80, Session: 5},
+		{Type: FrameProbe, Session: 6, Offset: 1352, Payload: make([]byte, 1376)},
+		{Type: FrameProbeAck, Session: 6, Offset: 1352, Payload: []byte{0, 0, 5, 0x48}},
+		{Type: FrameFEC, Session: 7, Offset: 4096, Payload: []byte{2, 1, 0, 0, 3, 0, 2, 'a' ^ 'd', 'b' ^ 'e', 'c'}},
+	}
+	for _, in := range frames {
+		b, err := in.Marshal()
+		if err != nil {
+			t.Fatalf("%v: Marshal failed: %v", in.Type, err)
+		}
+		out, err := ParseFrame(b)
+		if err != nil {
+			t.Fatalf("%v: ParseFrame failed: %v", in.Type, err)
+		}
+		// nil 和空切片编码相同，按字段的文本形式比较
+		if fmt.Sprintf("%+v", in) != fmt.Sprintf("%+v", out) {
+			t.Errorf("%v: round trip mismatch:\n got %+v\nwant %+v", in.Type, out, in)
+		}
+	}
+}
+
+func TestParseFrameRejects(t *testing.T) {
+	valid, _ := (&Frame{Type: FrameData, Payload: []byte("abc")}).Marshal()
+
+	if _, err := ParseFrame([]byte("plain ping payload")); !errors.Is(err, ErrNotFrame) {
+		t.Errorf("plain ping: expected ErrNotFrame, got %v", err)
+	}
+	badVersion := append([]byte(nil), valid...)
+	badVersion[2] = Version + 1
+	if _, err := ParseFrame(badVersion); !errors.Is(err, ErrVersion) {
+		t.Errorf("bad version: expected ErrVersion, got %v", err)
+	}
+	badType := append([]byte(nil), valid...)
+	badType[3] = 0
+	if _, err := ParseFrame(badType); !errors.Is(err, ErrMalformed) {
+		t.Errorf("bad type: expected ErrMalformed, got %v", err)
+	}
+	if _, err := ParseFrame(valid[:len(valid)-1]); !errors.Is(err, ErrMalformed) {
+		t.Errorf("truncated: expected ErrMalformed, got %v", err)
+	}
+	if _, err := (&Frame{Type: FrameAck, SACK: make([]SACKBlock, MaxSACKBlocks+1)}).Marshal(); err == nil {
+		t.Error("expected Marshal to reject too many SACK blocks")
+	}
+}
+
+// FuzzFrame 确保任意输入都不会让 ParseFrame 崩溃，且能解析的帧重新编码后与输入完全一致
+func FuzzFrame(f *testing.F) {
+	for _, fr := range []*Frame{
+		{Type: FrameData, Session: 1, Payload: []byte("hello")},
+		{Type: FrameAck, Ack: 10, Window: 100, SACK: []SACKBlock{{20, 30}}},
+		{Type: FrameError, Payload: []byte{2, 'd', 'n', 's'}},
+	} {
+		b, _ := fr.Marshal()
+		f.Add(b)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0x49, 0x54})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		fr, err := ParseFrame(b)
+		if err != nil {
+			return
+		}
+		out, err := fr.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal of parsed frame failed: %v", err)
+		}
+		if !bytes.Equal(out, b) {
+			t.Fatalf("round trip mismatch:\n got %x\nwant %x", out, b)
+		}
+	})
+}
@@ -0,0 +1,22 @@
+package protocol
+
+import "encoding/binary"
+
+// SessionHeaderLen 是每个 Echo 报文负载开头的会话 ID 长度。
+// NAT 会改写 Echo 的 ID（有时还有 Seq），因此双方只按负载中的会话 ID 区分会话，
+// 外层的 ID 和 Seq 只用于让 NAT 把回复和请求对应起来：服务端总是原样使用请求的 ID 和 Seq 回复。
+const SessionHeaderLen = 4
+
+// AppendSession 在 b 后面追加会话 ID 和 payload，结果再交给 Authenticator.Seal 签名
+func AppendSession(b []byte, session uint32, payload []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, session)
+	return append(b, payload...)
+}
+
+// SplitSession 从认证过的负载中取出会话 ID，payload 为空表示轮询请求或空回复
+func SplitSession(b []byte) (session uint32, payload []byte, err error) {
+	if len(b) < SessionHeaderLen {
+		return 0, nil, ErrMalformed
+	}
+	return binary.BigEndian.Uint32(b), b[SessionHeaderLen:], nil
+}
@@ -1,9 +1,25 @@
 package protocol
 
-// ServerAddr is the address of the remote server.
-// Clients will send ICMP packets to this address.
-// 注意：这里应该填写你服务器的公网 IP 地址。
-const ServerAddr = "127.0.0.1" // 请将这里修改为你服务器的公网 IP
+// MaxChunkSize 定义一个 ICMP 包内的默认最大数据尺寸，保留给 IP 和 ICMP 头的空间。
+// 客户端和服务端分片时都默认使用这个值，可以通过 -chunk-size 调整。
+// 开启路径 MTU 探测时它是探测的上限，会话实际使用的大小由探测决定。
+const MaxChunkSize = 1400
 
-// LocalProxyAddr is the address the client will listen on to act as an HTTP proxy.
-const LocalProxyAddr = "localhost:8888"
+// BaseChunkSize 是开启路径 MTU 探测时会话开始使用的数据尺寸：IPv6 要求的最小 MTU 1280
+// 减去 IPv6 头和 ICMPv6 头，几乎所有路径（包括 PPPoE 和常见 VPN）都能通过。
+const BaseChunkSize = 1232
+
+// MaxPacketSize 是读取 ICMP 报文使用的缓冲区大小。
+// 超过 MTU 的报文会在 IP 层分片后重组，因此按 IP 报文的上限分配，避免截断。
+const MaxPacketSize = 65535
+
+// 反向端口转发使用的请求方法，请求行为 "方法 * HTTP/1.1"，参数放在 Host 头中。
+//
+// 客户端用 BIND 请求服务端监听 Host 中的地址，服务端回复 200 后保持会话打开，
+// 每接受一个连接就在会话中写入一行随机令牌。客户端随后为每个令牌打开一个
+// ACCEPT 会话，Host 为令牌，服务端回复 200 后在该会话和接受的连接之间转发字节。
+// BIND 会话结束时服务端停止监听。
+const (
+	MethodBind   = "BIND"
+	MethodAccept = "ACCEPT"
+)
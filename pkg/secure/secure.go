@@ -0,0 +1,305 @@
+// Package secure 为每个隧道会话建立独立的加密通道。
+//
+// 会话开始时客户端（发起方）和服务端（响应方）交换临时 X25519 公钥，
+// 用 HKDF-SHA256 从共享密钥派生两个方向各自的 AES-256-GCM 密钥，
+// 之后的每个帧都整体加密后才放进 ICMP 报文。握手报文本身由外层的
+// 预共享密钥 HMAC 认证，因此中间人无法替换公钥。
+//
+// 报文格式：
+//
+//	HELLO: kind(1)=1 | session(4) | X25519 公钥(32)
+//	DATA:  kind(1)=2 | counter(8) | 密文和 GCM 标签
+//
+// counter 是发送方向上的报文计数，作为 nonce 使用，从不重复。接收方用一个 replayWindow 个计数的
+// 滑动窗口记录收到过的计数，重复的计数和比窗口更旧的计数都被拒绝，截获的报文不能再次送达。
+package secure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	kindHello byte = 1
+	kindData  byte = 2
+
+	helloLen      = 1 + 4 + 32
+	dataHeaderLen = 1 + 8
+
+	// Overhead 是加密给每个帧增加的字节数
+	Overhead = dataHeaderLen + 16
+
+	// maxPending 是握手完成前最多缓存的帧数，超出的帧丢弃，由可靠流重传
+	maxPending = 256
+	// helloInterval 是握手完成前重发 HELLO 的最小间隔
+	helloInterval = 200 * time.Millisecond
+	// replayWindow 是抗重放窗口的大小，比收到过的最大计数小这么多以上的报文一律拒绝
+	replayWindow = 128
+)
+
+var (
+	// ErrMalformed 表示报文不是合法的握手或加密报文
+	ErrMalformed = errors.New("secure: 报文格式错误")
+	// ErrDecrypt 表示报文解密或完整性校验失败
+	ErrDecrypt = errors.New("secure: 解密失败")
+	// ErrNotEstablished 表示握手完成前收到了加密报文
+	ErrNotEstablished = errors.New("secure: 握手尚未完成")
+	// ErrReplay 表示报文的计数已经收到过或太旧，可能是重放的报文
+	ErrReplay = errors.New("secure: 重复或重放的报文")
+)
+
+// Channel 是一个会话的加密通道。发起方在第一次 Seal 时发出 HELLO，
+// 握手完成前的帧先缓存起来，收到响应方的 HELLO 后一起加密发送。
+type Channel struct {
+	initiator bool
+	session   uint32
+	priv      *ecdh.PrivateKey
+	output    func([]byte) error
+
+	mu        sync.Mutex
+	hello     []byte // 本端的 HELLO 报文
+	helloSent time.Time
+	sendAEAD  cipher.AEAD
+	recvAEAD  cipher.AEAD
+	sendCtr   uint64
+	recvNext  uint64    // 收到过的最大计数加一，0 表示还没有收到过
+	recvSeen  [2]uint64 // 第 i 位表示计数 recvNext-1-i 已经收到，共 replayWindow 位
+	pending   [][]byte
+}
+
+// NewInitiator 创建客户端一侧的通道，session 随 HELLO 发给响应方，
+// output 负责把报文发给对端
+func NewInitiator(session uint32, output func([]byte) error) (*Channel, error) {
+	return newChannel(true, session, output)
+}
+
+// NewResponder 创建服务端一侧的通道，它在收到发起方的 HELLO 后回复自己的 HELLO
+func NewResponder(session uint32, output func([]byte) error) (*Channel, error) {
+	return newChannel(false, session, output)
+}
+
+func newChannel(initiator bool, session uint32, output func([]byte) error) (*Channel, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hello := make([]byte, 0, helloLen)
+	hello = append(hello, kindHello)
+	hello = binary.BigEndian.AppendUint32(hello, session)
+	hello = append(hello, priv.PublicKey().Bytes()...)
+	return &Channel{initiator: initiator, session: session, priv: priv, output: output, hello: hello}, nil
+}
+
+// HelloSession 判断报文是否是 HELLO，是则返回其中的会话 ID。
+// 响应方据此为未知的对端建立新会话。
+func HelloSession(b []byte) (uint32, bool) {
+	if len(b) != helloLen || b[0] != kindHello {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(b[1:5]), true
+}
+
+// Seal 加密一个帧并发送。握手完成前帧会被缓存，并按需重发 HELLO。
+func (c *Channel) Seal(frame []byte) error {
+	c.mu.Lock()
+	if c.sendAEAD == nil {
+		if len(c.pending) < maxPending {
+			c.pending = append(c.pending, append([]byte(nil), frame...))
+		}
+		var hello []byte
+		if c.initiator && time.Since(c.helloSent) >= helloInterval {
+			c.helloSent = time.Now()
+			hello = c.hello
+		}
+		c.mu.Unlock()
+		if hello != nil {
+			return c.output(hello)
+		}
+		return nil
+	}
+	pkt := c.sealLocked(frame)
+	c.mu.Unlock()
+	return c.output(pkt)
+}
+
+// Open 处理一个从对端收到的报文。加密报文解密后返回其中的帧；
+// 握手报文在内部处理，返回的帧为 nil。
+func (c *Channel) Open(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, ErrMalformed
+	}
+	switch b[0] {
+	case kindHello:
+		return nil, c.handleHello(b)
+	case kindData:
+		if len(b) < Overhead {
+			return nil, ErrMalformed
+		}
+		ctr := binary.BigEndian.Uint64(b[1:dataHeaderLen])
+		c.mu.Lock()
+		aead := c.recvAEAD
+		fresh := c.freshLocked(ctr)
+		c.mu.Unlock()
+		if aead == nil {
+			return nil, ErrNotEstablished
+		}
+		if !fresh {
+			return nil, ErrReplay
+		}
+		frame, err := aead.Open(nil, nonce(ctr), b[dataHeaderLen:], b[:dataHeaderLen])
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		// 通过认证后才记录计数，伪造的报文不能推动窗口；并发收到的同一个报文只有一个能送达
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if !c.freshLocked(ctr) {
+			return nil, ErrReplay
+		}
+		c.markLocked(ctr)
+		return frame, nil
+	default:
+		return nil, ErrMalformed
+	}
+}
+
+// handleHello 根据对端公钥派生会话密钥。响应方每次收到 HELLO 都回复自己的 HELLO，
+// 以弥补丢失的回复；握手完成后把缓存的帧加密发出。
+func (c *Channel) handleHello(b []byte) error {
+	session, ok := HelloSession(b)
+	if !ok || session != c.session {
+		return ErrMalformed
+	}
+	c.mu.Lock()
+	if c.sendAEAD == nil {
+		if err := c.deriveLocked(b[5:]); err != nil {
+			c.mu.Unlock()
+			return err
+		}
+	}
+	var out [][]byte
+	if !c.initiator {
+		out = append(out, c.hello)
+	}
+	for _, frame := range c.pending {
+		out = append(out, c.sealLocked(frame))
+	}
+	c.pending = nil
+	c.mu.Unlock()
+
+	for _, pkt := range out {
+		c.output(pkt)
+	}
+	return nil
+}
+
+// deriveLocked 计算共享密钥并派生两个方向的 AEAD
+func (c *Channel) deriveLocked(peerKey []byte) error {
+	peer, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return ErrMalformed
+	}
+	shared, err := c.priv.ECDH(peer)
+	if err != nil {
+		return ErrMalformed
+	}
+	// 盐按 发起方公钥 || 响应方公钥 的固定顺序拼接，双方得到相同的结果
+	own := c.priv.PublicKey().Bytes()
+	salt := append(append([]byte(nil), peerKey...), own...)
+	if c.initiator {
+		salt = append(append([]byte(nil), own...), peerKey...)
+	}
+	keys := hkdf(shared, salt, []byte("icmptun secure v1"), 64)
+	c2s, err := newAEAD(keys[:32])
+	if err != nil {
+		return err
+	}
+	s2c, err := newAEAD(keys[32:])
+	if err != nil {
+		return err
+	}
+	if c.initiator {
+		c.sendAEAD, c.recvAEAD = c2s, s2c
+	} else {
+		c.sendAEAD, c.recvAEAD = s2c, c2s
+	}
+	return nil
+}
+
+// freshLocked 判断计数 ctr 是否没有收到过并且在抗重放窗口之内
+func (c *Channel) freshLocked(ctr uint64) bool {
+	if ctr >= c.recvNext {
+		return true
+	}
+	d := c.recvNext - 1 - ctr
+	return d < replayWindow && c.recvSeen[d/64]&(1<<(d%64)) == 0
+}
+
+// markLocked 记录收到了计数 ctr，更大的计数让窗口向前滑动
+func (c *Channel) markLocked(ctr uint64) {
+	if ctr >= c.recvNext {
+		n := ctr + 1 - c.recvNext
+		switch {
+		case n >= replayWindow:
+			c.recvSeen = [2]uint64{}
+		case n >= 64:
+			c.recvSeen = [2]uint64{0, c.recvSeen[0] << (n - 64)}
+		case n > 0:
+			c.recvSeen = [2]uint64{c.recvSeen[0] << n, c.recvSeen[1]<<n | c.recvSeen[0]>>(64-n)}
+		}
+		c.recvNext = ctr + 1
+	}
+	d := c.recvNext - 1 - ctr
+	c.recvSeen[d/64] |= 1 << (d % 64)
+}
+
+func (c *Channel) sealLocked(frame []byte) []byte {
+	header := make([]byte, dataHeaderLen, dataHeaderLen+len(frame)+16)
+	header[0] = kindData
+	binary.BigEndian.PutUint64(header[1:], c.sendCtr)
+	n := nonce(c.sendCtr)
+	c.sendCtr++
+	// GCM 要求 dst 和附加数据不能重叠
+	ad := append([]byte(nil), header...)
+	return c.sendAEAD.Seal(header, n, frame, ad)
+}
+
+func nonce(ctr uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], ctr)
+	return n
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// hkdf 按 RFC 5869 用 HMAC-SHA256 提取并扩展出 n 字节密钥
+func hkdf(secret, salt, info []byte, n int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var out, prev []byte
+	for i := byte(1); len(out) < n; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(prev)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		prev = expand.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:n]
+}
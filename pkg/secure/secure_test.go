@@ -0,0 +1,117 @@
+package secure
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// newPair 创建一对通过内存直接相连的通道，received 收集双方解密出的帧
+func newPair(t *testing.T) (client, server *Channel, received map[*Channel][][]byte) {
+	received = make(map[*Channel][][]byte)
+	deliver := func(dst **Channel) func([]byte) error {
+		return func(pkt []byte) error {
+			frame, err := (*dst).Open(pkt)
+			if err != nil {
+				t.Errorf("Open failed: %v", err)
+				return nil
+			}
+			if frame != nil {
+				received[*dst] = append(received[*dst], frame)
+			}
+			return nil
+		}
+	}
+	var err error
+	if client, err = NewInitiator(7, deliver(&server)); err != nil {
+		t.Fatalf("NewInitiator failed: %v", err)
+	}
+	if server, err = NewResponder(7, deliver(&client)); err != nil {
+		t.Fatalf("NewResponder failed: %v", err)
+	}
+	return client, server, received
+}
+
+func TestChannelHandshakeAndTransfer(t *testing.T) {
+	client, server, received := newPair(t)
+
+	// 握手完成前的帧被缓存，收到响应方的 HELLO 后才送达
+	if err := client.Seal([]byte("first")); err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	client.Seal([]byte("second"))
+	server.Seal([]byte("reply"))
+
+	want := [][]byte{[]byte("first"), []byte("second")}
+	if got := received[server]; len(got) != 2 || !bytes.Equal(got[0], want[0]) || !bytes.Equal(got[1], want[1]) {
+		t.Errorf("server received %q, want %q", got, want)
+	}
+	if got := received[client]; len(got) != 1 || string(got[0]) != "reply" {
+		t.Errorf("client received %q, want [reply]", got)
+	}
+}
+
+func TestChannelRejectsTampering(t *testing.T) {
+	client, server, _ := newPair(t)
+	client.Seal([]byte("handshake"))
+
+	var pkt []byte
+	client.output = func(b []byte) error { pkt = b; return nil }
+	client.Seal([]byte("secret payload"))
+	if bytes.Contains(pkt, []byte("secret payload")) {
+		t.Fatal("plaintext visible in sealed packet")
+	}
+	pkt[len(pkt)-1] ^= 1
+	if _, err := server.Open(pkt); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("tampered packet: expected ErrDecrypt, got %v", err)
+	}
+
+	fresh, _ := NewResponder(7, func([]byte) error { return nil })
+	pkt[len(pkt)-1] ^= 1
+	if _, err := fresh.Open(pkt); !errors.Is(err, ErrNotEstablished) {
+		t.Errorf("packet before handshake: expected ErrNotEstablished, got %v", err)
+	}
+}
+
+func TestHelloSession(t *testing.T) {
+	var hello []byte
+	c, _ := NewInitiator(0xabcd, func(b []byte) error { hello = b; return nil })
+	c.Seal([]byte("x"))
+	if id, ok := HelloSession(hello); !ok || id != 0xabcd {
+		t.Errorf("HelloSession = %#x, %v; want 0xabcd, true", id, ok)
+	}
+	if _, ok := HelloSession([]byte{kindData, 1, 2, 3}); ok {
+		t.Error("data packet should not be a HELLO")
+	}
+}
+
+// TestChannelRejectsReplay 验证同一个加密报文只能送达一次，乱序到达的报文在窗口内仍被接受，太旧的被拒绝
+func TestChannelRejectsReplay(t *testing.T) {
+	client, server, _ := newPair(t)
+	client.Seal([]byte("handshake"))
+
+	var pkts [][]byte
+	client.output = func(b []byte) error { pkts = append(pkts, b); return nil }
+	for i := 0; i < replayWindow+2; i++ {
+		client.Seal([]byte("request"))
+	}
+
+	last := pkts[len(pkts)-1]
+	if _, err := server.Open(last); err != nil {
+		t.Fatalf("first Open failed: %v", err)
+	}
+	if _, err := server.Open(last); !errors.Is(err, ErrReplay) {
+		t.Errorf("replayed packet: expected ErrReplay, got %v", err)
+	}
+	// 比最新的报文早 replayWindow-1 个的报文仍在窗口内
+	inWindow := pkts[len(pkts)-replayWindow]
+	if _, err := server.Open(inWindow); err != nil {
+		t.Errorf("reordered packet inside the window: %v", err)
+	}
+	if _, err := server.Open(inWindow); !errors.Is(err, ErrReplay) {
+		t.Errorf("replayed reordered packet: expected ErrReplay, got %v", err)
+	}
+	if _, err := server.Open(pkts[0]); !errors.Is(err, ErrReplay) {
+		t.Errorf("packet older than the window: expected ErrReplay, got %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+// Package socks 实现 SOCKS5 (RFC 1928) 的地址编码，以及 UDP 数据报在隧道会话中的封装。
+//
+// UDP ASSOCIATE 会话以 "UDP-ASSOCIATE * HTTP/1.1" 请求开始，服务端回复 200 后，
+// 会话字节流中的每个数据报编码为：
+//
+//	length(2) | SOCKS5 地址 (atyp, addr, port) | 数据
+//
+// length 是地址和数据的总长度。客户端发出的数据报地址是目标，服务端发回的是来源。
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// MethodUDPAssociate 是开始 UDP 中继会话的请求方法
+const MethodUDPAssociate = "UDP-ASSOCIATE"
+
+// 地址类型
+const (
+	AtypIPv4   byte = 1
+	AtypDomain byte = 3
+	AtypIPv6   byte = 4
+)
+
+var (
+	// ErrAddrType 表示不支持的地址类型
+	ErrAddrType = errors.New("socks: 不支持的地址类型")
+	// ErrShort 表示数据不完整
+	ErrShort = errors.New("socks: 数据长度不足")
+)
+
+// Datagram 是一个带有对端地址的 UDP 数据报
+type Datagram struct {
+	Host string
+	Port int
+	Data []byte
+}
+
+// Addr 返回 host:port 形式的地址
+func (d *Datagram) Addr() string { return net.JoinHostPort(d.Host, strconv.Itoa(d.Port)) }
+
+// AppendAddr 把地址按 SOCKS5 格式编码追加到 b
+func AppendAddr(b []byte, host string, port int) ([]byte, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(append(b, AtypIPv4), ip4...)
+		} else {
+			b = append(append(b, AtypIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("socks: 域名长度无效 (%d)", len(host))
+		}
+		b = append(append(b, AtypDomain, byte(len(host))), host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// ReadAddr 从 r 读取一个 SOCKS5 地址
+func ReadAddr(r io.Reader) (host string, port int, err error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", 0, err
+	}
+	var addr []byte
+	switch atyp[0] {
+	case AtypIPv4:
+		addr = make([]byte, net.IPv4len)
+	case AtypIPv6:
+		addr = make([]byte, net.IPv6len)
+	case AtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", 0, err
+		}
+		addr = make([]byte, n[0])
+	default:
+		return "", 0, ErrAddrType
+	}
+	var p [2]byte
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", 0, err
+	}
+	if _, err := io.ReadFull(r, p[:]); err != nil {
+		return "", 0, err
+	}
+	if atyp[0] == AtypDomain {
+		host = string(addr)
+	} else {
+		host = net.IP(addr).String()
+	}
+	return host, int(binary.BigEndian.Uint16(p[:])), nil
+}
+
+// parseAddr 从 b 的开头解析一个 SOCKS5 地址，返回占用的字节数
+func parseAddr(b []byte) (host string, port int, n int, err error) {
+	r := &countingReader{b: b}
+	host, port, err = ReadAddr(r)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		err = ErrShort
+	}
+	return host, port, r.n, err
+}
+
+type countingReader struct {
+	b []byte
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.n >= len(r.b) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b[r.n:])
+	r.n += n
+	return n, nil
+}
+
+// WriteDatagram 把数据报编码后一次写入会话
+func WriteDatagram(w io.Writer, d *Datagram) error {
+	b, err := AppendAddr(make([]byte, 2, 2+len(d.Data)+32), d.Host, d.Port)
+	if err != nil {
+		return err
+	}
+	b = append(b, d.Data...)
+	if len(b)-2 > 0xffff {
+		return fmt.Errorf("socks: 数据报过长 (%d)", len(d.Data))
+	}
+	binary.BigEndian.PutUint16(b[:2], uint16(len(b)-2))
+	_, err = w.Write(b)
+	return err
+}
+
+// ReadDatagram 从会话中读取一个数据报
+func ReadDatagram(r io.Reader) (*Datagram, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	host, port, n, err := parseAddr(b)
+	if err != nil {
+		return nil, err
+	}
+	return &Datagram{Host: host, Port: port, Data: b[n:]}, nil
+}
+
+// ParseUDPHeader 解析 SOCKS5 客户端发来的 UDP 报文：RSV(2) | FRAG(1) | 地址 | 数据。
+// 不支持分片，FRAG 不为 0 的报文返回错误。
+func ParseUDPHeader(b []byte) (*Datagram, error) {
+	if len(b) < 3 {
+		return nil, ErrShort
+	}
+	if b[2] != 0 {
+		return nil, errors.New("socks: 不支持 UDP 分片")
+	}
+	host, port, n, err := parseAddr(b[3:])
+	if err != nil {
+		return nil, err
+	}
+	return &Datagram{Host: host, Port: port, Data: b[3+n:]}, nil
+}
+
+// AppendUDPHeader 按 SOCKS5 UDP 报文格式编码数据报，发给 SOCKS5 客户端
+func AppendUDPHeader(b []byte, d *Datagram) ([]byte, error) {
+	b, err := AppendAddr(append(b, 0, 0, 0), d.Host, d.Port)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, d.Data...), nil
+}
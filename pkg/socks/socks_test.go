@@ -0,0 +1,56 @@
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDatagramRoundTrip(t *testing.T) {
+	datagrams := []*Datagram{
+		{Host: "192.0.2.1", Port: 53, Data: []byte("query")},
+		{Host: "2001:db8::1", Port: 443, Data: []byte{}},
+		{Host: "example.com", Port: 65535, Data: bytes.Repeat([]byte("x"), 2000)},
+	}
+	var stream bytes.Buffer
+	for _, d := range datagrams {
+		if err := WriteDatagram(&stream, d); err != nil {
+			t.Fatalf("WriteDatagram(%s) failed: %v", d.Addr(), err)
+		}
+	}
+	for _, want := range datagrams {
+		got, err := ReadDatagram(&stream)
+		if err != nil {
+			t.Fatalf("ReadDatagram failed: %v", err)
+		}
+		if got.Host != want.Host || got.Port != want.Port || !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("got %s %q, want %s %q", got.Addr(), got.Data, want.Addr(), want.Data)
+		}
+	}
+}
+
+func TestUDPHeader(t *testing.T) {
+	in := &Datagram{Host: "10.1.2.3", Port: 5353, Data: []byte("payload")}
+	b, err := AppendUDPHeader(nil, in)
+	if err != nil {
+		t.Fatalf("AppendUDPHeader failed: %v", err)
+	}
+	out, err := ParseUDPHeader(b)
+	if err != nil {
+		t.Fatalf("ParseUDPHeader failed: %v", err)
+	}
+	if out.Addr() != in.Addr() || string(out.Data) != "payload" {
+		t.Errorf("got %s %q, want %s %q", out.Addr(), out.Data, in.Addr(), in.Data)
+	}
+
+	b[2] = 1
+	if _, err := ParseUDPHeader(b); err == nil {
+		t.Error("expected fragmented datagram to be rejected")
+	}
+	if _, err := ParseUDPHeader([]byte{0, 0, 0, AtypIPv4, 1, 2}); !errors.Is(err, ErrShort) {
+		t.Errorf("truncated header: expected ErrShort, got %v", err)
+	}
+	if _, err := ParseUDPHeader([]byte{0, 0, 0, 9, 1, 2}); !errors.Is(err, ErrAddrType) {
+		t.Errorf("bad address type: expected ErrAddrType, got %v", err)
+	}
+}
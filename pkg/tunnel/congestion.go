@@ -0,0 +1,131 @@
+package tunnel
+
+import "sync"
+
+// 拥塞控制采用 TCP 的 AIMD（RFC 5681）：拥塞窗口 cwnd 以分段计，限制在途分段数。
+// 会话从 initialCwnd 开始慢启动，每确认一个分段窗口加一；超过 ssthresh 后进入拥塞避免，
+// 每确认一整个窗口才加一。快速重传时窗口减半，超时重传时窗口退回 1。
+// 同一窗口内的多次丢包只算一次拥塞：每个新分段按发出的顺序编号，
+// 发生拥塞之前发出的分段再丢失不会继续减小窗口。
+//
+// ICMP 路径上的丢包大多来自路由器对 ICMP 的限速，连续的突发会被成片丢弃，
+// 窗口让发送方先小批量试探，再按确认的速度增长。
+//
+// 同一路径上的多个会话（例如 Mux 中的流）可以通过 Config.Congestion 共享一个控制器，
+// 它们在途的分段合计受同一个窗口限制，任一会话的丢包都会让所有会话减速。
+
+const (
+	// initialCwnd 是会话开始时的拥塞窗口
+	initialCwnd = 4
+	// minSsthresh 是拥塞后慢启动阈值的下限
+	minSsthresh = 2
+)
+
+// Congestion 是拥塞控制的状态，可以由多个会话共享
+type Congestion struct {
+	mu       sync.Mutex
+	limit    int    // 窗口的上限
+	cwnd     int    // 拥塞窗口，分段数
+	ssthresh int    // 慢启动阈值
+	acked    int    // 拥塞避免阶段累计确认的分段数，满一个窗口后 cwnd 加一
+	inflight int    // 所有会话在途的分段数
+	sent     uint64 // 已经发出的新分段数，用作分段的编号
+	recover  uint64 // 最近一次拥塞时的 sent，编号不大于它的分段丢失不再减小窗口
+	waiting  map[*Conn]struct{}
+}
+
+// NewCongestion 创建拥塞控制器，limit 是窗口的上限，通常等于 Config.SendWindow
+func NewCongestion(limit int) *Congestion {
+	return &Congestion{limit: limit, cwnd: min(initialCwnd, limit), ssthresh: limit}
+}
+
+// acquire 在窗口允许时占用一个在途名额并返回新分段的编号，否则登记 c，窗口打开时由 wake 唤醒
+func (cc *Congestion) acquire(c *Conn) (uint64, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.inflight >= cc.cwnd {
+		if cc.waiting == nil {
+			cc.waiting = make(map[*Conn]struct{})
+		}
+		cc.waiting[c] = struct{}{}
+		return 0, false
+	}
+	return cc.addLocked(1), true
+}
+
+// add 不检查窗口占用一个在途名额，用于必须发出的 FIN 和错误帧
+func (cc *Congestion) add() uint64 {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.addLocked(1)
+}
+
+func (cc *Congestion) addLocked(n int) uint64 {
+	cc.inflight += n
+	cc.sent++
+	return cc.sent
+}
+
+// hold 增减在途的分段数而不编号，用于切开或丢弃在途的分段
+func (cc *Congestion) hold(n int) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.inflight += n
+}
+
+// onAcked 在累积确认推进了 n 个分段后归还名额并增大拥塞窗口
+func (cc *Congestion) onAcked(n int) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.inflight -= n
+	if cc.cwnd < cc.ssthresh {
+		cc.cwnd += n
+	} else {
+		cc.acked += n
+		for cc.acked >= cc.cwnd {
+			cc.acked -= cc.cwnd
+			cc.cwnd++
+		}
+	}
+	// 超过上限的部分不起作用，也不应在之后拥塞时被当作已经探明的容量
+	cc.cwnd = min(cc.cwnd, cc.limit)
+}
+
+// onLoss 在重传编号为 epoch 的分段时减小拥塞窗口，timeout 表示是超时重传
+func (cc *Congestion) onLoss(epoch uint64, timeout bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if epoch <= cc.recover {
+		// 这一窗口已经减小过，超时仍然说明确认全部中断了
+		if timeout {
+			cc.cwnd = 1
+		}
+		return
+	}
+	cc.recover = cc.sent
+	cc.ssthresh = max(cc.inflight/2, minSsthresh)
+	cc.cwnd = cc.ssthresh
+	if timeout {
+		cc.cwnd = 1
+	}
+	cc.acked = 0
+}
+
+// wake 唤醒等待窗口的会话。调用方不能持有任何会话的锁
+func (cc *Congestion) wake() {
+	cc.mu.Lock()
+	if len(cc.waiting) == 0 || cc.inflight >= cc.cwnd {
+		cc.mu.Unlock()
+		return
+	}
+	waiting := cc.waiting
+	cc.waiting = nil
+	cc.mu.Unlock()
+
+	// 等待方登记后才释放自己的锁进入等待，拿到它的锁再通知就不会错过
+	for c := range waiting {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	}
+}
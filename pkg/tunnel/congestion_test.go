@@ -0,0 +1,150 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCongestionWindow 验证发送方只发出拥塞窗口允许的分段，确认到达后窗口增大，超时后退回 1
+func TestCongestionWindow(t *testing.T) {
+	var deliver atomic.Bool
+	var a, b *Conn
+	link := func(dst **Conn) func([]byte) error {
+		return func(pkt []byte) error {
+			if deliver.Load() {
+				go (*dst).Input(pkt)
+			}
+			return nil
+		}
+	}
+	a = NewConn(testConfig(), 1, link(&b))
+	b = NewConn(testConfig(), 1, link(&a))
+	defer a.Close()
+	defer b.Close()
+
+	data := bytes.Repeat([]byte("congestion "), 20000)
+	go a.Write(data)
+	time.Sleep(20 * time.Millisecond)
+	a.mu.Lock()
+	if n := len(a.inflight); n != initialCwnd {
+		t.Errorf("%d segments in flight before any ACK, want the initial window %d", n, initialCwnd)
+	}
+	a.mu.Unlock()
+
+	// 链路一直不通，超时重传后窗口退回 1，慢启动阈值减半
+	time.Sleep(100 * time.Millisecond)
+	a.mu.Lock()
+	if a.cc.cwnd != 1 || a.cc.ssthresh != minSsthresh {
+		t.Errorf("after a timeout cwnd = %d, ssthresh = %d; want 1 and %d", a.cc.cwnd, a.cc.ssthresh, minSsthresh)
+	}
+	a.mu.Unlock()
+
+	deliver.Store(true)
+	transferred := make([]byte, len(data))
+	if _, err := io.ReadFull(b, transferred); err != nil {
+		t.Fatalf("reading failed: %v", err)
+	}
+	if !bytes.Equal(transferred, data) {
+		t.Fatal("data corrupted")
+	}
+	a.mu.Lock()
+	if a.cc.cwnd <= minSsthresh {
+		t.Errorf("cwnd stayed at %d after a clean transfer", a.cc.cwnd)
+	}
+	a.mu.Unlock()
+}
+
+// TestCongestionOneReductionPerWindow 验证同一窗口内的多次丢包只减小一次窗口
+func TestCongestionOneReductionPerWindow(t *testing.T) {
+	cc := NewCongestion(64)
+	cc.cwnd = 32
+	for i := 0; i < 32; i++ {
+		cc.add()
+	}
+
+	cc.onLoss(1, false)
+	if cc.cwnd != 16 || cc.ssthresh != 16 {
+		t.Fatalf("after fast retransmit cwnd = %d, ssthresh = %d; want 16 and 16", cc.cwnd, cc.ssthresh)
+	}
+	cc.onLoss(6, false)
+	if cc.cwnd != 16 {
+		t.Errorf("second loss in the same window reduced cwnd to %d", cc.cwnd)
+	}
+	epoch := cc.add()
+	cc.hold(-1)
+	cc.onLoss(epoch, false)
+	if cc.cwnd != 16 {
+		t.Errorf("loss after the window: cwnd = %d, want half of the 32 in flight", cc.cwnd)
+	}
+
+	// 拥塞避免阶段每确认一整个窗口才加一
+	cc.onAcked(15)
+	if cc.cwnd != 16 {
+		t.Errorf("cwnd grew to %d before a full window was acknowledged", cc.cwnd)
+	}
+	cc.onAcked(1)
+	if cc.cwnd != 17 {
+		t.Errorf("cwnd = %d after a full window, want 17", cc.cwnd)
+	}
+}
+
+// TestCongestionShared 验证共享控制器的会话合计在途的分段不超过一个窗口，
+// 一个会话的确认释放的窗口可以被另一个会话使用
+func TestCongestionShared(t *testing.T) {
+	var deliver atomic.Bool
+	cfg := testConfig()
+	cfg.Congestion = NewCongestion(cfg.SendWindow)
+	conns := make(map[uint32]*Conn)
+	var mu sync.Mutex
+	link := func(peer uint32) func([]byte) error {
+		return func(pkt []byte) error {
+			if deliver.Load() {
+				mu.Lock()
+				dst := conns[peer]
+				mu.Unlock()
+				go dst.Input(pkt)
+			}
+			return nil
+		}
+	}
+	peerCfg := testConfig()
+	for id := uint32(1); id <= 2; id++ {
+		mu.Lock()
+		conns[id] = NewConn(cfg, id, link(id+100))
+		conns[id+100] = NewConn(peerCfg, id, link(id))
+		mu.Unlock()
+	}
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	data := bytes.Repeat([]byte("shared "), 20000)
+	for id := uint32(1); id <= 2; id++ {
+		go conns[id].Write(data)
+	}
+	time.Sleep(30 * time.Millisecond)
+	inflight := 0
+	for id := uint32(1); id <= 2; id++ {
+		c := conns[id]
+		c.mu.Lock()
+		inflight += len(c.inflight)
+		c.mu.Unlock()
+	}
+	if inflight != initialCwnd {
+		t.Errorf("%d segments in flight across both sessions, want the shared initial window %d", inflight, initialCwnd)
+	}
+
+	deliver.Store(true)
+	for id := uint32(1); id <= 2; id++ {
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(conns[id+100], got); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("session %d: transfer failed: %v", id, err)
+		}
+	}
+}
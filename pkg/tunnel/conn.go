@@ -0,0 +1,719 @@
+package tunnel
+
+import (
+	"errors"
+	"icmptun/pkg/protocol"
+	"icmptun/pkg/secure"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Config 控制可靠流的分段大小、重传和超时参数
+type Config struct {
+	// MSS 是单个分段携带的最大数据字节数，开启路径 MTU 探测时是会话开始时的值
+	MSS int
+	// MaxMSS 是路径 MTU 探测的上限，不大于 MSS 时不探测，MSS 保持不变
+	MaxMSS int
+	// SendWindow 是允许同时在途（已发送但未确认）的最大分段数，实际在途数还受拥塞窗口限制
+	SendWindow int
+	// ReceiveWindow 是接收缓存的最大字节数，读方消费得慢时对端会被限速
+	ReceiveWindow int
+	// InitialRTO 是还没有 RTT 样本时使用的重传超时
+	InitialRTO time.Duration
+	// MinRTO 和 MaxRTO 限定根据 RTT 计算出的重传超时范围
+	MinRTO time.Duration
+	MaxRTO time.Duration
+	// MaxRetries 是单个分段的最大重传次数，超过后会话失败
+	MaxRetries int
+	// IdleTimeout 是没有收到任何分段时会话保持的最长时间
+	IdleTimeout time.Duration
+	// FECData 和 FECParity 开启前向纠错：每 FECData 个数据分段发出 FECParity 个校验帧，
+	// 见 fec.go。任一为 0 时不发送校验帧，收到的校验帧总是会被使用
+	FECData   int
+	FECParity int
+	// Limiter 限制发出数据分段的速率，通常由同一端点的所有会话共享，nil 表示不限速
+	Limiter *Limiter
+	// Congestion 是拥塞控制器，共享它的会话合计在途的分段受同一个拥塞窗口限制，
+	// 见 congestion.go。nil 表示会话单独使用一个
+	Congestion *Congestion
+	// PathMTU 是路径 MTU 探测的状态，共享它的会话只进行一次查找并使用同一个 MSS，
+	// 见 pmtu.go。nil 表示会话单独使用一个
+	PathMTU *PathMTU
+}
+
+// PacketOverhead 是每个 ICMP 报文中除流数据以外最多占用的字节数：会话 ID、帧头、加密和认证标签
+const PacketOverhead = protocol.SessionHeaderLen + protocol.MaxFrameHeaderLen + secure.Overhead + protocol.TagLen
+
+// DefaultConfig 返回适合一般网络环境的默认参数
+func DefaultConfig() Config {
+	return Config{
+		MSS:           protocol.MaxChunkSize - PacketOverhead,
+		SendWindow:    64,
+		ReceiveWindow: 256 * 1024,
+		InitialRTO:    500 * time.Millisecond,
+		MinRTO:        100 * time.Millisecond,
+		MaxRTO:        5 * time.Second,
+		MaxRetries:    10,
+		IdleTimeout:   5 * time.Minute,
+	}
+}
+
+// TimeWait 是会话结束后仍应保留在会话表中的时间，
+// 这段时间内对端迟到的重传分段仍会得到确认，而不会被当作新会话。
+const TimeWait = 10 * time.Second
+
+// tickInterval 是检查重传和空闲超时的周期
+const tickInterval = 20 * time.Millisecond
+
+var (
+	// ErrTimeout 表示对端长时间没有响应，会话已放弃
+	ErrTimeout = errors.New("tunnel: 对端无响应，会话超时")
+	// ErrClosed 表示在已关闭的会话上读写
+	ErrClosed = errors.New("tunnel: 会话已关闭")
+	// ErrReset 表示对端用 RST 帧中止了会话
+	ErrReset = errors.New("tunnel: 会话被对端重置")
+
+	errSessionMismatch = errors.New("tunnel: 帧不属于本会话")
+)
+
+// outSegment 是一个已发送但尚未被累积确认的 DATA、FIN 或 ERROR 帧
+type outSegment struct {
+	typ     protocol.FrameType
+	seq     uint32
+	data    []byte
+	sentAt  time.Time
+	retries int
+	sacked  bool
+	epoch   uint64 // 拥塞控制给新分段的编号
+}
+
+func (o *outSegment) end() uint32 {
+	n := o.seq + uint32(len(o.data))
+	if o.typ != protocol.FrameData {
+		n++
+	}
+	return n
+}
+
+// Conn 是建立在 ICMP Echo 之上的可靠有序字节流。
+// 它按字节偏移编号数据，通过累积确认和 SACK 得知对端收到的数据，
+// 超时或收到三个重复确认（开启 FEC 时更多，见 fec.go）时重传，并丢弃重复到达的分段。
+// 每个帧都通告接收窗口，发送方不会发出超过对端窗口的数据。
+// Conn 本身不接触网络：编码好的帧交给 output 发送，收到的帧由调用方传给 Input。
+type Conn struct {
+	cfg     Config
+	session uint32
+	output  func([]byte) error
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// 发送方向
+	sndNxt   uint32
+	sndEdge  uint32 // 对端窗口允许发送到的位置
+	inflight []*outSegment
+	finSent  bool
+	dupAcks  int
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	cc       *Congestion // 拥塞控制，见 congestion.go
+
+	// 路径 MTU 探测，见 pmtu.go
+	path  *PathMTU
+	mss   int  // 在途分段按这个大小切分，路径的 MSS 变小时据此重新切分
+	heard bool // 已经收到过对端的帧，之后才开始探测
+
+	// 前向纠错，见 fec.go
+	fecOut fecSender
+	fecIn  fecReceiver
+
+	// 接收方向
+	rcvNxt     uint32
+	advWnd     uint32 // 最近一次通告给对端的窗口
+	ooo        map[uint32]*protocol.Frame
+	readBuf    []byte
+	finRecv    bool
+	remoteErr  *RemoteError // 对端通过错误帧结束了流
+	readClosed bool
+	lastRecv   time.Time
+	pingAt     time.Time // 最近一次发出保活 PING 的时间
+
+	err      error
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// NewConn 创建一个会话，session 写入每个帧的会话 ID，
+// output 负责把编码好的帧封装进 ICMP 报文发出
+func NewConn(cfg Config, session uint32, output func([]byte) error) *Conn {
+	cc := cfg.Congestion
+	if cc == nil {
+		cc = NewCongestion(cfg.SendWindow)
+	}
+	path := cfg.PathMTU
+	if path == nil {
+		path = NewPathMTU(cfg.MSS, cfg.MaxMSS)
+	}
+	c := &Conn{
+		cfg:      cfg,
+		session:  session,
+		output:   output,
+		rto:      cfg.InitialRTO,
+		path:     path,
+		mss:      path.MSS(),
+		cc:       cc,
+		sndEdge:  uint32(cfg.ReceiveWindow),
+		ooo:      make(map[uint32]*protocol.Frame),
+		lastRecv: time.Now(),
+		done:     make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.timerLoop()
+	return c
+}
+
+// Done 在会话两个方向都已结束或会话失败后关闭
+func (c *Conn) Done() <-chan struct{} { return c.done }
+
+// ID 返回帧头中的会话 ID，在 Mux 中就是流 ID
+func (c *Conn) ID() uint32 { return c.session }
+
+// Read 按序读取对端发送的数据，对端关闭写方向后返回 io.EOF，
+// 对端以错误帧结束时返回 *RemoteError。
+// 读出数据使窗口明显增大时会主动通告对端，让被限速的发送方继续发送。
+func (c *Conn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	for len(c.readBuf) == 0 && !c.finRecv && !c.readClosed && c.err == nil {
+		c.cond.Wait()
+	}
+	if len(c.readBuf) > 0 {
+		n := copy(p, c.readBuf)
+		c.readBuf = c.readBuf[n:]
+		var update []byte
+		if int(c.recvWindowLocked())-int(c.advWnd) >= c.cfg.ReceiveWindow/4 {
+			update = c.ackPacketLocked()
+		}
+		c.mu.Unlock()
+		if update != nil {
+			c.send(update)
+		}
+		return n, nil
+	}
+	defer c.mu.Unlock()
+	switch {
+	case c.readClosed:
+		return 0, ErrClosed
+	case c.remoteErr != nil:
+		return 0, c.remoteErr
+	case c.finRecv:
+		return 0, io.EOF
+	default:
+		return 0, c.err
+	}
+}
+
+// Write 把数据按 MSS 切分成分段发送。在途分段达到发送窗口或拥塞窗口、对端接收窗口已满，
+// 或者 Config.Limiter 没有令牌时阻塞；对端窗口为零时每次只发送一个字节作为探测，由重传机制周期性地重发。
+// 窗口允许发送之后才向 Limiter 取令牌，等待窗口的写方不会预订令牌，让重传和校验帧拿不到。
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		c.mu.Lock()
+		var epoch uint64
+		ok := false
+		for c.err == nil && !c.finSent {
+			if epoch, ok = c.canSendLocked(); ok {
+				break
+			}
+			c.cond.Wait()
+		}
+		if !ok {
+			err := c.err
+			if err == nil {
+				err = ErrClosed
+			}
+			c.mu.Unlock()
+			return written, err
+		}
+		c.mu.Unlock()
+
+		c.cfg.Limiter.Wait(c.done)
+		c.mu.Lock()
+		if c.err != nil || c.finSent {
+			// 等待令牌期间会话结束或写方向关闭，归还占用的拥塞窗口名额
+			err := c.err
+			if err == nil {
+				err = ErrClosed
+			}
+			c.mu.Unlock()
+			c.cc.hold(-1)
+			c.cc.wake()
+			return written, err
+		}
+		n := min(len(p), c.syncMSSLocked())
+		if avail := int32(c.sndEdge - c.sndNxt); avail <= 0 {
+			n = 1
+		} else if int(avail) < n {
+			n = int(avail)
+		}
+		o := &outSegment{typ: protocol.FrameData, seq: c.sndNxt, data: append([]byte(nil), p[:n]...), epoch: epoch}
+		c.sndNxt += uint32(n)
+		c.inflight = append(c.inflight, o)
+		pkt := c.packetLocked(o)
+		parity := c.fecAddLocked(o, o.sentAt)
+		c.mu.Unlock()
+
+		c.send(pkt)
+		for _, pkt := range parity {
+			c.send(pkt)
+		}
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// canSendLocked 判断发送窗口、对端接收窗口和拥塞窗口是否允许再发出一个分段，
+// 允许时占用拥塞窗口中的一个名额并返回分段的编号
+func (c *Conn) canSendLocked() (uint64, bool) {
+	if len(c.inflight) >= c.cfg.SendWindow {
+		return 0, false
+	}
+	// 零窗口时只允许一个探测分段在途
+	if !seqLess(c.sndNxt, c.sndEdge) && len(c.inflight) > 0 {
+		return 0, false
+	}
+	return c.cc.acquire(c)
+}
+
+// CloseWrite 发送 FIN，告诉对端不会再有数据，读方向不受影响
+func (c *Conn) CloseWrite() error {
+	c.mu.Lock()
+	if c.finSent || c.err != nil {
+		c.mu.Unlock()
+		return nil
+	}
+	c.finSent = true
+	o := &outSegment{typ: protocol.FrameFIN, seq: c.sndNxt, epoch: c.cc.add()}
+	c.sndNxt++
+	c.inflight = append(c.inflight, o)
+	pkt := c.packetLocked(o)
+	c.mu.Unlock()
+
+	c.send(pkt)
+	return nil
+}
+
+// CloseWithError 用错误帧代替 FIN 结束写方向，对端读完之前的数据后会收到 *RemoteError。
+// 错误帧和 FIN 一样可靠送达。
+func (c *Conn) CloseWithError(code ErrorCode, message string) error {
+	c.mu.Lock()
+	if c.finSent || c.err != nil {
+		c.mu.Unlock()
+		return nil
+	}
+	c.finSent = true
+	payload := (&RemoteError{Code: code, Message: message}).marshal(c.syncMSSLocked())
+	o := &outSegment{typ: protocol.FrameError, seq: c.sndNxt, data: payload, epoch: c.cc.add()}
+	c.sndNxt += uint32(len(payload)) + 1
+	c.inflight = append(c.inflight, o)
+	pkt := c.packetLocked(o)
+	c.mu.Unlock()
+
+	c.send(pkt)
+	return nil
+}
+
+// Abort 发送 RST 立即中止会话，未送达的数据全部丢弃
+func (c *Conn) Abort() {
+	c.mu.Lock()
+	pkt := c.marshalLocked(&protocol.Frame{Type: protocol.FrameRST})
+	c.failLocked(ErrClosed)
+	c.mu.Unlock()
+	c.cc.wake()
+	c.send(pkt)
+}
+
+// Fail 以 err 立即结束会话，不通知对端，读写都返回 err。
+// 用于已经确认对端不可达的情况，例如收到了路径上的 ICMP 差错报文。
+func (c *Conn) Fail(err error) {
+	c.mu.Lock()
+	c.failLocked(err)
+	c.mu.Unlock()
+	c.cc.wake()
+}
+
+// Ping 立即发送一个 PING 帧，对端收到后立即回复 ACK。
+// 空闲的会话会自己定期发送 PING 保活，见 onTick，不需要调用方定期调用。
+func (c *Conn) Ping() error {
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return err
+	}
+	pkt := c.pingPacketLocked(time.Now())
+	c.mu.Unlock()
+
+	c.send(pkt)
+	return nil
+}
+
+// Close 关闭写方向并丢弃之后收到的数据。已发送的数据仍会可靠送达。
+func (c *Conn) Close() error {
+	c.CloseWrite()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readClosed = true
+	c.readBuf = nil
+	c.cond.Broadcast()
+	return nil
+}
+
+// Input 处理一个从对端收到的原始帧
+func (c *Conn) Input(b []byte) error {
+	f, err := protocol.ParseFrame(b)
+	if err != nil {
+		return err
+	}
+	return c.input(f)
+}
+
+func (c *Conn) input(f *protocol.Frame) error {
+	if f.Session != c.session {
+		return errSessionMismatch
+	}
+
+	var out [][]byte
+	c.mu.Lock()
+	c.lastRecv = time.Now()
+	c.heard = true
+	switch f.Type {
+	case protocol.FrameRST:
+		c.failLocked(ErrReset)
+	case protocol.FrameProbe:
+		c.handleAckLocked(f)
+		out = append(out, c.handleProbeLocked(f))
+	case protocol.FrameProbeAck:
+		c.handleAckLocked(f)
+		if pkt := c.handleProbeAckLocked(f, c.lastRecv); pkt != nil {
+			out = append(out, pkt)
+		}
+	case protocol.FrameAck:
+		if pkt := c.handleAckLocked(f); pkt != nil {
+			out = append(out, pkt)
+		}
+	case protocol.FramePing:
+		c.handleAckLocked(f)
+		out = append(out, c.ackPacketLocked())
+	case protocol.FrameFEC:
+		c.handleAckLocked(f)
+		// 还原出的分段和收到的数据帧一样立即确认
+		if c.handleFECLocked(f) {
+			out = append(out, c.ackPacketLocked())
+		}
+	default:
+		if pkt := c.handleAckLocked(f); pkt != nil {
+			out = append(out, pkt)
+		}
+		c.handleDataLocked(f)
+		c.fecRecordLocked(f)
+		// 每个数据帧都立即确认，重复帧的确认用于弥补丢失的 ACK
+		out = append(out, c.ackPacketLocked())
+	}
+	c.checkDoneLocked()
+	c.mu.Unlock()
+	c.cc.wake()
+
+	for _, pkt := range out {
+		c.send(pkt)
+	}
+	return nil
+}
+
+// handleAckLocked 处理帧中的累积确认、窗口和 SACK，需要快速重传时返回待发送的帧
+func (c *Conn) handleAckLocked(f *protocol.Frame) []byte {
+	ack := f.Ack
+	if seqLess(c.sndNxt, ack) {
+		// 确认了从未发送的数据，忽略
+		return nil
+	}
+
+	var sample time.Duration
+	acked := 0
+	for len(c.inflight) > 0 && seqLessEq(c.inflight[0].end(), ack) {
+		o := c.inflight[0]
+		// 只对未重传过的分段采样 RTT（Karn 算法）
+		if o.retries == 0 {
+			sample = time.Since(o.sentAt)
+		}
+		c.inflight = c.inflight[1:]
+		acked++
+	}
+	grew := false
+	if edge := ack + f.Window; seqLess(c.sndEdge, edge) {
+		c.sndEdge = edge
+		grew = true
+		c.cond.Broadcast()
+	}
+	// 对端在回应却仍然关闭窗口，说明在途的只是零窗口探测，不计入重传失败
+	if len(c.inflight) > 0 && !seqLess(c.inflight[0].seq, c.sndEdge) {
+		c.inflight[0].retries = 0
+	}
+	for _, blk := range f.SACK {
+		for _, o := range c.inflight {
+			if seqLessEq(blk.Start, o.seq) && seqLessEq(o.end(), blk.End) {
+				o.sacked = true
+			}
+		}
+	}
+
+	if acked > 0 {
+		if sample > 0 {
+			c.updateRTTLocked(sample)
+		}
+		c.cc.onAcked(acked)
+		c.dupAcks = 0
+		c.cond.Broadcast()
+		return nil
+	}
+	// 窗口更新不算重复确认
+	if f.Type == protocol.FrameAck && !grew && len(c.inflight) > 0 && ack == c.inflight[0].seq {
+		c.dupAcks++
+		if c.dupAcks == c.dupAckThreshold() {
+			o := c.inflight[0]
+			c.cc.onLoss(o.epoch, false)
+			o.retries++
+			return c.packetLocked(o)
+		}
+	}
+	return nil
+}
+
+// handleDataLocked 把 DATA、FIN 或 ERROR 帧放入接收缓存，按序部分立即交付给读方
+func (c *Conn) handleDataLocked(f *protocol.Frame) {
+	if seqLessEq(frameEnd(f), c.rcvNxt) {
+		return // 重复帧
+	}
+	// 错误帧不占用接收缓存，不受窗口限制
+	if f.Type == protocol.FrameData && !seqLess(f.Offset, c.rcvNxt+c.recvWindowLocked()) {
+		return // 超出接收窗口，确认中会带上当前窗口
+	}
+	if _, dup := c.ooo[f.Offset]; !dup {
+		c.ooo[f.Offset] = f
+	}
+	for {
+		var next *protocol.Frame
+		for seq, s := range c.ooo {
+			if seqLessEq(frameEnd(s), c.rcvNxt) {
+				delete(c.ooo, seq)
+				continue
+			}
+			if seqLessEq(s.Offset, c.rcvNxt) {
+				next = s
+				delete(c.ooo, seq)
+				break
+			}
+		}
+		if next == nil {
+			return
+		}
+		c.deliverLocked(next)
+	}
+}
+
+// deliverLocked 交付一个覆盖 rcvNxt 的帧，跳过已经交付过的前缀
+func (c *Conn) deliverLocked(f *protocol.Frame) {
+	payload := f.Payload[c.rcvNxt-f.Offset:]
+	if f.Type == protocol.FrameError {
+		c.remoteErr = parseRemoteError(payload)
+		c.rcvNxt += uint32(len(payload)) + 1
+		c.finRecv = true
+		c.cond.Broadcast()
+		return
+	}
+	if !c.readClosed && !c.finRecv {
+		c.readBuf = append(c.readBuf, payload...)
+	}
+	c.rcvNxt += uint32(len(payload))
+	if f.Type == protocol.FrameFIN {
+		c.finRecv = true
+		c.rcvNxt++
+	}
+	c.cond.Broadcast()
+}
+
+// recvWindowLocked 返回接收缓存还能容纳的字节数，读方向关闭后数据直接丢弃，窗口总是全开
+func (c *Conn) recvWindowLocked() uint32 {
+	if c.readClosed {
+		return uint32(c.cfg.ReceiveWindow)
+	}
+	return uint32(max(c.cfg.ReceiveWindow-len(c.readBuf), 0))
+}
+
+// sackBlocksLocked 把乱序缓存合并成区间，返回最靠前的几个 SACK 块
+func (c *Conn) sackBlocksLocked() []protocol.SACKBlock {
+	if len(c.ooo) == 0 {
+		return nil
+	}
+	blocks := make([]protocol.SACKBlock, 0, len(c.ooo))
+	for _, f := range c.ooo {
+		blocks = append(blocks, protocol.SACKBlock{Start: f.Offset, End: frameEnd(f)})
+	}
+	sort.Slice(blocks, func(i, j int) bool { return seqLess(blocks[i].Start, blocks[j].Start) })
+	merged := blocks[:1]
+	for _, b := range blocks[1:] {
+		last := &merged[len(merged)-1]
+		if seqLessEq(b.Start, last.End) {
+			if seqLess(last.End, b.End) {
+				last.End = b.End
+			}
+			continue
+		}
+		merged = append(merged, b)
+	}
+	if len(merged) > protocol.MaxSACKBlocks {
+		merged = merged[:protocol.MaxSACKBlocks]
+	}
+	return merged
+}
+
+// packetLocked 编码一个 DATA、FIN 或 ERROR 帧并记录发送时间，确认号总是使用最新值
+func (c *Conn) packetLocked(o *outSegment) []byte {
+	o.sentAt = time.Now()
+	return c.marshalLocked(&protocol.Frame{Type: o.typ, Offset: o.seq, Payload: o.data})
+}
+
+func (c *Conn) ackPacketLocked() []byte {
+	return c.marshalLocked(&protocol.Frame{Type: protocol.FrameAck, Offset: c.sndNxt})
+}
+
+// marshalLocked 填入会话 ID、确认号、窗口和 SACK 后编码帧
+func (c *Conn) marshalLocked(f *protocol.Frame) []byte {
+	c.advWnd = c.recvWindowLocked()
+	f.Session = c.session
+	f.Ack = c.rcvNxt
+	f.Window = c.advWnd
+	f.SACK = c.sackBlocksLocked()
+	b, _ := f.Marshal() // 负载不超过 MSS，SACK 块已截断，编码不会失败
+	return b
+}
+
+// updateRTTLocked 按 RFC 6298 更新平滑 RTT 和重传超时
+func (c *Conn) updateRTTLocked(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		delta := c.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = c.srtt + max(tickInterval, 4*c.rttvar)
+	c.rto = min(max(c.rto, c.cfg.MinRTO), c.cfg.MaxRTO)
+}
+
+func (c *Conn) timerLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			c.onTick(now)
+		}
+	}
+}
+
+// onTick 重传超时的分段，并在重传次数耗尽或长时间空闲时让会话失败。
+// Config.Limiter 没有令牌时剩下的分段留到之后的周期重传。
+// 超过 IdleTimeout 的三分之一没有收到帧时发送 PING，对端回复的 ACK 让没有数据的会话双方都不会空闲超时；
+// 对端已经不在时 PING 得不到回应，会话仍在 IdleTimeout 后失败。
+func (c *Conn) onTick(now time.Time) {
+	var out [][]byte
+	c.mu.Lock()
+	if now.Sub(c.lastRecv) > c.cfg.IdleTimeout {
+		c.failLocked(ErrTimeout)
+		c.mu.Unlock()
+		c.cc.wake()
+		return
+	}
+	// 在标记任何分段重传之前采用路径的 MSS 并处理黑洞，切开的分段在这个周期就按新的 MSS 发出
+	c.syncMSSLocked()
+	if c.blackHoleLocked(now) {
+		c.path.blackHole(now)
+		c.syncMSSLocked()
+	}
+	backoff := false
+	for _, o := range c.inflight {
+		if o.sacked || now.Sub(o.sentAt) < c.rto {
+			continue
+		}
+		if o.retries >= c.cfg.MaxRetries {
+			c.failLocked(ErrTimeout)
+			c.mu.Unlock()
+			c.cc.wake()
+			return
+		}
+		if !c.cfg.Limiter.Allow() {
+			break
+		}
+		// 零窗口探测没有得到确认是因为对端窗口关闭，不是拥塞
+		if !backoff && seqLess(o.seq, c.sndEdge) {
+			c.cc.onLoss(o.epoch, true)
+		}
+		o.retries++
+		out = append(out, c.packetLocked(o))
+		backoff = true
+	}
+	if backoff {
+		c.rto = min(c.rto*2, c.cfg.MaxRTO)
+	}
+	if keep := c.cfg.IdleTimeout / 3; now.Sub(c.lastRecv) >= keep && now.Sub(c.pingAt) >= keep {
+		out = append(out, c.pingPacketLocked(now))
+	}
+	if pkt := c.pmtuTickLocked(now); pkt != nil {
+		out = append(out, pkt)
+	}
+	out = append(out, c.fecTickLocked(now)...)
+	c.mu.Unlock()
+
+	for _, pkt := range out {
+		c.send(pkt)
+	}
+}
+
+func (c *Conn) pingPacketLocked(now time.Time) []byte {
+	c.pingAt = now
+	return c.marshalLocked(&protocol.Frame{Type: protocol.FramePing, Offset: c.sndNxt})
+}
+
+// failLocked 结束会话，在途的分段不再重传，它们占用的拥塞窗口由调用方解锁后用 cc.wake 通知等待方
+func (c *Conn) failLocked(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.cc.hold(-len(c.inflight))
+	c.inflight = nil
+	c.cond.Broadcast()
+	c.doneOnce.Do(func() { close(c.done) })
+}
+
+// checkDoneLocked 在双方的 FIN 都已送达后结束会话
+func (c *Conn) checkDoneLocked() {
+	if c.finSent && len(c.inflight) == 0 && c.finRecv {
+		c.doneOnce.Do(func() { close(c.done) })
+	}
+}
+
+// send 发送一个编码好的帧。发送失败等同于丢包，由重传机制处理。
+func (c *Conn) send(pkt []byte) {
+	c.output(pkt)
+}
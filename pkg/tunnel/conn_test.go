@@ -0,0 +1,320 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"icmptun/pkg/protocol"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.InitialRTO = 50 * time.Millisecond
+	cfg.MinRTO = 20 * time.Millisecond
+	cfg.MaxRTO = 200 * time.Millisecond
+	cfg.MaxRetries = 30
+	return cfg
+}
+
+// newLossyPair 创建一对互相连接的会话，链路按 loss 概率丢包并用随机延迟打乱顺序
+func newLossyPair(loss float64) (a, b *Conn) {
+	var mu sync.Mutex
+	rng := rand.New(rand.NewSource(1))
+	link := func(dst **Conn) func([]byte) error {
+		return func(pkt []byte) error {
+			mu.Lock()
+			drop := rng.Float64() < loss
+			delay := time.Duration(rng.Intn(5)) * time.Millisecond
+			mu.Unlock()
+			if drop {
+				return nil
+			}
+			time.AfterFunc(delay, func() { (*dst).Input(pkt) })
+			return nil
+		}
+	}
+	a = NewConn(testConfig(), 1, link(&b))
+	b = NewConn(testConfig(), 1, link(&a))
+	return a, b
+}
+
+func TestFrameEnd(t *testing.T) {
+	data := &protocol.Frame{Type: protocol.FrameData, Offset: 0xfffffff0, Payload: []byte("payload")}
+	if got := frameEnd(data); got != 0xfffffff7 {
+		t.Errorf("DATA frame end = %#x, want %#x", got, uint32(0xfffffff7))
+	}
+	fin := &protocol.Frame{Type: protocol.FrameFIN, Offset: 100}
+	if got := frameEnd(fin); got != 101 {
+		t.Errorf("FIN should occupy one offset, got end %d", got)
+	}
+}
+
+func TestConnReliableTransferOverLossyLink(t *testing.T) {
+	a, b := newLossyPair(0.2)
+	defer a.Close()
+	defer b.Close()
+
+	up := bytes.Repeat([]byte("upload-"), 30000)
+	down := bytes.Repeat([]byte("download-"), 30000)
+
+	errc := make(chan error, 2)
+	go func() {
+		if _, err := a.Write(up); err != nil {
+			errc <- err
+			return
+		}
+		errc <- a.CloseWrite()
+	}()
+	go func() {
+		if _, err := b.Write(down); err != nil {
+			errc <- err
+			return
+		}
+		errc <- b.CloseWrite()
+	}()
+
+	gotUp, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatalf("reading upload failed: %v", err)
+	}
+	gotDown, err := io.ReadAll(a)
+	if err != nil {
+		t.Fatalf("reading download failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	if !bytes.Equal(gotUp, up) {
+		t.Errorf("upload corrupted: got %d bytes, want %d", len(gotUp), len(up))
+	}
+	if !bytes.Equal(gotDown, down) {
+		t.Errorf("download corrupted: got %d bytes, want %d", len(gotDown), len(down))
+	}
+
+	for _, c := range []*Conn{a, b} {
+		select {
+		case <-c.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("session did not finish after both FINs were acknowledged")
+		}
+	}
+}
+
+func TestConnTimeoutWhenPeerSilent(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxRetries = 3
+	c := NewConn(cfg, 1, func([]byte) error { return nil })
+	defer c.Close()
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrTimeout) {
+			t.Errorf("expected ErrTimeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not time out")
+	}
+}
+
+func TestConnRejectsOtherSession(t *testing.T) {
+	c := NewConn(testConfig(), 1, func([]byte) error { return nil })
+	defer c.Close()
+	b, _ := (&protocol.Frame{Type: protocol.FrameData, Session: 2, Payload: []byte("x")}).Marshal()
+	if err := c.Input(b); !errors.Is(err, errSessionMismatch) {
+		t.Errorf("expected errSessionMismatch, got %v", err)
+	}
+}
+
+func TestConnReset(t *testing.T) {
+	a, b := newLossyPair(0)
+	defer b.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.Read(make([]byte, 1))
+		done <- err
+	}()
+	a.Abort()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrReset) {
+			t.Errorf("expected ErrReset, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("RST did not abort the peer")
+	}
+}
+
+func TestConnFlowControl(t *testing.T) {
+	a, b := newLossyPair(0)
+	defer a.Close()
+	defer b.Close()
+	const window = 8 * 1024
+	b.mu.Lock()
+	b.cfg.ReceiveWindow = window
+	b.mu.Unlock()
+	a.mu.Lock()
+	a.sndEdge = window
+	a.mu.Unlock()
+
+	data := bytes.Repeat([]byte("flow-control-"), 20000)
+	written := make(chan error, 1)
+	go func() {
+		_, err := a.Write(data)
+		written <- err
+	}()
+
+	// 读方不读取时，接收缓存不应超过窗口，写方应被阻塞
+	time.Sleep(200 * time.Millisecond)
+	b.mu.Lock()
+	buffered := len(b.readBuf)
+	b.mu.Unlock()
+	if buffered > window {
+		t.Errorf("receiver buffered %d bytes, window is %d", buffered, window)
+	}
+	select {
+	case <-written:
+		t.Fatal("writer should block while the receiver window is full")
+	default:
+	}
+
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatalf("reading failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data corrupted under flow control")
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+}
+
+func TestConnCloseWithError(t *testing.T) {
+	a, b := newLossyPair(0.2)
+	defer a.Close()
+	defer b.Close()
+
+	data := bytes.Repeat([]byte("partial-"), 1000)
+	go func() {
+		a.Write(data)
+		a.CloseWithError(ErrCodeTimeout, "upstream timed out")
+	}()
+
+	got, err := io.ReadAll(b)
+	if !bytes.Equal(got, data) {
+		t.Errorf("data before the error frame was not delivered: got %d bytes, want %d", len(got), len(data))
+	}
+	var remote *RemoteError
+	if !errors.As(err, &remote) {
+		t.Fatalf("expected *RemoteError, got %v", err)
+	}
+	if remote.Code != ErrCodeTimeout || remote.Message != "upstream timed out" {
+		t.Errorf("unexpected remote error %+v", remote)
+	}
+}
+
+func TestConnFail(t *testing.T) {
+	c := NewConn(testConfig(), 1, func([]byte) error { return nil })
+	defer c.Close()
+	unreachable := errors.New("host unreachable")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+	c.Fail(unreachable)
+	select {
+	case err := <-done:
+		if !errors.Is(err, unreachable) {
+			t.Errorf("Read returned %v, want the failure", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Fail did not wake the reader")
+	}
+	select {
+	case <-c.Done():
+	default:
+		t.Error("failed session is not done")
+	}
+	if _, err := c.Write([]byte("x")); !errors.Is(err, unreachable) {
+		t.Errorf("Write returned %v, want the failure", err)
+	}
+}
+
+// newDirectPair 创建一对直接相连的会话，帧在发送时同步交给对端。
+// 会话一创建就可能发出保活 PING，两端都创建好之后链路才开始传递
+func newDirectPair(cfg Config) (a, b *Conn) {
+	ready := make(chan struct{})
+	link := func(dst **Conn) func([]byte) error {
+		return func(pkt []byte) error {
+			<-ready
+			return (*dst).Input(pkt)
+		}
+	}
+	a = NewConn(cfg, 1, link(&b))
+	b = NewConn(cfg, 1, link(&a))
+	close(ready)
+	return a, b
+}
+
+// TestIdleSessionKeepsAlive 验证没有数据的会话自己发送 PING 保活，超过 IdleTimeout 后仍能继续传输
+func TestIdleSessionKeepsAlive(t *testing.T) {
+	cfg := testConfig()
+	cfg.IdleTimeout = 200 * time.Millisecond
+	a, b := newDirectPair(cfg)
+	defer a.Close()
+	defer b.Close()
+
+	time.Sleep(3 * cfg.IdleTimeout)
+	select {
+	case <-a.Done():
+		t.Fatalf("idle session failed: %v", a.err)
+	case <-b.Done():
+		t.Fatalf("idle peer failed: %v", b.err)
+	default:
+	}
+	a.Write([]byte("still here"))
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(b, buf); err != nil || string(buf) != "still here" {
+		t.Errorf("read %q (%v) after the idle period", buf, err)
+	}
+}
+
+// TestPingKeepsSessionAlive 验证定期 Ping 能让没有数据的会话双方都不会空闲超时
+func TestPingKeepsSessionAlive(t *testing.T) {
+	cfg := testConfig()
+	cfg.IdleTimeout = 200 * time.Millisecond
+	a, b := newDirectPair(cfg)
+	defer a.Close()
+	defer b.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := a.Ping(); err != nil {
+			t.Fatalf("Ping failed: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case <-a.Done():
+		t.Fatal("pinging side timed out")
+	case <-b.Done():
+		t.Fatal("pinged side timed out")
+	default:
+	}
+}
@@ -0,0 +1,64 @@
+package tunnel
+
+import "fmt"
+
+// ErrorCode 是对端通过错误帧报告的失败类别
+type ErrorCode uint8
+
+const (
+	// ErrCodeUnknown 表示未分类的失败
+	ErrCodeUnknown ErrorCode = iota
+	// ErrCodeBadRequest 表示对端无法解析收到的请求
+	ErrCodeBadRequest
+	// ErrCodeDNS 表示目标域名解析失败
+	ErrCodeDNS
+	// ErrCodeConnect 表示无法连接到目标（拒绝连接、网络不可达等）
+	ErrCodeConnect
+	// ErrCodeTimeout 表示连接目标或等待目标响应超时
+	ErrCodeTimeout
+	// ErrCodeUpstream 表示连接建立后目标返回了错误或中途断开
+	ErrCodeUpstream
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrCodeBadRequest:
+		return "请求无效"
+	case ErrCodeDNS:
+		return "域名解析失败"
+	case ErrCodeConnect:
+		return "连接目标失败"
+	case ErrCodeTimeout:
+		return "目标响应超时"
+	case ErrCodeUpstream:
+		return "目标连接异常"
+	default:
+		return "未知错误"
+	}
+}
+
+// RemoteError 是对端通过错误帧报告的失败，会话在错误帧之前的数据仍可正常读取
+type RemoteError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// marshal 把错误编码为错误帧的负载：类别(1) + 描述
+func (e *RemoteError) marshal(limit int) []byte {
+	msg := e.Message
+	if len(msg) > limit-1 {
+		msg = msg[:limit-1]
+	}
+	return append([]byte{byte(e.Code)}, msg...)
+}
+
+func parseRemoteError(b []byte) *RemoteError {
+	if len(b) == 0 {
+		return &RemoteError{Code: ErrCodeUnknown}
+	}
+	return &RemoteError{Code: ErrorCode(b[0]), Message: string(b[1:])}
+}
@@ -0,0 +1,243 @@
+package tunnel
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"icmptun/pkg/protocol"
+	"time"
+)
+
+// 前向纠错（FEC）用 XOR 校验帧保护数据分段，接收方丢失分段时不必等待一个往返的重传。
+//
+// 发送方把连续发出的 Config.FECData 个新 DATA 分段编为一组，组内按下标交错分成
+// Config.FECParity 个子组：第 j 个子组包含下标为 j、j+M、j+2M… 的分段，
+// 它的校验是这些分段按最长者补零后的逐字节异或。每个子组能还原一个丢失的分段，
+// 交错让连续丢失的几个分段落在不同的子组中。一段时间没有新数据时，未满的组也立即发出校验。
+//
+// 校验帧的 offset 是组内第一个分段的偏移，负载依次是组内分段数(1)、子组数(1)、子组下标(1)、
+// 各分段的长度(各 2) 和异或结果。组内分段在流中首尾相接，由长度就能算出每个分段的偏移。
+// 校验帧不带 SACK 块，元数据占用的是 SACK 块的空间，因此不会比最大的 DATA 帧更长。
+//
+// 接收方记住最近收到的数据分段。子组中只缺一个分段时，用校验和其余分段还原它，当作收到的
+// DATA 帧处理；暂时缺少多个分段的校验帧保留下来，等重排的分段到达后再试。
+// 校验帧不重传，也不占用拥塞窗口，Config.Limiter 没有令牌时直接放弃。
+
+const (
+	fecHeaderLen = 3
+	// MaxFECData 是一组最多包含的数据分段数，受校验帧中元数据空间的限制
+	MaxFECData = (protocol.MaxSACKBlocks*8 - fecHeaderLen) / 2
+	// fecHistory 是接收方为还原丢失分段而记住的最近数据分段数
+	fecHistory = 64
+	// fecPending 是接收方最多保留的等待分段到齐的校验帧数
+	fecPending = 16
+)
+
+// fecSender 是发送方正在编组的数据分段
+type fecSender struct {
+	group []*outSegment
+	last  time.Time // 最近一次加入分段的时间
+}
+
+// fecRange 是校验覆盖的一个分段
+type fecRange struct {
+	seq uint32
+	n   int
+}
+
+// fecParity 是解析后的校验帧
+type fecParity struct {
+	segs   []fecRange
+	parity []byte
+}
+
+// fecReceiver 是接收方用于还原分段的状态
+type fecReceiver struct {
+	history map[uint32][]byte // 最近收到的数据分段，按偏移索引
+	order   []uint32          // history 的插入顺序，用于淘汰最旧的分段
+	pending []*fecParity
+}
+
+// dupAckThreshold 返回触发快速重传的重复确认数。开启 FEC 时组内丢失的分段在校验帧到达后就能还原，
+// 组内其余分段引起的重复确认不应触发重传。
+func (c *Conn) dupAckThreshold() int {
+	if c.cfg.FECData > 0 && c.cfg.FECParity > 0 {
+		return 3 + c.cfg.FECData
+	}
+	return 3
+}
+
+// fecAddLocked 把新发出的数据分段加入当前组，组满时返回各子组的校验帧
+func (c *Conn) fecAddLocked(o *outSegment, now time.Time) [][]byte {
+	if c.cfg.FECData <= 0 || c.cfg.FECParity <= 0 {
+		return nil
+	}
+	c.fecOut.group = append(c.fecOut.group, o)
+	c.fecOut.last = now
+	if len(c.fecOut.group) < c.cfg.FECData {
+		return nil
+	}
+	return c.fecFlushLocked()
+}
+
+// fecTickLocked 在一段时间没有新数据时为未满的组发出校验帧，写方暂停时最后几个分段也受到保护
+func (c *Conn) fecTickLocked(now time.Time) [][]byte {
+	if len(c.fecOut.group) == 0 || now.Sub(c.fecOut.last) < tickInterval {
+		return nil
+	}
+	return c.fecFlushLocked()
+}
+
+// fecFlushLocked 编码当前组每个子组的校验帧并开始新的一组
+func (c *Conn) fecFlushLocked() [][]byte {
+	group := c.fecOut.group
+	c.fecOut.group = nil
+	m := min(c.cfg.FECParity, len(group))
+	var out [][]byte
+	for j := 0; j < m; j++ {
+		if !c.cfg.Limiter.Allow() {
+			break
+		}
+		out = append(out, c.fecPacketLocked(group, m, j))
+	}
+	return out
+}
+
+// fecPacketLocked 编码 group 中第 j 个子组的校验帧
+func (c *Conn) fecPacketLocked(group []*outSegment, m, j int) []byte {
+	size := 0
+	for i := j; i < len(group); i += m {
+		size = max(size, len(group[i].data))
+	}
+	payload := make([]byte, fecHeaderLen+2*len(group)+size)
+	payload[0], payload[1], payload[2] = byte(len(group)), byte(m), byte(j)
+	for i, o := range group {
+		binary.BigEndian.PutUint16(payload[fecHeaderLen+2*i:], uint16(len(o.data)))
+	}
+	parity := payload[fecHeaderLen+2*len(group):]
+	for i := j; i < len(group); i += m {
+		subtle.XORBytes(parity, parity, group[i].data)
+	}
+	c.advWnd = c.recvWindowLocked()
+	f := &protocol.Frame{
+		Type:    protocol.FrameFEC,
+		Session: c.session,
+		Offset:  group[0].seq,
+		Ack:     c.rcvNxt,
+		Window:  c.advWnd,
+		Payload: payload,
+	}
+	b, _ := f.Marshal()
+	return b
+}
+
+// parseFEC 解析校验帧，取出它所在子组的分段
+func parseFEC(f *protocol.Frame) (*fecParity, bool) {
+	b := f.Payload
+	if len(b) < fecHeaderLen {
+		return nil, false
+	}
+	n, m, j := int(b[0]), int(b[1]), int(b[2])
+	if n == 0 || n > MaxFECData || m == 0 || j >= m || len(b) < fecHeaderLen+2*n {
+		return nil, false
+	}
+	p := &fecParity{parity: b[fecHeaderLen+2*n:]}
+	seq := f.Offset
+	for i := 0; i < n; i++ {
+		l := int(binary.BigEndian.Uint16(b[fecHeaderLen+2*i:]))
+		if i%m == j {
+			if l > len(p.parity) {
+				return nil, false
+			}
+			p.segs = append(p.segs, fecRange{seq: seq, n: l})
+		}
+		seq += uint32(l)
+	}
+	return p, true
+}
+
+// fecRecordLocked 记住收到的数据分段，并用等待中的校验帧尝试还原，返回是否还原了分段
+func (c *Conn) fecRecordLocked(f *protocol.Frame) bool {
+	if f.Type != protocol.FrameData || len(f.Payload) == 0 {
+		return false
+	}
+	c.fecRememberLocked(f.Offset, f.Payload)
+	return len(c.fecIn.pending) > 0 && c.fecRecoverLocked()
+}
+
+// handleFECLocked 处理校验帧，返回是否还原了分段
+func (c *Conn) handleFECLocked(f *protocol.Frame) bool {
+	p, ok := parseFEC(f)
+	if !ok {
+		return false
+	}
+	r := &c.fecIn
+	r.pending = append(r.pending, p)
+	if len(r.pending) > fecPending {
+		r.pending = r.pending[1:]
+	}
+	return c.fecRecoverLocked()
+}
+
+func (c *Conn) fecRememberLocked(seq uint32, data []byte) {
+	r := &c.fecIn
+	if r.history == nil {
+		r.history = make(map[uint32][]byte)
+	}
+	if _, ok := r.history[seq]; ok {
+		return
+	}
+	r.history[seq] = data
+	r.order = append(r.order, seq)
+	if len(r.order) > fecHistory {
+		delete(r.history, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+// fecRecoverLocked 用等待中的校验帧还原丢失的分段，直到没有可以还原的为止
+func (c *Conn) fecRecoverLocked() bool {
+	r := &c.fecIn
+	recovered := false
+	for progress := true; progress; {
+		progress = false
+		kept := r.pending[:0]
+		for _, p := range r.pending {
+			var missing []fecRange
+			for _, s := range p.segs {
+				if data, ok := r.history[s.seq]; !ok || len(data) != s.n {
+					missing = append(missing, s)
+				}
+			}
+			switch {
+			case len(missing) == 0:
+				// 分段都已收到，校验没有用处
+			case len(missing) == 1 && !seqLessEq(missing[0].seq+uint32(missing[0].n), c.rcvNxt):
+				c.fecRestoreLocked(p, missing[0])
+				recovered, progress = true, true
+			case len(missing) == 1:
+				// 缺少的分段已经交付，只是不在记录中
+			default:
+				// 子组中的分段全部交付之前都可能等到重排的分段
+				last := p.segs[len(p.segs)-1]
+				if !seqLessEq(last.seq+uint32(last.n), c.rcvNxt) {
+					kept = append(kept, p)
+				}
+			}
+		}
+		r.pending = kept
+	}
+	return recovered
+}
+
+// fecRestoreLocked 用校验和子组中其余的分段还原 missing，当作收到的 DATA 帧处理
+func (c *Conn) fecRestoreLocked(p *fecParity, missing fecRange) {
+	data := append([]byte(nil), p.parity...)
+	for _, s := range p.segs {
+		if s != missing {
+			subtle.XORBytes(data, data, c.fecIn.history[s.seq])
+		}
+	}
+	f := &protocol.Frame{Type: protocol.FrameData, Offset: missing.seq, Payload: data[:missing.n]}
+	c.fecRememberLocked(f.Offset, f.Payload)
+	c.handleDataLocked(f)
+}
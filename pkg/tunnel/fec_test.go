@@ -0,0 +1,127 @@
+package tunnel
+
+import (
+	"bytes"
+	"icmptun/pkg/protocol"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func fecConfig(data, parity int) Config {
+	cfg := testConfig()
+	cfg.FECData, cfg.FECParity = data, parity
+	// 重传超时足够长，传输能很快完成只能是因为丢失的分段被还原了
+	cfg.InitialRTO, cfg.MinRTO, cfg.MaxRTO = 5*time.Second, 5*time.Second, 5*time.Second
+	return cfg
+}
+
+// TestFECInterleavedRecovery 验证交错的子组能还原连续丢失的分段
+func TestFECInterleavedRecovery(t *testing.T) {
+	var sent [][]byte
+	a := NewConn(fecConfig(6, 2), 1, func(pkt []byte) error {
+		sent = append(sent, pkt)
+		return nil
+	})
+	defer a.Close()
+	b := NewConn(testConfig(), 1, func([]byte) error { return nil })
+	defer b.Close()
+
+	a.mu.Lock()
+	var group []*outSegment
+	var want []byte
+	for i := 0; i < 6; i++ {
+		data := bytes.Repeat([]byte{byte('a' + i)}, 100+i*10) // 长度不同，检验补零
+		o := &outSegment{typ: protocol.FrameData, seq: uint32(len(want)), data: data}
+		group = append(group, o)
+		want = append(want, data...)
+	}
+	parity := [][]byte{a.fecPacketLocked(group, 2, 0), a.fecPacketLocked(group, 2, 1)}
+	a.mu.Unlock()
+
+	// 连续的第 2、3 个分段丢失，它们分属两个子组
+	for i, o := range group {
+		if i == 2 || i == 3 {
+			continue
+		}
+		pkt, _ := (&protocol.Frame{Type: protocol.FrameData, Session: 1, Offset: o.seq, Payload: o.data}).Marshal()
+		b.Input(pkt)
+	}
+	for _, pkt := range parity {
+		if err := b.Input(pkt); err != nil {
+			t.Fatalf("parity rejected: %v", err)
+		}
+	}
+	b.mu.Lock()
+	got := append([]byte(nil), b.readBuf...)
+	b.mu.Unlock()
+	if !bytes.Equal(got, want) {
+		t.Errorf("recovered %d bytes, want %d", len(got), len(want))
+	}
+}
+
+// TestFECAvoidsRetransmission 验证每组丢失一个分段时，数据靠校验帧还原而不需要重传
+func TestFECAvoidsRetransmission(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[uint32]bool)
+	fresh, dropped, retransmitted := 0, 0, 0
+	// 每个方向按顺序投递，a 发出的每第四个新数据帧丢失一次
+	link := func(dst **Conn, lossy bool) func([]byte) error {
+		ch := make(chan []byte, 4096)
+		go func() {
+			for pkt := range ch {
+				(*dst).Input(pkt)
+			}
+		}()
+		return func(pkt []byte) error {
+			if lossy {
+				f, _ := protocol.ParseFrame(pkt)
+				if f.Type == protocol.FrameData {
+					mu.Lock()
+					drop := false
+					if seen[f.Offset] {
+						retransmitted++
+					} else {
+						seen[f.Offset] = true
+						fresh++
+						drop = fresh%4 == 1
+						if drop {
+							dropped++
+						}
+					}
+					mu.Unlock()
+					if drop {
+						return nil
+					}
+				}
+			}
+			ch <- pkt
+			return nil
+		}
+	}
+	var a, b *Conn
+	a = NewConn(fecConfig(4, 1), 1, link(&b, true))
+	b = NewConn(fecConfig(4, 1), 1, link(&a, false))
+	defer a.Close()
+	defer b.Close()
+
+	data := bytes.Repeat([]byte("forward error correction "), 8000)
+	start := time.Now()
+	go a.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatalf("reading failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data corrupted")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("transfer took %v, lost segments were not recovered", elapsed)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if dropped == 0 || retransmitted > dropped/4 {
+		t.Errorf("%d segments dropped, %d retransmitted", dropped, retransmitted)
+	}
+}
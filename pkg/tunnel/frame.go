@@ -0,0 +1,18 @@
+package tunnel
+
+import "icmptun/pkg/protocol"
+
+// frameEnd 返回帧占用流偏移空间的结束位置，FIN 和 ERROR 帧额外占用一个偏移
+func frameEnd(f *protocol.Frame) uint32 {
+	n := f.Offset + uint32(len(f.Payload))
+	if f.Type == protocol.FrameFIN || f.Type == protocol.FrameError {
+		n++
+	}
+	return n
+}
+
+// seqLess 使用序号回绕算术比较 a < b
+func seqLess(a, b uint32) bool { return int32(a-b) < 0 }
+
+// seqLessEq 使用序号回绕算术比较 a <= b
+func seqLessEq(a, b uint32) bool { return int32(a-b) <= 0 }
@@ -0,0 +1,76 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter 是按报文计数的令牌桶，限制一个端点发出数据报文的总速率：新的数据分段、重传和 FEC 校验帧。
+// 路由器和 Linux 的 icmp_ratelimit 都按报文数限速，超出它们的突发会被成片丢弃，
+// 因此同一端点的所有会话共享一个 Limiter，让数据的总速率保持在路径允许的范围内。
+// ACK、PING、路径 MTU 探测和轮询请求不受限制：它们数量少，推迟它们会让对端误判丢包。
+// nil 的 Limiter 不限速。
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // 每秒补充的令牌数
+	burst  float64 // 桶的容量
+	tokens float64 // 可以为负，表示已经被等待者预订的令牌
+	last   time.Time
+}
+
+// NewLimiter 创建每秒最多发送 rate 个报文、最多连续突发 burst 个报文的限速器。
+// rate 不大于 0 时返回 nil，即不限速。
+func NewLimiter(rate, burst int) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	burst = max(burst, 1)
+	return &Limiter{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// refillLocked 按经过的时间补充令牌
+func (l *Limiter) refillLocked(now time.Time) {
+	if now.After(l.last) {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+	}
+}
+
+// Wait 取走一个令牌，没有令牌时阻塞到令牌补充上来。令牌在等待开始时就已预订，
+// 先等待的先发送。stop 关闭时提前返回 false，预订的令牌不退还。
+func (l *Limiter) Wait(stop <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	l.refillLocked(time.Now())
+	l.tokens--
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return true
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// Allow 在有令牌时取走一个并返回 true，不等待。令牌都被等待者预订时返回 false。
+func (l *Limiter) Allow() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refillLocked(time.Now())
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,95 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(100, 5)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if !l.Allow() {
+			t.Fatalf("packet %d of the burst was not allowed", i)
+		}
+	}
+	if l.Allow() {
+		t.Error("allowed a packet beyond the burst")
+	}
+	for i := 0; i < 10; i++ {
+		l.Wait(nil)
+	}
+	// 10 个报文以每秒 100 个的速率需要约 100ms
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond || elapsed > time.Second {
+		t.Errorf("10 packets after the burst took %v, want about 100ms", elapsed)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if !NewLimiter(1, 1).Wait(stop) {
+		t.Error("first packet should not wait")
+	}
+	slow := NewLimiter(1, 1)
+	slow.Allow()
+	if slow.Wait(stop) {
+		t.Error("Wait should give up when stop is closed")
+	}
+
+	var unlimited *Limiter
+	if NewLimiter(0, 10) != nil || !unlimited.Allow() || !unlimited.Wait(nil) {
+		t.Error("a nil limiter should not limit")
+	}
+}
+
+// TestLimiterPacesSessions 验证共享同一个 Limiter 的会话发出的数据分段总数受速率限制
+func TestLimiterPacesSessions(t *testing.T) {
+	cfg := testConfig()
+	cfg.MSS = 100
+	cfg.Limiter = NewLimiter(200, 10)
+	var pairs [2][2]*Conn
+	for i := range pairs {
+		a, b := &pairs[i][0], &pairs[i][1]
+		*a = NewConn(cfg, 1, func(pkt []byte) error { go (*b).Input(pkt); return nil })
+		*b = NewConn(testConfig(), 1, func(pkt []byte) error { go (*a).Input(pkt); return nil })
+		defer (*a).Close()
+		defer (*b).Close()
+	}
+
+	// 两个会话共 40 个分段，突发 10 个之后以每秒 200 个发送，约需 150ms
+	data := bytes.Repeat([]byte("x"), 20*cfg.MSS)
+	start := time.Now()
+	done := make(chan struct{}, len(pairs))
+	for i := range pairs {
+		go func(a, b *Conn) {
+			go a.Write(data)
+			io.ReadFull(b, make([]byte, len(data)))
+			done <- struct{}{}
+		}(pairs[i][0], pairs[i][1])
+	}
+	for range pairs {
+		<-done
+	}
+	if elapsed := time.Since(start); elapsed < 120*time.Millisecond {
+		t.Errorf("40 segments at 200/s took only %v", elapsed)
+	}
+}
+
+// TestLimiterNotHeldByBlockedWriter 验证等待发送窗口的写方不会预订令牌，重传和校验帧仍能取到
+func TestLimiterNotHeldByBlockedWriter(t *testing.T) {
+	cfg := testConfig()
+	cfg.MSS = 100
+	cfg.SendWindow = 1
+	cfg.InitialRTO = time.Second // 检查之前不重传
+	cfg.Limiter = NewLimiter(1, 2)
+	c := NewConn(cfg, 1, func([]byte) error { return nil })
+	defer c.Abort()
+
+	// 第一个分段取走一个令牌，第二个分段等待发送窗口
+	go c.Write(bytes.Repeat([]byte("x"), 2*cfg.MSS))
+	time.Sleep(50 * time.Millisecond)
+	if !cfg.Limiter.Allow() {
+		t.Error("a writer blocked on the send window holds the remaining token")
+	}
+}
@@ -0,0 +1,318 @@
+package tunnel
+
+import (
+	"errors"
+	"icmptun/pkg/protocol"
+	"sync"
+	"time"
+)
+
+// Mux 在一个会话上复用多个流，客户端和服务端之间的所有连接共用一次握手、一个加密通道和一组轮询请求。
+//
+// 每个流是一个 Conn，帧头中的会话 ID 就是流 ID。流各自编号、确认和重传，一个流丢包不会阻塞其他流；
+// 每个流有自己的接收窗口，读得慢的流只让对端暂停这个流。所有流共享一个拥塞控制器，
+// 合计在途的分段受同一个拥塞窗口限制；路径 MTU 也属于整个会话，所有流共享一次查找得到的 MSS。
+//
+// 发起方用奇数流 ID，另一方用偶数，ID 只增不减。收到不认识的流 ID 时，
+// 只有对端发起的、没有打开过的流 ID 上从偏移 0 开始的 DATA、FIN 或 ERROR 帧打开新流并交给 Accept，
+// 其余帧属于已经结束或还没有打开的流，直接丢弃，由对端重传。
+// 流结束后在表中保留 TimeWait，迟到的重传仍能得到确认。之后才到的重复帧或重放的帧不会再打开同一个流：
+// Mux 记住对端最大的流 ID 和它之前 peerWindow 个 ID 中哪些打开过，更早的 ID 一律不再打开。
+// 流 ID 0 保留给会话本身：ID 为 0 的 RST 帧关闭整个会话。
+type Mux struct {
+	cfg    Config
+	idle   time.Duration
+	output func([]byte) error
+
+	mu       sync.Mutex
+	streams  map[uint32]*muxStream
+	active   int       // 还没有结束的流数
+	idleFrom time.Time // 最后一个流结束的时间
+	nextID   uint32
+	peerID   uint32 // 对端打开过的最大流 ID
+	peerSeen uint64 // 第 i 位表示流 peerID-2i 打开过
+	lastRecv time.Time
+	accept   chan *Conn
+
+	err      error
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// muxStream 是 Mux 中的一个流
+type muxStream struct {
+	conn   *Conn
+	opened time.Time
+}
+
+// acceptBacklog 是等待 Accept 的流的最大数量，超过后新流的帧被丢弃，由对端重传
+const acceptBacklog = 64
+
+// peerWindow 是最大的对端流 ID 之前还能打开的 ID 数，容纳并发打开的流乱序到达
+const peerWindow = 64
+
+// muxTick 是检查会话空闲的周期
+const muxTick = time.Second
+
+var (
+	// ErrStreamsExhausted 表示会话的流 ID 已经用完，需要新建会话
+	ErrStreamsExhausted = errors.New("tunnel: 会话的流 ID 已用完")
+)
+
+// NewMux 创建会话。initiator 表示本端是发起会话的一方，使用奇数流 ID。
+// cfg 是流的参数，所有流共享按 cfg.SendWindow 创建的拥塞控制器和按 cfg.MSS、cfg.MaxMSS 创建的路径 MTU 探测；
+// 没有流并且 idle 内没有收到任何帧时会话关闭。output 负责发出编码好的帧。
+func NewMux(cfg Config, initiator bool, idle time.Duration, output func([]byte) error) *Mux {
+	cfg.Congestion = NewCongestion(cfg.SendWindow)
+	cfg.PathMTU = NewPathMTU(cfg.MSS, cfg.MaxMSS)
+	now := time.Now()
+	m := &Mux{
+		cfg:      cfg,
+		idle:     idle,
+		output:   output,
+		streams:  make(map[uint32]*muxStream),
+		idleFrom: now,
+		nextID:   2,
+		lastRecv: now,
+		accept:   make(chan *Conn, acceptBacklog),
+		done:     make(chan struct{}),
+	}
+	if initiator {
+		m.nextID = 1
+	}
+	go m.timerLoop()
+	return m
+}
+
+// Done 在会话关闭或失败后关闭
+func (m *Mux) Done() <-chan struct{} { return m.done }
+
+// Err 返回会话结束的原因，会话仍在进行时为 nil
+func (m *Mux) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Open 用 cfg 打开一个新流，cfg 中的拥塞控制器和路径 MTU 探测被替换为会话共享的
+func (m *Mux) Open(cfg Config) (*Conn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	id := m.nextID
+	if id+2 < id {
+		return nil, ErrStreamsExhausted
+	}
+	m.nextID += 2
+	return m.newStreamLocked(cfg, id), nil
+}
+
+// Accept 等待对端打开的下一个流，会话结束后返回结束的原因
+func (m *Mux) Accept() (*Conn, error) {
+	select {
+	case c := <-m.accept:
+		return c, nil
+	case <-m.done:
+		return nil, m.Err()
+	}
+}
+
+// Streams 返回还没有结束的流数
+func (m *Mux) Streams() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active
+}
+
+// Idle 返回会话没有任何流、也没有收到帧的时长，有流时为 0
+func (m *Mux) Idle() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.idleLocked(time.Now())
+}
+
+func (m *Mux) idleLocked(now time.Time) time.Duration {
+	if m.active > 0 {
+		return 0
+	}
+	since := m.idleFrom
+	if m.lastRecv.After(since) {
+		since = m.lastRecv
+	}
+	return now.Sub(since)
+}
+
+// MSS 返回会话当前的分段大小
+func (m *Mux) MSS() int {
+	return m.cfg.PathMTU.MSS()
+}
+
+// LimitMSS 把会话的 MSS 降到不超过 mss，见 Conn.LimitMSS。
+// 所有流立即重新切分在途分段，之后打开的流也使用降低后的值，直到下一次定期查找
+func (m *Mux) LimitMSS(mss int) {
+	m.cfg.PathMTU.limit(mss, time.Now())
+	for _, c := range m.conns() {
+		c.LimitMSS(mss)
+	}
+}
+
+// Close 通知对端关闭会话，并以 ErrClosed 结束所有流
+func (m *Mux) Close() error {
+	b, _ := (&protocol.Frame{Type: protocol.FrameRST}).Marshal()
+	m.output(b)
+	m.Fail(ErrClosed)
+	return nil
+}
+
+// Fail 以 err 立即结束会话和所有流，不通知对端
+func (m *Mux) Fail(err error) {
+	m.mu.Lock()
+	if m.err == nil {
+		m.err = err
+	}
+	m.doneOnce.Do(func() { close(m.done) })
+	m.mu.Unlock()
+	for _, c := range m.conns() {
+		c.Fail(err)
+	}
+}
+
+func (m *Mux) conns() []*Conn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conns := make([]*Conn, 0, len(m.streams))
+	for _, s := range m.streams {
+		conns = append(conns, s.conn)
+	}
+	return conns
+}
+
+// Input 处理一个从对端收到的原始帧，交给它所属的流
+func (m *Mux) Input(b []byte) error {
+	f, err := protocol.ParseFrame(b)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil
+	}
+	m.lastRecv = time.Now()
+	if f.Session == 0 {
+		m.mu.Unlock()
+		if f.Type == protocol.FrameRST {
+			m.Fail(ErrReset)
+		}
+		return nil
+	}
+	var c *Conn
+	if s, ok := m.streams[f.Session]; ok {
+		c = s.conn
+	} else {
+		if !m.opensLocked(f) {
+			m.mu.Unlock()
+			return nil
+		}
+		c = m.newStreamLocked(m.cfg, f.Session)
+		m.markPeerLocked(f.Session)
+		m.accept <- c
+	}
+	m.mu.Unlock()
+	return c.input(f)
+}
+
+// opensLocked 判断不认识的流 ID 上的帧能否打开一个新流
+func (m *Mux) opensLocked(f *protocol.Frame) bool {
+	if f.Session%2 == m.nextID%2 || m.peerOpenedLocked(f.Session) || f.Offset != 0 || len(m.accept) == cap(m.accept) {
+		return false
+	}
+	switch f.Type {
+	case protocol.FrameData, protocol.FrameFIN, protocol.FrameError:
+		return true
+	}
+	return false
+}
+
+// peerOpenedLocked 判断对端的流 id 是否打开过，窗口之前的 ID 都当作打开过
+func (m *Mux) peerOpenedLocked(id uint32) bool {
+	if id > m.peerID {
+		return false
+	}
+	d := (m.peerID - id) / 2
+	return d >= peerWindow || m.peerSeen&(1<<d) != 0
+}
+
+// markPeerLocked 记录对端的流 id 已经打开
+func (m *Mux) markPeerLocked(id uint32) {
+	if id <= m.peerID {
+		m.peerSeen |= 1 << ((m.peerID - id) / 2)
+		return
+	}
+	if d := (id - m.peerID) / 2; d < peerWindow {
+		m.peerSeen <<= d
+	} else {
+		m.peerSeen = 0
+	}
+	m.peerSeen |= 1
+	m.peerID = id
+}
+
+// newStreamLocked 创建 ID 为 id 的流，流结束 TimeWait 后从表中删除
+func (m *Mux) newStreamLocked(cfg Config, id uint32) *Conn {
+	cfg.Congestion = m.cfg.Congestion
+	cfg.PathMTU = m.cfg.PathMTU
+	s := &muxStream{conn: NewConn(cfg, id, m.output), opened: time.Now()}
+	m.streams[id] = s
+	m.active++
+	go m.reap(id, s)
+	return s.conn
+}
+
+func (m *Mux) reap(id uint32, s *muxStream) {
+	<-s.conn.Done()
+	s.conn.mu.Lock()
+	err := s.conn.err
+	s.conn.mu.Unlock()
+
+	m.mu.Lock()
+	m.active--
+	if m.active == 0 {
+		m.idleFrom = time.Now()
+	}
+	// 流打开后整个会话都没有收到过帧，说明对端已经不认识这个会话（例如重启过），之后的流也会同样失败
+	dead := errors.Is(err, ErrTimeout) && m.lastRecv.Before(s.opened)
+	m.mu.Unlock()
+	if dead {
+		m.Fail(ErrTimeout)
+	}
+
+	time.Sleep(TimeWait)
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+func (m *Mux) timerLoop() {
+	ticker := time.NewTicker(muxTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			// 在同一次加锁中标记关闭，之后的 Open 不会再把流放进即将关闭的会话
+			m.mu.Lock()
+			expired := m.err == nil && m.idleLocked(now) > m.idle
+			if expired {
+				m.err = ErrClosed
+			}
+			m.mu.Unlock()
+			if expired {
+				m.Close()
+			}
+		}
+	}
+}
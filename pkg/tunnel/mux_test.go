@@ -0,0 +1,287 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"icmptun/pkg/protocol"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newMuxPair 创建一对互相连接的会话，a 是发起方
+func newMuxPair(t *testing.T, idle time.Duration) (a, b *Mux) {
+	link := func(dst **Mux) func([]byte) error {
+		return func(pkt []byte) error {
+			time.AfterFunc(0, func() { (*dst).Input(pkt) })
+			return nil
+		}
+	}
+	a = NewMux(testConfig(), true, idle, link(&b))
+	b = NewMux(testConfig(), false, idle, link(&a))
+	t.Cleanup(func() {
+		a.Fail(ErrClosed)
+		b.Fail(ErrClosed)
+	})
+	return a, b
+}
+
+// TestMuxStreams 验证多个流并发传输互不干扰，流 ID 按发起方分配奇数
+func TestMuxStreams(t *testing.T) {
+	client, server := newMuxPair(t, time.Minute)
+	go func() {
+		for {
+			c, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.CloseWrite()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := client.Open(testConfig())
+			if err != nil {
+				t.Errorf("Open failed: %v", err)
+				return
+			}
+			defer c.Close()
+			if c.session%2 != 1 {
+				t.Errorf("initiator opened stream %d, want an odd ID", c.session)
+			}
+			data := bytes.Repeat([]byte(fmt.Sprintf("stream %d;", i)), 3000)
+			go func() {
+				c.Write(data)
+				c.CloseWrite()
+			}()
+			got, err := io.ReadAll(c)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("stream %d echoed %d bytes (%v), want %d", c.session, len(got), err, len(data))
+			}
+		}()
+	}
+	wg.Wait()
+	deadline := time.Now().Add(2 * time.Second)
+	for client.Streams() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := client.Streams(); n != 0 {
+		t.Errorf("%d streams still active after all of them finished", n)
+	}
+}
+
+// TestMuxIgnoresStrayFrames 验证不从偏移 0 开始的帧、本端 ID 的帧和 ACK 不会打开新流
+func TestMuxIgnoresStrayFrames(t *testing.T) {
+	client, server := newMuxPair(t, time.Minute)
+	late, _ := (&protocol.Frame{Type: protocol.FrameData, Session: 3, Offset: 4, Payload: []byte("late")}).Marshal()
+	server.Input(late)
+	own, _ := (&protocol.Frame{Type: protocol.FrameData, Session: 2, Payload: []byte("own")}).Marshal()
+	server.Input(own)
+	ack, _ := (&protocol.Frame{Type: protocol.FrameAck, Session: 5}).Marshal()
+	server.Input(ack)
+
+	if n := server.Streams(); n != 0 {
+		t.Fatalf("stray frames opened %d streams", n)
+	}
+	if _, err := client.Open(testConfig()); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+}
+
+// TestMuxClose 验证关闭会话会通知对端，对端的流以 ErrReset 结束
+func TestMuxClose(t *testing.T) {
+	client, server := newMuxPair(t, time.Minute)
+	c, _ := client.Open(testConfig())
+	c.Write([]byte("hello"))
+	s, err := server.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	client.Close()
+	select {
+	case <-server.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("server session did not end after the client closed it")
+	}
+	if !errors.Is(server.Err(), ErrReset) {
+		t.Errorf("server session ended with %v, want ErrReset", server.Err())
+	}
+	if _, err := io.ReadAll(s); !errors.Is(err, ErrReset) {
+		t.Errorf("server stream read returned %v, want ErrReset", err)
+	}
+	if _, err := client.Open(testConfig()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Open on a closed session returned %v", err)
+	}
+}
+
+// TestMuxIdle 验证没有流的会话空闲超时后关闭
+func TestMuxIdle(t *testing.T) {
+	client, server := newMuxPair(t, 10*time.Millisecond)
+	c, _ := client.Open(testConfig())
+	c.Write([]byte("x"))
+	s, _ := server.Accept()
+	time.Sleep(2 * muxTick)
+	select {
+	case <-client.Done():
+		t.Fatal("session closed while a stream was open")
+	default:
+	}
+
+	c.Close()
+	s.Close()
+	select {
+	case <-client.Done():
+	case <-time.After(3 * muxTick):
+		t.Fatal("idle session was not closed")
+	}
+}
+
+// TestMuxDeadPeer 验证流打开后会话从未收到回应时，整个会话失败，之后的流不再使用它
+func TestMuxDeadPeer(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxRetries = 2
+	m := NewMux(cfg, true, time.Minute, func([]byte) error { return nil })
+	defer m.Fail(ErrClosed)
+	c, _ := m.Open(cfg)
+	c.Write([]byte("anyone?"))
+	select {
+	case <-m.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session outlived a stream that never heard from the peer")
+	}
+	if !errors.Is(m.Err(), ErrTimeout) {
+		t.Errorf("session ended with %v, want ErrTimeout", m.Err())
+	}
+}
+
+// TestMuxSharesPathMTU 验证路径 MTU 属于整个会话：新流直接使用已经找到的 MSS 而不重新查找，
+// 报文过大通知降低的 MSS 在下一次定期查找时可以重新升高
+func TestMuxSharesPathMTU(t *testing.T) {
+	var probes atomic.Int64
+	link := func(dst **Mux, count bool) func([]byte) error {
+		return func(pkt []byte) error {
+			if len(pkt)-protocol.MaxFrameHeaderLen > 1000 {
+				return nil
+			}
+			if f, err := protocol.ParseFrame(pkt); count && err == nil && f.Type == protocol.FrameProbe {
+				probes.Add(1)
+			}
+			time.AfterFunc(0, func() { (*dst).Input(pkt) })
+			return nil
+		}
+	}
+	var client, server *Mux
+	client = NewMux(pmtuConfig(500, 1400), true, time.Minute, link(&server, true))
+	server = NewMux(pmtuConfig(500, 1400), false, time.Minute, link(&client, false))
+	t.Cleanup(func() {
+		client.Fail(ErrClosed)
+		server.Fail(ErrClosed)
+	})
+	go func() {
+		for {
+			c, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.CloseWrite()
+			}()
+		}
+	}()
+	echo := func() *Conn {
+		t.Helper()
+		c, err := client.Open(pmtuConfig(500, 1400))
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		c.Write([]byte("hello"))
+		if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+			t.Fatalf("echo failed: %v", err)
+		}
+		return c
+	}
+
+	echo()
+	found := waitSearch(t, client.cfg.PathMTU)
+	if found > 1000 || found < 1000-pmtuStep {
+		t.Fatalf("discovered MSS %d, path allows 1000", found)
+	}
+	sent := probes.Load()
+	c := echo()
+	time.Sleep(10 * tickInterval)
+	if mss := c.MSS(); mss != found {
+		t.Errorf("new stream uses MSS %d, want the session's %d", mss, found)
+	}
+	if n := probes.Load(); n != sent {
+		t.Errorf("new stream sent %d more probes, want none", n-sent)
+	}
+
+	client.LimitMSS(600)
+	if mss := client.MSS(); mss != 600 {
+		t.Fatalf("session MSS after LimitMSS = %d, want 600", mss)
+	}
+	// 让下一次定期查找提前到现在
+	p := client.cfg.PathMTU
+	p.mu.Lock()
+	p.search.next = time.Now()
+	p.mu.Unlock()
+	time.Sleep(tickInterval)
+	found = waitSearch(t, p)
+	if found > 1000 || found < 1000-pmtuStep {
+		t.Errorf("MSS after the periodic search = %d, want about 1000 again", found)
+	}
+	if mss := echo().MSS(); mss != found {
+		t.Errorf("stream opened after the search uses MSS %d, want the session's %d", mss, found)
+	}
+}
+
+// TestMuxIgnoresReplayedStream 验证流从表中删除之后，重复或重放的第一个 DATA 帧不会再打开一个新流
+func TestMuxIgnoresReplayedStream(t *testing.T) {
+	m := NewMux(testConfig(), false, time.Minute, func([]byte) error { return nil })
+	defer m.Fail(ErrClosed)
+	first, _ := (&protocol.Frame{Type: protocol.FrameData, Session: 1, Payload: []byte("CONNECT")}).Marshal()
+
+	m.Input(first)
+	c, err := m.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	c.Abort()
+	// 代替 reap 在 TimeWait 之后删除流
+	m.mu.Lock()
+	delete(m.streams, c.ID())
+	m.mu.Unlock()
+
+	m.Input(first)
+	select {
+	case c := <-m.accept:
+		t.Fatalf("replayed frame opened stream %d again", c.ID())
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// 并发打开的流可能乱序到达，比最大 ID 小但没有打开过的流仍然可以打开
+	for _, id := range []uint32{5, 3} {
+		pkt, _ := (&protocol.Frame{Type: protocol.FrameData, Session: id, Payload: []byte("CONNECT")}).Marshal()
+		m.Input(pkt)
+		select {
+		case c := <-m.accept:
+			if c.ID() != id {
+				t.Errorf("accepted stream %d, want %d", c.ID(), id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("stream %d was not accepted", id)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"icmptun/pkg/protocol"
+	"sync"
+	"time"
+)
+
+// 路径 MTU 探测参考 RFC 8899 的 PLPMTUD：不依赖 ICMP，用隧道自己的探测帧找出能通过的最大分段。
+//
+// 会话从 Config.MSS 开始，这个值应当在几乎所有路径上都能通过。收到对端的第一个帧后，
+// 发送方在当前 MSS 和上限之间二分查找：PROBE 帧的长度等于携带对应数据量的最大帧，
+// 对端收到后回复 PROBE_ACK，连续 pmtuMaxProbes 次没有确认就认为这个大小无法通过。
+// 确认过的最大值成为新的 MSS，之后每隔 pmtuRaiseInterval 重新查找，以发现变大的路径。
+//
+// 双方在 PROBE 和 PROBE_ACK 中告知自己的 MSS 上限（Config.MaxMSS），查找不超过两者中较小的一个。
+// 路径变小时有两种途径得知：调用方收到报文过大通知后调用 LimitMSS，或者超过 Config.MSS 的分段
+// 连续重传 pmtuBlackHoleRetries 次（ICMP 被过滤的黑洞路径）。两种情况下在途分段都会按新的 MSS 重新切分。
+//
+// 同一路径上的多个会话（例如 Mux 中的流）可以通过 Config.PathMTU 共享一次查找和查找得到的 MSS。
+
+const (
+	// pmtuMaxProbes 是同一大小的探测最多发送的次数
+	pmtuMaxProbes = 3
+	// pmtuStep 是查找的精度，上下界相差不超过它时结束
+	pmtuStep = 16
+	// pmtuRaiseInterval 是两次查找之间的间隔
+	pmtuRaiseInterval = 10 * time.Minute
+	// pmtuBlackHoleRetries 是大分段重传多少次后退回 Config.MSS
+	pmtuBlackHoleRetries = 3
+)
+
+// MinMSS 是 LimitMSS 接受的最小值，避免伪造的报文过大通知把会话压到几乎不可用
+const MinMSS = 256
+
+// PathMTU 是路径 MTU 探测的状态，可以由多个会话共享。Mux 中的流共享会话的 PathMTU：
+// 整个会话只进行一次查找，查找由任一收到过对端帧的流发出探测，得到的 MSS 所有流一起使用，
+// 报文过大通知和黑洞退回同样作用于所有流，之后打开的流也从会话当前的 MSS 开始。
+type PathMTU struct {
+	base  int // 初始 MSS，即 Config.MSS
+	local int // 本端的 MSS 上限，随探测帧告知对端
+
+	mu     sync.Mutex
+	mss    int
+	search pmtuSearch
+}
+
+// pmtuSearch 是一次路径 MTU 查找的状态，大小都以 MSS 计
+type pmtuSearch struct {
+	peerMax int // 对端告知的 MSS 上限，0 表示还不知道
+	lo      int // 已确认能通过的最大值
+	hi      int // 已知不能通过的最小值
+	probe   int // 在途探测的大小，0 表示没有在查找
+	tries   int
+	sentAt  time.Time
+	next    time.Time // 下一次查找开始的时间
+}
+
+// NewPathMTU 创建路径 MTU 探测的状态，mss 和 maxMSS 即 Config.MSS 和 Config.MaxMSS
+func NewPathMTU(mss, maxMSS int) *PathMTU {
+	return &PathMTU{base: mss, local: max(maxMSS, mss), mss: mss}
+}
+
+// MSS 返回路径当前的分段大小
+func (p *PathMTU) MSS() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mss
+}
+
+// limit 把 MSS 降到不超过 mss，见 Conn.LimitMSS
+func (p *PathMTU) limit(mss int, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if mss <= 0 {
+		mss = p.base
+	}
+	mss = max(mss, MinMSS)
+	if mss >= p.mss {
+		return
+	}
+	p.mss = mss
+	p.search.probe = 0
+	p.search.next = now.Add(pmtuRaiseInterval)
+}
+
+// blackHole 退回初始 MSS 并立即重新查找
+func (p *PathMTU) blackHole(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mss = min(p.mss, p.base)
+	p.search.probe = 0
+	p.search.next = now
+}
+
+// maxLocked 返回协商后的 MSS 上限
+func (p *PathMTU) maxLocked() int {
+	m := p.local
+	if p.search.peerMax > 0 {
+		m = min(m, p.search.peerMax)
+	}
+	return m
+}
+
+// learnPeerMax 记录对端在探测帧中告知的上限，当前 MSS 超过它时立即降低
+func (p *PathMTU) learnPeerMax(payload []byte) {
+	if len(payload) < 4 {
+		return
+	}
+	peerMax := int(binary.BigEndian.Uint32(payload))
+	if peerMax < MinMSS {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.search.peerMax = peerMax
+	p.mss = min(p.mss, peerMax)
+}
+
+// acked 在大小为 size 的探测得到确认后提高 MSS 并继续查找，返回下一个要发出的探测大小，0 表示不发
+func (p *PathMTU) acked(size int, now time.Time) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := &p.search
+	if s.probe == 0 || size != s.probe {
+		return 0 // 过期或重复的确认
+	}
+	s.lo = s.probe
+	if s.lo > p.mss {
+		p.mss = min(s.lo, p.maxLocked())
+	}
+	s.hi = min(s.hi, p.maxLocked()+1)
+	return p.nextProbeLocked(now)
+}
+
+// tick 在需要时开始新一轮查找，或重发超过 rto 没有确认的探测，返回要发出的探测大小，0 表示不发
+func (p *PathMTU) tick(now time.Time, rto time.Duration) int {
+	if p.local <= p.base {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := &p.search
+	if s.probe == 0 {
+		if now.Before(s.next) {
+			return 0
+		}
+		s.lo, s.hi = p.mss, p.maxLocked()+1
+		return p.nextProbeLocked(now)
+	}
+	if now.Sub(s.sentAt) < rto {
+		return 0
+	}
+	if s.tries < pmtuMaxProbes {
+		return p.sendLocked(now)
+	}
+	s.hi = s.probe
+	return p.nextProbeLocked(now)
+}
+
+// nextProbeLocked 选择下一个探测大小，范围已经足够小时结束这一轮查找。
+// 第一次探测直接尝试上限，大多数路径在上限处就能通过。
+func (p *PathMTU) nextProbeLocked(now time.Time) int {
+	s := &p.search
+	if s.hi-s.lo <= pmtuStep {
+		s.probe = 0
+		s.next = now.Add(pmtuRaiseInterval)
+		return 0
+	}
+	if s.probe == 0 {
+		s.probe = s.hi - 1
+	} else {
+		s.probe = (s.lo + s.hi) / 2
+	}
+	s.tries = 0
+	return p.sendLocked(now)
+}
+
+// sendLocked 记录一次探测的发送，返回探测的大小
+func (p *PathMTU) sendLocked(now time.Time) int {
+	p.search.tries++
+	p.search.sentAt = now
+	return p.search.probe
+}
+
+// MSS 返回当前的分段大小
+func (c *Conn) MSS() int {
+	return c.path.MSS()
+}
+
+// LimitMSS 在收到路径上的报文过大通知时调用，把 MSS 降到不超过 mss 并重新切分在途分段。
+// mss 为 0 表示通知没有给出 MTU，退回 Config.MSS。下一次定期查找前不会再探测更大的值。
+// 共享 Config.PathMTU 的其他会话在下一个周期采用新的 MSS。
+func (c *Conn) LimitMSS(mss int) {
+	c.path.limit(mss, time.Now())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.syncMSSLocked()
+}
+
+// syncMSSLocked 采用路径当前的 MSS 并返回它，变小时重新切分在途分段
+func (c *Conn) syncMSSLocked() int {
+	c.setMSSLocked(c.path.MSS())
+	return c.mss
+}
+
+// setMSSLocked 修改 MSS。变小时把在途的大分段切开，切开的分段在下一个周期立即重传。
+func (c *Conn) setMSSLocked(mss int) {
+	shrink := mss < c.mss
+	c.mss = mss
+	if !shrink {
+		return
+	}
+	var inflight []*outSegment
+	for _, o := range c.inflight {
+		if o.typ != protocol.FrameData || len(o.data) <= mss {
+			inflight = append(inflight, o)
+			continue
+		}
+		for off := 0; off < len(o.data); off += mss {
+			inflight = append(inflight, &outSegment{
+				typ:     protocol.FrameData,
+				seq:     o.seq + uint32(off),
+				data:    o.data[off:min(off+mss, len(o.data))],
+				retries: max(o.retries, 1), // 不用于 RTT 采样
+				sacked:  o.sacked,
+				epoch:   o.epoch,
+			})
+		}
+	}
+	c.cc.hold(len(inflight) - len(c.inflight))
+	c.inflight = inflight
+}
+
+// blackHoleLocked 判断是否有到期重传、超过初始 MSS 的分段已经重传了 pmtuBlackHoleRetries 次，
+// 说明路径可能变小了而报文过大通知被过滤了
+func (c *Conn) blackHoleLocked(now time.Time) bool {
+	for _, o := range c.inflight {
+		if o.sacked || now.Sub(o.sentAt) < c.rto {
+			continue
+		}
+		if o.retries >= pmtuBlackHoleRetries && o.typ == protocol.FrameData && len(o.data) > c.path.base {
+			return true
+		}
+	}
+	return false
+}
+
+// handleProbeLocked 记录对端的上限并回复 PROBE_ACK
+func (c *Conn) handleProbeLocked(f *protocol.Frame) []byte {
+	c.path.learnPeerMax(f.Payload)
+	payload := binary.BigEndian.AppendUint32(nil, uint32(c.path.local))
+	return c.marshalLocked(&protocol.Frame{Type: protocol.FrameProbeAck, Offset: f.Offset, Payload: payload})
+}
+
+// handleProbeAckLocked 在探测得到确认后让路径提高 MSS，需要继续查找时返回下一个探测帧
+func (c *Conn) handleProbeAckLocked(f *protocol.Frame, now time.Time) []byte {
+	c.path.learnPeerMax(f.Payload)
+	if size := c.path.acked(int(f.Offset), now); size > 0 {
+		return c.probePacketLocked(size)
+	}
+	return nil
+}
+
+// pmtuTickLocked 在路径需要时发出探测帧。对端还不认识这个会话时探测得不到确认，
+// 收到过对端的帧之后才参与查找
+func (c *Conn) pmtuTickLocked(now time.Time) []byte {
+	if !c.heard {
+		return nil
+	}
+	if size := c.path.tick(now, c.rto); size > 0 {
+		return c.probePacketLocked(size)
+	}
+	return nil
+}
+
+// probePacketLocked 编码一个探测帧，长度等于携带 size 字节数据并带满 SACK 块的 DATA 帧。
+// 填充使用随机字节，压缩不会让探测帧变小。
+func (c *Conn) probePacketLocked(size int) []byte {
+	payload := make([]byte, size+protocol.MaxSACKBlocks*8)
+	rand.Read(payload[4:])
+	binary.BigEndian.PutUint32(payload, uint32(c.path.local))
+	c.advWnd = c.recvWindowLocked()
+	f := &protocol.Frame{
+		Type:    protocol.FrameProbe,
+		Session: c.session,
+		Offset:  uint32(size),
+		Ack:     c.rcvNxt,
+		Window:  c.advWnd,
+		Payload: payload,
+	}
+	b, _ := f.Marshal()
+	return b
+}
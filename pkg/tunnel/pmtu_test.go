@@ -0,0 +1,211 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"icmptun/pkg/protocol"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newMTUPair 创建一对会话，链路丢弃长度超过 limit 的帧，limit 以帧能携带的数据量（MSS）计
+func newMTUPair(acfg, bcfg Config, limit *atomic.Int64) (a, b *Conn) {
+	link := func(dst **Conn) func([]byte) error {
+		return func(pkt []byte) error {
+			if int64(len(pkt)-protocol.MaxFrameHeaderLen) > limit.Load() {
+				return nil
+			}
+			go (*dst).Input(pkt)
+			return nil
+		}
+	}
+	a = NewConn(acfg, 1, link(&b))
+	b = NewConn(bcfg, 1, link(&a))
+	return a, b
+}
+
+func pmtuConfig(mss, maxMSS int) Config {
+	cfg := testConfig()
+	cfg.MSS, cfg.MaxMSS = mss, maxMSS
+	return cfg
+}
+
+// waitSearch 等待 p 结束当前这一轮路径 MTU 查找并返回得到的 MSS
+func waitSearch(t *testing.T, p *PathMTU) int {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		p.mu.Lock()
+		// 一轮查找结束后下一轮安排在 pmtuRaiseInterval 之后
+		done := p.search.probe == 0 && p.search.next.After(time.Now())
+		mss := p.mss
+		p.mu.Unlock()
+		if done {
+			return mss
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("path MTU search did not finish")
+	return 0
+}
+
+// transfer 从 a 向 b 写入 data 并检查 b 完整收到
+func transfer(t *testing.T, a, b *Conn, data []byte) {
+	t.Helper()
+	go func() {
+		a.Write(data)
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatalf("reading failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data corrupted")
+	}
+}
+
+func TestPMTUDiscovery(t *testing.T) {
+	var limit atomic.Int64
+	limit.Store(1000)
+	a, b := newMTUPair(pmtuConfig(500, 1400), pmtuConfig(500, 1400), &limit)
+	defer a.Close()
+	defer b.Close()
+
+	transfer(t, a, b, []byte("hello"))
+	for _, c := range []*Conn{a, b} {
+		if mss := waitSearch(t, c.path); mss > 1000 || mss < 1000-pmtuStep {
+			t.Errorf("discovered MSS %d, path allows 1000", mss)
+		}
+	}
+	transfer(t, a, b, bytes.Repeat([]byte("after discovery "), 4000))
+}
+
+func TestPMTUNegotiatesPeerMax(t *testing.T) {
+	var limit atomic.Int64
+	limit.Store(1 << 20)
+	a, b := newMTUPair(pmtuConfig(500, 1400), pmtuConfig(500, 800), &limit)
+	defer a.Close()
+	defer b.Close()
+
+	transfer(t, a, b, []byte("hello"))
+	transfer(t, b, a, []byte("hello"))
+	if mss := waitSearch(t, a.path); mss != 800 {
+		t.Errorf("side with the higher limit settled on %d, want the peer's 800", mss)
+	}
+	if mss := waitSearch(t, b.path); mss != 800 {
+		t.Errorf("side with the lower limit settled on %d, want 800", mss)
+	}
+}
+
+// TestLimitMSSResegments 验证报文过大通知会把在途的大分段切开重传
+func TestLimitMSSResegments(t *testing.T) {
+	var limit atomic.Int64
+	limit.Store(0) // 先丢弃所有帧，让分段留在在途队列中
+	a, b := newMTUPair(pmtuConfig(1200, 0), pmtuConfig(1200, 0), &limit)
+	defer a.Close()
+	defer b.Close()
+
+	data := bytes.Repeat([]byte("resegment "), 1000)
+	go a.Write(data)
+	time.Sleep(50 * time.Millisecond)
+
+	limit.Store(300)
+	a.LimitMSS(300)
+	if mss := a.MSS(); mss != 300 {
+		t.Fatalf("MSS after LimitMSS = %d, want 300", mss)
+	}
+	a.mu.Lock()
+	for _, o := range a.inflight {
+		if len(o.data) > 300 {
+			t.Errorf("in-flight segment at %d still has %d bytes", o.seq, len(o.data))
+		}
+	}
+	a.mu.Unlock()
+
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatalf("reading failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data corrupted after resegmentation")
+	}
+
+	a.LimitMSS(10)
+	if mss := a.MSS(); mss != MinMSS {
+		t.Errorf("MSS after a tiny hint = %d, want the floor %d", mss, MinMSS)
+	}
+}
+
+// TestPMTUBlackHole 验证路径变小而没有报文过大通知时，会话退回初始 MSS 并重新查找
+func TestPMTUBlackHole(t *testing.T) {
+	var limit atomic.Int64
+	limit.Store(1400)
+	a, b := newMTUPair(pmtuConfig(500, 1400), pmtuConfig(500, 1400), &limit)
+	defer a.Close()
+	defer b.Close()
+
+	transfer(t, a, b, []byte("hello"))
+	if mss := waitSearch(t, a.path); mss != 1400 {
+		t.Fatalf("discovered MSS %d, want 1400", mss)
+	}
+
+	limit.Store(700)
+	transfer(t, a, b, bytes.Repeat([]byte("black hole "), 2000))
+	if mss := waitSearch(t, a.path); mss > 700 || mss < 700-pmtuStep {
+		t.Errorf("MSS after the path shrank = %d, want about 700", mss)
+	}
+}
+
+// TestPMTUBlackHoleRetransmits 验证退回初始 MSS 的那个周期里，到期的分段和切开的分段都立即发出，
+// 而不是被记为已重传却没有发出
+func TestPMTUBlackHoleRetransmits(t *testing.T) {
+	var mu sync.Mutex
+	var sent [][]byte
+	c := NewConn(pmtuConfig(500, 1400), 1, func(pkt []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, pkt)
+		return nil
+	})
+	defer c.Abort()
+
+	past := time.Now().Add(-time.Second)
+	c.mu.Lock()
+	c.mss = 1400
+	c.path.mu.Lock()
+	c.path.mss = 1400
+	c.path.mu.Unlock()
+	c.inflight = []*outSegment{
+		{typ: protocol.FrameData, seq: 0, data: make([]byte, 100), sentAt: past, retries: 1},
+		{typ: protocol.FrameData, seq: 100, data: make([]byte, 1400), sentAt: past, retries: pmtuBlackHoleRetries},
+	}
+	c.cc.hold(len(c.inflight))
+	c.mu.Unlock()
+	c.onTick(time.Now())
+
+	mu.Lock()
+	defer mu.Unlock()
+	var data []uint32
+	for _, pkt := range sent {
+		f, err := protocol.ParseFrame(pkt)
+		if err == nil && f.Type == protocol.FrameData {
+			if len(f.Payload) > 500 {
+				t.Errorf("segment at %d carries %d bytes after falling back to MSS 500", f.Offset, len(f.Payload))
+			}
+			data = append(data, f.Offset)
+		}
+	}
+	if want := []uint32{0, 100, 600, 1100}; fmt.Sprint(data) != fmt.Sprint(want) {
+		t.Errorf("retransmitted segments at %v, want %v", data, want)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, o := range c.inflight {
+		if o.retries == 0 || time.Since(o.sentAt) > time.Second/2 {
+			t.Errorf("segment at %d was not marked as just sent", o.seq)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"icmptun/pkg/protocol"
+	"os"
+	"strings"
+)
+
+// echoIgnorePath 是控制 Linux 内核是否自动回复 Echo 请求的 sysctl。
+// 内核的回复会带着客户端请求的原始数据先于隧道的回复到达，还可能让状态防火墙提前关闭映射。
+// 设置为 1 后原始套接字仍能收到 Echo 请求。
+// ICMPv6 有独立的 echoIgnorePath6。
+const (
+	echoIgnorePath  = "/proc/sys/net/ipv4/icmp_echo_ignore_all"
+	echoIgnorePath6 = "/proc/sys/net/ipv6/icmp/echo_ignore_all"
+)
+
+// echoIgnorePathFor 返回控制 f 的 Echo 自动回复的 sysctl
+func echoIgnorePathFor(f *protocol.Family) string {
+	if f == protocol.IPv6 {
+		return echoIgnorePath6
+	}
+	return echoIgnorePath
+}
+
+// kernelEchoEnabled 报告内核是否会自动回复 Echo 请求
+func kernelEchoEnabled(path string) (bool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(b)) == "0", nil
+}
+
+// suppressKernelEcho 关闭内核的 Echo 自动回复，返回恢复原值的函数。原本已经关闭时 restore 什么也不做。
+func suppressKernelEcho(path string) (restore func() error, err error) {
+	old, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(string(old)) != "0" {
+		return func() error { return nil }, nil
+	}
+	if err := os.WriteFile(path, []byte("1\n"), 0o644); err != nil {
+		return nil, fmt.Errorf("写入 %s 失败: %w", path, err)
+	}
+	return func() error { return os.WriteFile(path, old, 0o644) }, nil
+}
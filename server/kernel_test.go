@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSuppressKernelEcho 验证关闭内核 Echo 自动回复后能恢复原值，原本已关闭时不做修改
+func TestSuppressKernelEcho(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "icmp_echo_ignore_all")
+	os.WriteFile(path, []byte("0\n"), 0o644)
+
+	if enabled, err := kernelEchoEnabled(path); err != nil || !enabled {
+		t.Fatalf("expected kernel echo to be enabled, got %v %v", enabled, err)
+	}
+	restore, err := suppressKernelEcho(path)
+	if err != nil {
+		t.Fatalf("suppressKernelEcho failed: %v", err)
+	}
+	if enabled, _ := kernelEchoEnabled(path); enabled {
+		t.Error("kernel echo still enabled after suppressKernelEcho")
+	}
+	if err := restore(); err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "0\n" {
+		t.Errorf("restore wrote %q, want %q", b, "0\n")
+	}
+
+	// 管理员已经关闭时保持原样，退出时也不会打开
+	os.WriteFile(path, []byte("1\n"), 0o644)
+	restore, err = suppressKernelEcho(path)
+	if err != nil {
+		t.Fatalf("suppressKernelEcho failed: %v", err)
+	}
+	restore()
+	if b, _ := os.ReadFile(path); string(b) != "1\n" {
+		t.Errorf("value changed to %q", b)
+	}
+
+	if _, err := suppressKernelEcho(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing sysctl")
+	}
+}
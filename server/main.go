@@ -2,20 +2,33 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"icmptun/pkg/compress"
+	"icmptun/pkg/config"
+	"icmptun/pkg/logging"
+	"icmptun/pkg/poll"
+	"icmptun/pkg/protocol"
+	"icmptun/pkg/secure"
+	"icmptun/pkg/socks"
+	"icmptun/pkg/tunnel"
+	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
 )
 
 const (
 	// MaxChunkSize 定义一个 ICMP 包内的最大数据尺寸，保留给 IP 和 ICMP 头的空间
-	MaxChunkSize = 1400
+	MaxChunkSize = protocol.MaxChunkSize
 )
 
 // icmpConn 定义一个可以写入 ICMP 包的接口，主要使用于单元测试时的模拟
@@ -23,10 +36,102 @@ type icmpConn interface {
 	WriteTo(b []byte, addr net.Addr) (int, error)
 }
 
+// session 是一个客户端会话：复用在会话上的流、承载它的加密通道和等待客户端请求的下行队列
+type session struct {
+	*tunnel.Mux
+	channel *secure.Channel
+	queue   *poll.Queue
+	peer    net.IP // 客户端地址，按它匹配报文过大通知
+}
+
+// input 解密客户端发来的报文并把其中的帧交给所属的流，握手报文由加密通道自行处理
+func (s *session) input(b []byte) error {
+	frame, err := s.channel.Open(b)
+	if err != nil || frame == nil {
+		return err
+	}
+	return s.Input(frame)
+}
+
+// sessionMap 保存进行中的会话，按客户端地址和 ID 区分
+type sessionMap struct {
+	sync.RWMutex
+	m map[string]*session
+}
+
+func (s *sessionMap) Get(key string) (*session, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	sess, ok := s.m[key]
+	return sess, ok
+}
+
+func (s *sessionMap) Set(key string, sess *session) {
+	s.Lock()
+	defer s.Unlock()
+	s.m[key] = sess
+}
+
+// Range 对每个会话调用 f
+func (s *sessionMap) Range(f func(key string, sess *session)) {
+	s.RLock()
+	defer s.RUnlock()
+	for key, sess := range s.m {
+		f(key, sess)
+	}
+}
+
+// Remove 仅在 key 仍然指向 sess 时删除会话
+func (s *sessionMap) Remove(key string, sess *session) {
+	s.Lock()
+	defer s.Unlock()
+	if s.m[key] == sess {
+		delete(s.m, key)
+	}
+}
+
+var sessions = &sessionMap{m: make(map[string]*session)}
+
+var (
+	// authenticator 用预共享密钥校验客户端的帧并为回复签名
+	authenticator *protocol.Authenticator
+	// conf 是命令行参数和配置文件给出的运行参数
+	conf = config.Default(config.Server)
+	// family 是监听地址所属地址族的 ICMP 协议，决定监听的网络和 Echo 类型
+	family = protocol.IPv4
+	// answerPings 表示内核的 Echo 自动回复已经关闭，由服务端代替内核回复普通 ping。
+	// 内核仍在回复时服务端不回复，否则每个 ping 都会收到两个回复，暴露隧道的存在
+	answerPings bool
+)
+
+// sessionKey 用客户端地址和会话 ID 组成会话的唯一标识
+func sessionKey(addr net.Addr, session uint32) string {
+	return fmt.Sprintf("%s/%d", addr, session)
+}
+
 func main() {
+	var err error
+	conf, err = config.Load(config.Server, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("加载配置失败: %v", err)
+	}
+	logging.SetLevel(conf.LogLevel)
+	authenticator, err = protocol.NewAuthenticator([]byte(conf.Key))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// 监听地址是 IPv6 时改用 ICMPv6，隧道在只有 IPv6 的网络上也能工作
+	if _, family, err = protocol.ResolveFamily(conf.ListenAddr); err != nil {
+		log.Fatalf("解析监听地址 %s 失败: %v", conf.ListenAddr, err)
+	}
+
 	// 启动监听 ICMP 包，通常需要 root 权限
-	log.Printf("开始监听 ICMP network=%s address=%s", "ip4:icmp", "0.0.0.0")
-	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	log.Printf("开始监听 ICMP network=%s address=%s", family.Network, conf.ListenAddr)
+	conn, err := icmp.ListenPacket(family.Network, conf.ListenAddr)
 	if err != nil {
 		log.Fatalf("Error listening for ICMP packets: %v. Note: this may require root privileges.", err)
 	}
@@ -35,123 +140,382 @@ func main() {
 		log.Println("ICMP 监听器已关闭")
 	}()
 
+	// 路径 MTU 探测要求超过路径 MTU 的回复被丢弃而不是分片，否则探测到的只是重组的上限
+	if conf.PMTUDiscovery {
+		if err := family.SetDontFragment(conn); err != nil {
+			log.Printf("禁止 ICMP 报文分片失败: %v，探测到的报文大小可能依赖分片", err)
+		}
+	}
+
+	// 内核自动回复的 Echo Reply 会和隧道的回复一起到达客户端，运行期间按配置关闭，收到退出信号时恢复
+	ignorePath := echoIgnorePathFor(family)
+	if conf.SuppressKernelEcho {
+		restore, err := suppressKernelEcho(ignorePath)
+		if err != nil {
+			log.Printf("关闭内核 Echo 自动回复失败: %v", err)
+		} else {
+			log.Printf("已设置 %s=1，退出时恢复", ignorePath)
+			answerPings = true
+			go func() {
+				sig := make(chan os.Signal, 1)
+				signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+				<-sig
+				if err := restore(); err != nil {
+					log.Printf("恢复 %s 失败: %v", ignorePath, err)
+				}
+				conn.Close()
+				os.Exit(0)
+			}()
+		}
+	} else if enabled, err := kernelEchoEnabled(ignorePath); err == nil && enabled {
+		log.Printf("警告: 内核会自动回复每个 Echo 请求，客户端会收到重复的回复；可以使用 -suppress-kernel-echo")
+	}
+
 	log.Println("ICMP HTTP 代理服务器已启动，等待请求...")
+	if len(conf.Compression) > 0 {
+		go logCompressTotals(10 * time.Minute)
+	}
 
+	// ParseMessage 会复制报文数据，因此读缓冲区可以复用
+	buf := make([]byte, protocol.MaxPacketSize)
 	for {
-		buf := make([]byte, 1500) // MTU 大小
 		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
 			log.Printf("读取 ICMP 连接数据失败: %v", err)
 			continue
 		}
 
-		msg, err := icmp.ParseMessage(ipv4.ICMPTypeEcho.Protocol(), buf[:n])
+		msg, err := icmp.ParseMessage(family.Protocol, buf[:n])
 		if err != nil {
 			log.Printf("解析 ICMP 消息失败: %v", err)
 			continue
 		}
 
-		// 这里不再检查特殊的 ID，任何 Echo 请求都视作隧道数据，由客户端保证 ID 唯一
-		if echo, ok := msg.Body.(*icmp.Echo); ok && msg.Type == ipv4.ICMPTypeEcho {
-			log.Printf("收到来自 %s 的 ICMP 请求，ID %d，长度 %d", addr, echo.ID, len(echo.Data))
-			go handleHttpRequest(conn, addr, echo)
+		if mtu, quoted, ok := protocol.PacketTooBig(msg); ok {
+			handlePacketTooBig(addr, mtu, quoted)
+			continue
+		}
+
+		// 只有通过预共享密钥认证的 Echo 请求才视作隧道数据，其余按普通 ping 回复
+		if echo, ok := msg.Body.(*icmp.Echo); ok && msg.Type == family.Request {
+			logging.Debugf("收到来自 %s 的 ICMP 请求，ID %d，Seq %d，长度 %d", addr, echo.ID, echo.Seq, len(echo.Data))
+			handleEcho(conn, addr, echo)
 		}
 	}
 }
 
-// handleHttpRequest 将 ICMP 数据解析成 HTTP 请求，执行后把响应返回给客户端
-func handleHttpRequest(conn icmpConn, addr net.Addr, reqPacket *icmp.Echo) {
-	// 步骤1：将 ICMP 数据解析为 HTTP 请求
-	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(reqPacket.Data)))
+// handleEcho 把 Echo 请求中的报文交给所属会话，加密握手的第一个报文会创建新会话。
+// 会话按 (来源地址, 负载中的会话 ID) 区分，Echo 的 ID 和 Seq 可能被 NAT 改写，只用于回复。
+// 多个分片的请求在会话内重组后才交给 http.ReadRequest。
+func handleEcho(conn icmpConn, addr net.Addr, echo *icmp.Echo) {
+	data, err := authenticator.Open(protocol.ClientToServer, echo.Data)
+	if err != nil {
+		// 未通过认证的报文和普通主机回应 ping 一样原样回复，不暴露隧道的存在；
+		// 内核仍在自动回复时交给内核
+		if answerPings {
+			sendEchoReply(conn, addr, echo.ID, echo.Seq, echo.Data)
+		}
+		return
+	}
+	sessionID, data, err := protocol.SplitSession(data)
+	if err != nil {
+		logging.Debugf("忽略缺少会话 ID 的报文: %s ID %d Seq %d", addr, echo.ID, echo.Seq)
+		return
+	}
+
+	// 空报文是客户端的轮询请求，只用于让服务端回复下行数据。
+	// 已经结束的会话在 TimeWait 内仍然接收迟到的报文，同一 ID 的新握手则替换它
+	hello, ok := secure.HelloSession(data)
+	isHello := ok && hello == sessionID
+	key := sessionKey(addr, sessionID)
+	if sess, found := sessions.Get(key); found && (sess.Err() == nil || !isHello) {
+		if len(data) > 0 {
+			if err := sess.input(data); err != nil {
+				log.Printf("会话 %s 丢弃无效帧: %v", key, err)
+			}
+		}
+		sess.queue.Request(echo.ID, echo.Seq)
+		return
+	}
+	// 新会话总是以加密握手开始，握手中的会话 ID 必须和报文头一致
+	if !isHello {
+		logging.Debugf("忽略不属于任何会话的报文: %s Seq %d", key, echo.Seq)
+		return
+	}
+
+	// 下行报文只作为客户端请求的回复发出，回复原样使用请求的 ID 和 Seq
+	queue := poll.NewQueue(func(id, seq int, b []byte) error {
+		return sendEchoReply(conn, addr, id, seq, authenticator.Seal(protocol.ServerToClient, protocol.AppendSession(nil, sessionID, b)))
+	})
+	channel, err := secure.NewResponder(sessionID, queue.Send)
 	if err != nil {
-		log.Printf("解析 ICMP 数据为 HTTP 请求失败: %v", err)
+		log.Printf("为会话 %s 创建加密通道失败: %v", key, err)
+		return
+	}
+	sess := &session{Mux: tunnel.NewMux(conf.Tunnel(), false, conf.IdleTimeout, channel.Seal), channel: channel, queue: queue, peer: addrIP(addr)}
+	sessions.Set(key, sess)
+	go func() {
+		<-sess.Done()
+		time.Sleep(tunnel.TimeWait)
+		sessions.Remove(key, sess)
+		queue.Close()
+	}()
+	sess.input(data)
+	queue.Request(echo.ID, echo.Seq)
+	go serveStreams(sess, key)
+}
+
+// serveStreams 为客户端在会话上打开的每个流处理一个 HTTP 请求，直到会话结束
+func serveStreams(sess *session, key string) {
+	for {
+		stream, err := sess.Accept()
+		if err != nil {
+			logging.Debugf("会话 %s 结束: %v", key, err)
+			return
+		}
+		go handleHttpRequest(stream, fmt.Sprintf("%s#%d", key, stream.ID()))
+	}
+}
+
+// handlePacketTooBig 按路径上的报文过大通知减小发往同一客户端地址的所有会话的分段。
+// 通知引用的是服务端发出的 Echo Reply，它的目的地址就是会话键中的客户端地址；
+// 路径 MTU 属于路径而不是单个会话，因此还没有碰到限制的会话也一起减小。
+func handlePacketTooBig(from net.Addr, mtu int, data []byte) {
+	q, ok := family.ParseQuoted(data)
+	if !ok || q.Type != family.Reply {
+		return
+	}
+	// 不支持 RFC 1191 的老路由器不报告 MTU，传 0 让会话退回初始大小
+	mss := 0
+	if mtu > 0 {
+		mss = max(family.ChunkSize(mtu)-tunnel.PacketOverhead, 1)
+	}
+	logging.Infof("%s 报告到 %s 的路径 MTU 为 %d，减小报文", from, q.Dst, mtu)
+	// 比较解析出的 IP，会话键中的地址可能带有 IPv6 区域，引用的报文头中没有
+	sessions.Range(func(key string, sess *session) {
+		if sess.peer.Equal(q.Dst) {
+			sess.LimitMSS(mss)
+		}
+	})
+}
+
+// addrIP 返回报文来源地址中的 IP
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// logCompressTotals 定期记录所有会话累计的压缩效果，没有新的数据时不记录
+func logCompressTotals(interval time.Duration) {
+	var last compress.Stats
+	for range time.Tick(interval) {
+		if s := compress.Totals(); s != last {
+			logging.Infof("压缩统计: %v", s)
+			last = s
+		}
+	}
+}
+
+// handleHttpRequest 从会话中读取 HTTP 请求，执行后把响应写回会话。
+// 会话的负载按和客户端协商的算法压缩
+func handleHttpRequest(conn *tunnel.Conn, key string) {
+	session := compress.NewConn(conn, conf.Compression)
+	defer session.Close()
+	defer func() { logging.Debugf("会话 %s 的压缩统计: %v", key, session.Stats()) }()
+
+	// 步骤1：从会话字节流中解析 HTTP 请求
+	br := bufio.NewReader(session)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		log.Printf("解析会话 %s 的 HTTP 请求失败: %v", key, err)
+		session.CloseWithError(tunnel.ErrCodeBadRequest, err.Error())
+		return
+	}
+	logging.Infof("转发 %s %s", req.Method, req.URL)
+
+	// HTTPS 等隧道请求使用 CONNECT，需要建立长连接并双向转发原始字节
+	if req.Method == http.MethodConnect {
+		handleConnect(session, br, key, req.Host)
+		return
+	}
+
+	// SOCKS5 UDP ASSOCIATE 在会话中中继 UDP 数据报
+	if req.Method == socks.MethodUDPAssociate {
+		handleUDPAssociate(session, br, key)
+		return
+	}
+
+	// 反向端口转发：BIND 监听端口并通知客户端，ACCEPT 接管一个已接受的连接
+	if req.Method == protocol.MethodBind {
+		handleBind(session, br, key, req.Host)
+		return
+	}
+	if req.Method == protocol.MethodAccept {
+		handleAccept(session, br, key, req.Host)
 		return
 	}
-	log.Printf("转发 %s %s", req.Method, req.URL)
 
 	// Go 的 HTTP 客户端要求 RequestURI 为空
 	req.RequestURI = ""
 
-	// 重新构造 URL，目前仅处理 HTTP，实际应用中应考虑 HTTPS
+	// 重新构造 URL，普通代理请求只会是 HTTP，HTTPS 通过 CONNECT 处理
 	req.URL.Scheme = "http"
 	req.URL.Host = req.Host
 
 	// 步骤2：执行 HTTP 请求，使用标准客户端处理 DNS 和连接等
 	client := &http.Client{
 		// 设置超时时间
-		Timeout: 30 * time.Second,
+		Timeout: conf.UpstreamTimeout,
 	}
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Printf("执行 HTTP 请求到 %s 失败: %v", req.Host, err)
-		// TODO: 可在此处将错误信息回传给客户端
+		// 通过错误帧把失败类别和原因回传给客户端，客户端据此立即回复 502/504
+		session.CloseWithError(errorCode(err), err.Error())
 		return
 	}
 	defer resp.Body.Close()
 
-	// 步骤3：将完整的 HTTP 响应（状态行、头、体）转为字节
-	respBytes, err := httputil.DumpResponse(resp, true)
+	// 步骤3：边读取上游响应边写入会话，由可靠流负责分块、确认和重传。
+	// 客户端读得慢时会话的接收窗口会让 Write 阻塞，进而暂停读取上游。
+	// 图片、视频和已经带有内容编码的响应再压缩也不会变小
+	session.SetCompress(compress.Compressible(resp.Header.Get("Content-Type"), resp.Header.Get("Content-Encoding")))
+	logging.Infof("开始向会话 %s 流式发送响应: %s", key, resp.Status)
+	if err := resp.Write(session); err != nil {
+		log.Printf("发送响应到会话 %s 失败: %v", key, err)
+		session.CloseWithError(tunnel.ErrCodeUpstream, err.Error())
+		return
+	}
+	logging.Infof("完成向会话 %s 发送响应", key)
+}
+
+// handleConnect 连接 CONNECT 请求的目标地址，回复状态行后在会话和 TCP 连接之间双向转发字节
+func handleConnect(session *compress.Conn, br *bufio.Reader, key, host string) {
+	target, err := net.DialTimeout("tcp", host, conf.UpstreamTimeout)
 	if err != nil {
-		log.Printf("转储 HTTP 响应失败: %v", err)
+		log.Printf("连接 CONNECT 目标 %s 失败: %v", host, err)
+		session.CloseWithError(errorCode(err), err.Error())
 		return
 	}
+	defer target.Close()
 
-	// 步骤4：把响应按块拆分，以 ICMP 包发送给客户端
-	sendResponseInChunks(conn, addr, reqPacket.ID, respBytes)
+	if _, err := session.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+	logging.Infof("隧道 %s 已连接到 %s", key, host)
+	relayTCP(session, br, key, target)
 }
 
-// sendResponseInChunks 将大响应拆分成多个 ICMP 包顺序发送
-func sendResponseInChunks(conn icmpConn, addr net.Addr, requestID int, data []byte) {
-	totalLen := len(data)
-	log.Printf("以分块形式向 %s 发送 %d 字节响应", addr, totalLen)
-
-	for seq, i := 0, 0; i < totalLen; i, seq = i+MaxChunkSize, seq+1 {
-		end := i + MaxChunkSize
-		if end > totalLen {
-			end = totalLen
+// relayTCP 在会话和 TCP 连接之间双向转发字节，直到 TCP 连接的对端关闭
+func relayTCP(session *compress.Conn, br *bufio.Reader, key string, target net.Conn) {
+	// 上行：客户端发来的数据写入目标，客户端关闭后半关闭目标连接
+	go func() {
+		io.Copy(target, br)
+		if tc, ok := target.(*net.TCPConn); ok {
+			tc.CloseWrite()
 		}
-		chunk := data[i:end]
-
-		reply := &icmp.Message{
-			Type: ipv4.ICMPTypeEchoReply,
-			Code: 0,
-			Body: &icmp.Echo{
-				ID:   requestID, // 所有分片使用同一 ID
-				Seq:  seq,       // 序号用于重组顺序
-				Data: chunk,
-			},
+	}()
+
+	// 下行：目标返回的数据写回会话，直到目标关闭连接
+	if _, err := io.Copy(session, target); err != nil {
+		log.Printf("隧道 %s 异常结束: %v", key, err)
+		return
+	}
+	logging.Infof("隧道 %s 的目标已关闭连接", key)
+}
+
+// handleUDPAssociate 为 SOCKS5 UDP ASSOCIATE 中继数据报：会话中的数据报发往其中的目标地址，
+// 收到的数据报连同来源地址写回会话，客户端关闭会话后结束
+func handleUDPAssociate(session *compress.Conn, br *bufio.Reader, key string) {
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		log.Printf("为会话 %s 创建 UDP 套接字失败: %v", key, err)
+		session.CloseWithError(tunnel.ErrCodeUpstream, err.Error())
+		return
+	}
+	defer pc.Close()
+
+	if _, err := session.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+		return
+	}
+	logging.Infof("UDP 中继 %s 已建立，本地地址 %s", key, pc.LocalAddr())
+
+	// 上行：客户端关闭会话后关闭套接字，下行循环随之结束
+	go func() {
+		defer pc.Close()
+		for {
+			d, err := socks.ReadDatagram(br)
+			if err != nil {
+				return
+			}
+			addr, err := net.ResolveUDPAddr("udp", d.Addr())
+			if err != nil {
+				logging.Debugf("UDP 中继 %s 解析目标 %s 失败: %v", key, d.Addr(), err)
+				continue
+			}
+			if _, err := pc.WriteTo(d.Data, addr); err != nil {
+				logging.Debugf("UDP 中继 %s 发送到 %s 失败: %v", key, addr, err)
+			}
 		}
+	}()
 
-		rb, err := reply.Marshal(nil)
+	// 下行：目标返回的数据报带上来源地址写回会话
+	buf := make([]byte, protocol.MaxPacketSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
 		if err != nil {
-			log.Printf("编码第 %d 个 ICMP 响应分片失败: %v", seq, err)
-			return // 编码失败则停止发送
+			break
 		}
-
-		if _, err := conn.WriteTo(rb, addr); err != nil {
-			log.Printf("发送 ICMP 响应分片 #%d 到 %s 失败: %v", seq, addr, err)
-			return // 发送失败则停止
+		from := addr.(*net.UDPAddr)
+		d := &socks.Datagram{Host: from.IP.String(), Port: from.Port, Data: buf[:n]}
+		if err := socks.WriteDatagram(session, d); err != nil {
+			break
 		}
 	}
+	logging.Infof("UDP 中继 %s 已结束", key)
+}
 
-	// 所有数据发送完毕后，再发一个零长度包表示结束
-	finalPacket := &icmp.Message{
-		Type: ipv4.ICMPTypeEchoReply,
+// errorCode 把上游失败归类为错误帧的类别
+func errorCode(err error) tunnel.ErrorCode {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &dnsErr):
+		return tunnel.ErrCodeDNS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return tunnel.ErrCodeTimeout
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return tunnel.ErrCodeConnect
+	default:
+		return tunnel.ErrCodeUpstream
+	}
+}
+
+// sendEchoReply 向客户端发送一个携带会话分段的 Echo Reply
+func sendEchoReply(conn icmpConn, addr net.Addr, requestID, seq int, data []byte) error {
+	reply := &icmp.Message{
+		Type: family.Reply,
 		Code: 0,
 		Body: &icmp.Echo{
 			ID:   requestID,
-			Seq:  (len(data) + MaxChunkSize - 1) / MaxChunkSize, // 最后一个序号
-			Data: []byte{},
+			Seq:  seq,
+			Data: data,
 		},
 	}
-	fb, err := finalPacket.Marshal(nil)
+	rb, err := reply.Marshal()
 	if err != nil {
-		log.Printf("最终 ICMP 包编码失败: %v", err)
-		return
+		log.Printf("编码 ICMP 响应分片 #%d 失败: %v", seq, err)
+		return err
 	}
-	if _, err := conn.WriteTo(fb, addr); err != nil {
-		log.Printf("发送最终 ICMP 包到 %s 失败: %v", addr, err)
-	} else {
-		log.Printf("完成向 %s 发送响应", addr)
+	if _, err := conn.WriteTo(rb, addr); err != nil {
+		log.Printf("发送 ICMP 响应分片 #%d 到 %s 失败: %v", seq, addr, err)
+		return err
 	}
+	return nil
 }
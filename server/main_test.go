@@ -3,36 +3,53 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
+	"icmptun/internal/icmptest"
+	"icmptun/pkg/compress"
+	"icmptun/pkg/poll"
+	"icmptun/pkg/protocol"
+	"icmptun/pkg/secure"
+	"icmptun/pkg/socks"
+	"icmptun/pkg/tunnel"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
-	"sort"
+	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
-// mockIcmpConn 用于在测试中捕获写入的 ICMP 数据包
+// mockIcmpConn 用于在测试中捕获写入的 ICMP 数据包，deliver 不为空时还会把数据包转交给它
 type mockIcmpConn struct {
 	mu      sync.Mutex
 	packets [][]byte
 	addr    net.Addr
+	deliver func([]byte)
 }
 
 // WriteTo 实现 icmpConn 接口，保存写入的数据包
 func (m *mockIcmpConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
 	// 保存数据包的副本
 	packetCopy := make([]byte, len(p))
 	copy(packetCopy, p)
 	m.packets = append(m.packets, packetCopy)
 	m.addr = addr
+	deliver := m.deliver
+	m.mu.Unlock()
+	if deliver != nil {
+		deliver(packetCopy)
+	}
 	return len(p), nil
 }
 
@@ -43,6 +60,76 @@ func (m *mockIcmpConn) GetPackets() [][]byte {
 	return append([][]byte(nil), m.packets...)
 }
 
+// localClient 是测试中模拟客户端的默认来源地址
+var localClient = &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+
+// dialTestSession 在新的模拟客户端会话中打开一个流，流和真实客户端一样协商压缩
+func dialTestSession(t *testing.T, mockConn *mockIcmpConn, clientAddr net.Addr, requestID int) *compress.Conn {
+	stream, err := dialTestMux(t, mockConn, clientAddr, requestID).Open(tunnel.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	return compress.NewConn(stream, conf.Compression)
+}
+
+// dialTestMux 创建一个模拟客户端会话：它的报文经 handleEcho 交给服务端，
+// 服务端通过 mockConn 写出的 Echo Reply 再交回给它
+func dialTestMux(t *testing.T, mockConn *mockIcmpConn, clientAddr net.Addr, requestID int) *session {
+	var seq atomic.Int32
+	nextSeq := func() int { return int(uint16(seq.Add(1))) }
+	send := func(seq int, b []byte) {
+		data := authenticator.Seal(protocol.ClientToServer, protocol.AppendSession(nil, uint32(requestID), b))
+		handleEcho(mockConn, clientAddr, &icmp.Echo{ID: requestID, Seq: seq, Data: data})
+	}
+	// 和真实客户端一样保持轮询，服务端只能通过请求的回复下发数据
+	poller := poll.NewPoller(4, nextSeq, func(seq int) error { send(seq, nil); return nil })
+	channel, err := secure.NewInitiator(uint32(requestID), func(b []byte) error {
+		send(nextSeq(), b)
+		poller.Start()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+	client := &session{Mux: tunnel.NewMux(tunnel.DefaultConfig(), true, time.Minute, channel.Seal), channel: channel}
+	t.Cleanup(func() { client.Close() })
+	t.Cleanup(poller.Close)
+	mockConn.mu.Lock()
+	mockConn.deliver = func(p []byte) {
+		msg, err := icmp.ParseMessage(family.Protocol, p)
+		if err != nil {
+			t.Errorf("Failed to parse ICMP message: %v", err)
+			return
+		}
+		if msg.Type != family.Reply {
+			t.Errorf("reply has type %v, want %v", msg.Type, family.Reply)
+			return
+		}
+		reply := msg.Body.(*icmp.Echo)
+		data, err := authenticator.Open(protocol.ServerToClient, reply.Data)
+		if err != nil {
+			t.Errorf("Failed to verify reply: %v", err)
+			return
+		}
+		sessionID, packet, err := protocol.SplitSession(data)
+		if err != nil || sessionID != uint32(requestID) {
+			t.Errorf("reply for session %d carries session %d (%v)", requestID, sessionID, err)
+			return
+		}
+		poller.Received(reply.Seq)
+		if len(packet) > 0 {
+			client.input(packet)
+		}
+	}
+	mockConn.mu.Unlock()
+	return client
+}
+
+func TestMain(m *testing.M) {
+	authenticator, _ = protocol.NewAuthenticator([]byte("test-key"))
+	os.Exit(m.Run())
+}
+
 // TestHandleHttpRequest_Chunking 测试完整的代理逻辑以及分片发送
 func TestHandleHttpRequest_Chunking(t *testing.T) {
 	// 1. 构建返回大量数据的模拟 HTTP 服务
@@ -64,32 +151,27 @@ func TestHandleHttpRequest_Chunking(t *testing.T) {
 		t.Fatalf("Failed to dump HTTP request: %v", err)
 	}
 
-	// 3. 构造进入服务端的 ICMP 包
-	clientAddr := &net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	// 3. 通过模拟的 ICMP 连接建立会话并发送请求，关闭压缩让响应保持原来的大小
+	old := conf.Compression
+	conf.Compression = nil
+	defer func() { conf.Compression = old }()
 	requestID := 1234
-	requestPacket := &icmp.Echo{
-		ID:   requestID,
-		Seq:  1, // 请求包本身的序号无关紧要
-		Data: reqBytes,
-	}
-
-	// 4. 创建模拟的 ICMP 连接并调用处理函数
 	mockConn := &mockIcmpConn{}
-	handleHttpRequest(mockConn, clientAddr, requestPacket)
-
-	// 5. 等待处理函数完成所有分片发送
-	time.Sleep(200 * time.Millisecond)
-
-	// 6. 验证结果
-	packets := mockConn.GetPackets()
-	if len(packets) < 3 { // Should be at least 2 data chunks + 1 final chunk
-		t.Fatalf("Expected at least 3 packets for a chunked response, but got %d", len(packets))
+	client := dialTestSession(t, mockConn, localClient, requestID)
+	defer client.Close()
+	if _, err := client.Write(reqBytes); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
 	}
 
-	// 将所有分片重新组装为完整响应
-	var reassembledBody []byte
-	var receivedChunks []*icmp.Echo
+	// 4. 服务端写完响应后关闭会话，读取到 EOF 即为完整响应
+	reassembledBody, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("Failed to read response from session: %v", err)
+	}
 
+	// 5. 验证每个分片都使用请求的 ID，且不超过最大分片尺寸
+	packets := mockConn.GetPackets()
+	dataPackets := 0
 	for i, packetBytes := range packets {
 		msg, err := icmp.ParseMessage(ipv4.ICMPTypeEcho.Protocol(), packetBytes)
 		if err != nil {
@@ -102,26 +184,21 @@ func TestHandleHttpRequest_Chunking(t *testing.T) {
 		if echo.ID != requestID {
 			t.Errorf("Packet #%d: expected ID %d, got %d", i, requestID, echo.ID)
 		}
-		receivedChunks = append(receivedChunks, echo)
-	}
-
-	// Sort chunks by sequence number to handle out-of-order delivery if it ever occurs.
-	sort.Slice(receivedChunks, func(i, j int) bool {
-		return receivedChunks[i].Seq < receivedChunks[j].Seq
-	})
-
-	// Check for the final zero-length packet
-	lastChunk := receivedChunks[len(receivedChunks)-1]
-	if len(lastChunk.Data) != 0 {
-		t.Errorf("Expected the last packet to be zero-length, but it had length %d", len(lastChunk.Data))
+		if len(echo.Data) > MaxChunkSize {
+			t.Errorf("Packet #%d: data length %d exceeds MaxChunkSize", i, len(echo.Data))
+		}
+		if bytes.Contains(echo.Data, []byte("0123456789")) {
+			t.Errorf("Packet #%d: response body is visible on the wire", i)
+		}
+		if len(echo.Data) > tunnel.PacketOverhead {
+			dataPackets++
+		}
 	}
-
-	// 去掉最后一个空包后重新拼接数据
-	for _, chunk := range receivedChunks[:len(receivedChunks)-1] {
-		reassembledBody = append(reassembledBody, chunk.Data...)
+	if dataPackets < 3 {
+		t.Fatalf("Expected at least 3 data packets for a chunked response, but got %d", dataPackets)
 	}
 
-	// 7. 将重组后的数据解析为 HTTP 响应并校验内容
+	// 6. 将重组后的数据解析为 HTTP 响应并校验内容
 	reassembledResp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(reassembledBody)), req)
 	if err != nil {
 		t.Fatalf("Failed to read reassembled HTTP response: %v", err)
@@ -141,5 +218,610 @@ func TestHandleHttpRequest_Chunking(t *testing.T) {
 		t.Errorf("Reassembled response body does not match original. Got %d bytes, want %d bytes.", len(finalBody), len(responseBody))
 	}
 
-	t.Logf("Successfully reassembled %d chunks into a valid HTTP response.", len(packets))
+	t.Logf("Successfully reassembled %d data packets into a valid HTTP response.", dataPackets)
+}
+
+// TestHandleHttpRequest_Streaming 验证上游响应会边读边发，客户端无需等待上游结束即可读到前面的数据
+func TestHandleHttpRequest_Streaming(t *testing.T) {
+	release := make(chan struct{})
+	mockHTTPServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first-part;"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second-part"))
+	}))
+	defer mockHTTPServer.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	req, _ := http.NewRequest("GET", mockHTTPServer.URL, nil)
+	reqBytes, _ := httputil.DumpRequest(req, true)
+	client := dialTestSession(t, &mockIcmpConn{}, localClient, 2468)
+	defer client.Close()
+	if _, err := client.Write(reqBytes); err != nil {
+		t.Fatalf("Failed to write request: %v", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(client), req)
+	if err != nil {
+		t.Fatalf("Failed to read response head: %v", err)
+	}
+	first := make([]byte, len("first-part;"))
+	readDone := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(resp.Body, first)
+		readDone <- err
+	}()
+	select {
+	case err := <-readDone:
+		if err != nil {
+			t.Fatalf("Failed to read first part: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first part of the body was not streamed before the upstream finished")
+	}
+
+	close(release)
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read rest of body: %v", err)
+	}
+	if got := string(first) + string(rest); got != "first-part;second-part" {
+		t.Errorf("unexpected body %q", got)
+	}
+}
+
+// TestHandleHttpRequest_Compression 验证文本响应压缩后发送，已经压缩过的内容类型原样发送
+func TestHandleHttpRequest_Compression(t *testing.T) {
+	page := bytes.Repeat([]byte("<li>compressible</li>\n"), 2000)
+	mockHTTPServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Write(page)
+	}))
+	defer mockHTTPServer.Close()
+
+	for i, tc := range []struct {
+		contentType string
+		compressed  bool
+	}{
+		{"text/html;charset=utf-8", true},
+		{"image/png", false},
+	} {
+		req, _ := http.NewRequest("GET", mockHTTPServer.URL+"/?type="+tc.contentType, nil)
+		reqBytes, _ := httputil.DumpRequest(req, true)
+		client := dialTestSession(t, &mockIcmpConn{}, localClient, 7100+i)
+		if _, err := client.Write(reqBytes); err != nil {
+			t.Fatalf("Failed to write request: %v", err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(client), req)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil || !bytes.Equal(body, page) {
+			t.Fatalf("%s: expected %d bytes, got %d (%v)", tc.contentType, len(page), len(body), err)
+		}
+		client.Close()
+
+		s := client.Stats()
+		if got := s.WireIn*4 < s.RawIn; got != tc.compressed {
+			t.Errorf("%s: compressed = %v, want %v (%v)", tc.contentType, got, tc.compressed, s)
+		}
+	}
+}
+
+// TestHandleConnect 验证 CONNECT 隧道会连接目标，并在会话和目标之间双向转发数据
+func TestHandleConnect(t *testing.T) {
+	// 1. 启动一个回显 TCP 服务作为 CONNECT 目标
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	// 2. 发送 CONNECT 请求并读取状态行
+	client := dialTestSession(t, &mockIcmpConn{}, localClient, 4321)
+	defer client.Close()
+	connectReq, _ := http.NewRequest(http.MethodConnect, "http://"+ln.Addr().String(), nil)
+	connectReq.Host = ln.Addr().String()
+	reqBytes, _ := httputil.DumpRequest(connectReq, false)
+	if _, err := client.Write(reqBytes); err != nil {
+		t.Fatalf("Failed to write CONNECT request: %v", err)
+	}
+	br := bufio.NewReader(client)
+	resp, err := http.ReadResponse(br, connectReq)
+	if err != nil {
+		t.Fatalf("Failed to read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	// 3. 隧道数据应被目标原样回显，客户端关闭后目标也关闭
+	if _, err := client.Write([]byte("hello world")); err != nil {
+		t.Fatalf("Failed to write tunnel data: %v", err)
+	}
+	client.CloseWrite()
+	echoed, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatalf("Failed to read tunnel data: %v", err)
+	}
+	if string(echoed) != "hello world" {
+		t.Fatalf("expected tunnel to relay 'hello world', got %q", echoed)
+	}
+
+	select {
+	case <-client.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("session did not finish after both sides closed")
+	}
+}
+
+// TestHandleConnect_DialFailure 验证目标不可达时回复 502 状态行
+func TestHandleConnect_DialFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	client := dialTestSession(t, &mockIcmpConn{}, localClient, 1)
+	defer client.Close()
+	client.Write([]byte("CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n\r\n"))
+	status, err := io.ReadAll(client)
+	var remote *tunnel.RemoteError
+	if !errors.As(err, &remote) {
+		t.Fatalf("expected an error frame, got data %q and error %v", status, err)
+	}
+	if remote.Code != tunnel.ErrCodeConnect {
+		t.Errorf("expected error code %v, got %v (%s)", tunnel.ErrCodeConnect, remote.Code, remote.Message)
+	}
+}
+
+// TestHandleHttpRequest_UpstreamFailure 验证上游失败会通过错误帧立即回传失败类别和原因
+func TestHandleHttpRequest_UpstreamFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	closedAddr := ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name    string
+		request string
+		want    tunnel.ErrorCode
+	}{
+		{"connection refused", "GET http://" + closedAddr + "/ HTTP/1.1\r\nHost: " + closedAddr + "\r\n\r\n", tunnel.ErrCodeConnect},
+		{"unknown host", "GET http://no-such-host.invalid/ HTTP/1.1\r\nHost: no-such-host.invalid\r\n\r\n", tunnel.ErrCodeDNS},
+		{"malformed request", "NOT AN HTTP REQUEST\r\n\r\n", tunnel.ErrCodeBadRequest},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dialTestSession(t, &mockIcmpConn{}, localClient, 3000+i)
+			defer client.Close()
+			client.Write([]byte(tt.request))
+
+			start := time.Now()
+			data, err := io.ReadAll(client)
+			var remote *tunnel.RemoteError
+			if !errors.As(err, &remote) {
+				t.Fatalf("expected an error frame, got data %q and error %v", data, err)
+			}
+			if remote.Code != tt.want {
+				t.Errorf("expected error code %v, got %v (%s)", tt.want, remote.Code, remote.Message)
+			}
+			if remote.Message == "" {
+				t.Error("error frame should carry a description")
+			}
+			if elapsed := time.Since(start); elapsed > 10*time.Second {
+				t.Errorf("error took %v to arrive", elapsed)
+			}
+		})
+	}
+}
+
+// TestHandleEcho_ReassemblesPerAddress 验证多分片上传按 (来源地址, ID) 重组：
+// 两个客户端使用相同 ID 同时上传，各自只会收到自己的请求体
+func TestHandleEcho_ReassemblesPerAddress(t *testing.T) {
+	mockHTTPServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer mockHTTPServer.Close()
+
+	const requestID = 777
+	bodies := [][]byte{
+		bytes.Repeat([]byte("A"), 20000),
+		bytes.Repeat([]byte("B"), 30000),
+	}
+	addrs := []net.Addr{
+		&net.IPAddr{IP: net.ParseIP("10.0.0.1")},
+		&net.IPAddr{IP: net.ParseIP("10.0.0.2")},
+	}
+
+	var wg sync.WaitGroup
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", mockHTTPServer.URL, bytes.NewReader(bodies[i]))
+			req.Header.Set("Content-Length", strconv.Itoa(len(bodies[i])))
+			reqBytes, _ := httputil.DumpRequest(req, true)
+
+			client := dialTestSession(t, &mockIcmpConn{}, addrs[i], requestID)
+			defer client.Close()
+			if _, err := client.Write(reqBytes); err != nil {
+				t.Errorf("client %d: write failed: %v", i, err)
+				return
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(client), req)
+			if err != nil {
+				t.Errorf("client %d: read response failed: %v", i, err)
+				return
+			}
+			got, _ := io.ReadAll(resp.Body)
+			if !bytes.Equal(got, bodies[i]) {
+				t.Errorf("client %d: upstream received %d bytes, want %d", i, len(got), len(bodies[i]))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// TestHandleEcho_Unauthenticated 验证内核 Echo 自动回复关闭时，没有通过认证的报文被当作普通 ping 原样回复，且不会建立会话
+func TestHandleEcho_Unauthenticated(t *testing.T) {
+	answerPings = true
+	defer func() { answerPings = false }()
+	frame, _ := (&protocol.Frame{Type: protocol.FrameData, Session: 55, Payload: []byte("GET http://example.com/ HTTP/1.1\r\n\r\n")}).Marshal()
+	forged, _ := protocol.NewAuthenticator([]byte("wrong-key"))
+	payloads := [][]byte{
+		[]byte("abcdefghijklmnopqrstuvwabcdefghi"),
+		frame,
+		forged.Seal(protocol.ClientToServer, frame),
+	}
+	for i, data := range payloads {
+		mockConn := &mockIcmpConn{}
+		addr := &net.IPAddr{IP: net.ParseIP("192.0.2.1")}
+		handleEcho(mockConn, addr, &icmp.Echo{ID: 55, Seq: i, Data: data})
+
+		packets := mockConn.GetPackets()
+		if len(packets) != 1 {
+			t.Fatalf("payload %d: expected exactly one reply, got %d", i, len(packets))
+		}
+		msg, err := icmp.ParseMessage(ipv4.ICMPTypeEchoReply.Protocol(), packets[0])
+		if err != nil {
+			t.Fatalf("payload %d: failed to parse reply: %v", i, err)
+		}
+		echo := msg.Body.(*icmp.Echo)
+		if msg.Type != ipv4.ICMPTypeEchoReply || echo.ID != 55 || echo.Seq != i || !bytes.Equal(echo.Data, data) {
+			t.Errorf("payload %d: reply is not a plain echo of the request: %+v", i, echo)
+		}
+		if _, found := sessions.Get(sessionKey(addr, 55)); found {
+			t.Errorf("payload %d: unauthenticated packet created a session", i)
+		}
+	}
+}
+
+// TestHandleEcho_UnauthenticatedKernelEcho 验证内核仍在自动回复 Echo 时，服务端不再回复普通 ping，
+// 否则每个 ping 都会收到重复的回复
+func TestHandleEcho_UnauthenticatedKernelEcho(t *testing.T) {
+	mockConn := &mockIcmpConn{}
+	addr := &net.IPAddr{IP: net.ParseIP("192.0.2.2")}
+	handleEcho(mockConn, addr, &icmp.Echo{ID: 56, Seq: 1, Data: []byte("abcdefghijklmnopqrstuvwabcdefghi")})
+	if packets := mockConn.GetPackets(); len(packets) != 0 {
+		t.Errorf("server answered an ordinary ping the kernel already answers: %d replies", len(packets))
+	}
+	if _, found := sessions.Get(sessionKey(addr, 56)); found {
+		t.Error("unauthenticated packet created a session")
+	}
+}
+
+// TestHandleEcho_IPv6 验证监听 IPv6 地址时会话通过 ICMPv6 Echo Reply 回复
+func TestHandleEcho_IPv6(t *testing.T) {
+	family = protocol.IPv6
+	defer func() { family = protocol.IPv4 }()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "over icmpv6")
+	}))
+	defer backend.Close()
+
+	mockConn := &mockIcmpConn{}
+	addr := &net.IPAddr{IP: net.ParseIP("2001:db8::1")}
+	client := dialTestSession(t, mockConn, addr, 6006)
+	defer client.Close()
+	fmt.Fprintf(client, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", backend.URL, backend.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "over icmpv6" {
+		t.Errorf("unexpected body %q", body)
+	}
+	for i, p := range mockConn.GetPackets() {
+		if p[0] != byte(ipv6.ICMPTypeEchoReply) {
+			t.Errorf("packet #%d has type %d, want ICMPv6 echo reply", i, p[0])
+		}
+	}
+}
+
+// TestHandleUDPAssociate 验证 UDP 中继会把会话中的数据报发往目标，并带着来源地址写回回复
+func TestHandleUDPAssociate(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(append([]byte("echo:"), buf[:n]...), addr)
+		}
+	}()
+
+	client := dialTestSession(t, &mockIcmpConn{}, localClient, 5150)
+	defer client.Close()
+	client.Write([]byte(socks.MethodUDPAssociate + " * HTTP/1.1\r\nHost: *\r\n\r\n"))
+	br := bufio.NewReader(client)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for UDP-ASSOCIATE, got %v %v", resp, err)
+	}
+
+	target := echo.LocalAddr().(*net.UDPAddr)
+	if err := socks.WriteDatagram(client, &socks.Datagram{Host: "127.0.0.1", Port: target.Port, Data: []byte("dns")}); err != nil {
+		t.Fatalf("Failed to write datagram: %v", err)
+	}
+	got := make(chan *socks.Datagram, 1)
+	go func() {
+		d, err := socks.ReadDatagram(br)
+		if err != nil {
+			t.Errorf("Failed to read datagram: %v", err)
+		}
+		got <- d
+	}()
+	select {
+	case d := <-got:
+		if d == nil || d.Port != target.Port || string(d.Data) != "echo:dns" {
+			t.Errorf("unexpected reply %+v", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no datagram relayed back")
+	}
+}
+
+// TestHandleEcho_RepliesOnlyToRequests 验证服务端从不主动发送报文：每个回复都对应客户端的一个请求，
+// 原样使用该请求的 ID 和 Seq，且每个请求最多回复一次。请求的 ID 被模拟的 NAT 逐个改写，
+// 会话仍然按负载中的会话 ID 识别。
+func TestHandleEcho_RepliesOnlyToRequests(t *testing.T) {
+	responseBody := bytes.Repeat([]byte("x"), 20000)
+	mockHTTPServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(responseBody)
+	}))
+	defer mockHTTPServer.Close()
+
+	// 记录客户端发出的每个请求（握手、数据、确认和轮询）的 Seq 和改写后的 ID
+	const sessionID = 7007
+	var mu sync.Mutex
+	var seq int
+	requested := make(map[int]int)
+	nextSeq := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		seq++
+		requested[seq] = 40000 + seq%7
+		return seq
+	}
+	mockConn := &mockIcmpConn{}
+	send := func(s int, b []byte) {
+		mu.Lock()
+		id := requested[s]
+		mu.Unlock()
+		data := authenticator.Seal(protocol.ClientToServer, protocol.AppendSession(nil, sessionID, b))
+		handleEcho(mockConn, localClient, &icmp.Echo{ID: id, Seq: s, Data: data})
+	}
+	poller := poll.NewPoller(2, nextSeq, func(s int) error { send(s, nil); return nil })
+	defer poller.Close()
+	channel, err := secure.NewInitiator(sessionID, func(b []byte) error {
+		send(nextSeq(), b)
+		poller.Start()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to create channel: %v", err)
+	}
+	client := &session{Mux: tunnel.NewMux(tunnel.DefaultConfig(), true, time.Minute, channel.Seal), channel: channel}
+	defer client.Close()
+	mockConn.deliver = func(p []byte) {
+		msg, _ := icmp.ParseMessage(ipv4.ICMPTypeEcho.Protocol(), p)
+		reply := msg.Body.(*icmp.Echo)
+		mu.Lock()
+		id, ok := requested[reply.Seq]
+		delete(requested, reply.Seq)
+		mu.Unlock()
+		if !ok || id != reply.ID {
+			t.Errorf("reply ID %d Seq %d does not answer a pending request", reply.ID, reply.Seq)
+		}
+		poller.Received(reply.Seq)
+		data, err := authenticator.Open(protocol.ServerToClient, reply.Data)
+		if err != nil {
+			t.Errorf("Failed to verify reply: %v", err)
+			return
+		}
+		if _, packet, err := protocol.SplitSession(data); err == nil && len(packet) > 0 {
+			client.input(packet)
+		}
+	}
+
+	stream, err := client.Open(tunnel.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	conn := compress.NewConn(stream, conf.Compression)
+	req, _ := http.NewRequest("GET", mockHTTPServer.URL, nil)
+	reqBytes, _ := httputil.DumpRequest(req, false)
+	conn.Write(reqBytes)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || !bytes.Equal(body, responseBody) {
+		t.Fatalf("expected %d bytes, got %d (%v)", len(responseBody), len(body), err)
+	}
+}
+
+// TestHandleEcho_MultiplexedStreams 验证一个会话上的多个流并发处理各自的请求，
+// 流等待上游时不会阻塞其他流，会话关闭后同一 ID 可以重新握手
+func TestHandleEcho_MultiplexedStreams(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	client := dialTestMux(t, &mockIcmpConn{}, localClient, 7300)
+	get := func(path string) (string, error) {
+		stream, err := client.Open(tunnel.DefaultConfig())
+		if err != nil {
+			return "", err
+		}
+		conn := compress.NewConn(stream, conf.Compression)
+		defer conn.Close()
+		req, _ := http.NewRequest("GET", backend.URL+path, nil)
+		reqBytes, _ := httputil.DumpRequest(req, false)
+		conn.Write(reqBytes)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	slow := make(chan error, 1)
+	go func() {
+		_, err := get("/slow")
+		slow <- err
+	}()
+	for i := 0; i < 3; i++ {
+		path := fmt.Sprintf("/fast/%d", i)
+		if body, err := get(path); err != nil || body != path {
+			t.Fatalf("GET %s returned %q (%v) while another stream was waiting", path, body, err)
+		}
+	}
+	release <- struct{}{}
+	if err := <-slow; err != nil {
+		t.Fatalf("slow request failed: %v", err)
+	}
+
+	sess, ok := sessions.Get(sessionKey(localClient, 7300))
+	if !ok {
+		t.Fatal("server session not found")
+	}
+	client.Close()
+	select {
+	case <-sess.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("server session outlived the client closing it")
+	}
+
+	// 结束的会话还在 TimeWait 中，同一 ID 的新握手替换它
+	client = dialTestMux(t, &mockIcmpConn{}, localClient, 7300)
+	if body, err := get("/again"); err != nil || body != "/again" {
+		t.Fatalf("GET on a new session with the same ID returned %q (%v)", body, err)
+	}
+}
+
+// TestHandlePacketTooBig 验证报文过大通知只减小发往被引用地址的会话的分段
+func TestHandlePacketTooBig(t *testing.T) {
+	near := &net.IPAddr{IP: net.ParseIP("198.51.100.7")}
+	far := &net.IPAddr{IP: net.ParseIP("198.51.100.8")}
+	mockConn := &mockIcmpConn{}
+	client := dialTestSession(t, mockConn, near, 4242)
+	defer client.Close()
+	other := dialTestSession(t, &mockIcmpConn{}, far, 4242)
+	defer other.Close()
+	// 握手随第一次写入发出，半个请求行让服务端会话保持等待
+	client.Write([]byte("GET "))
+	other.Write([]byte("GET "))
+
+	var sess, otherSess *session
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		sess, _ = sessions.Get(sessionKey(near, 4242))
+		otherSess, _ = sessions.Get(sessionKey(far, 4242))
+		if sess != nil && otherSess != nil && len(mockConn.GetPackets()) > 0 {
+			break
+		}
+	}
+	if sess == nil || otherSess == nil {
+		t.Fatal("sessions were not created")
+	}
+	before := otherSess.MSS()
+
+	// 路由器引用服务端发给 near 的第一个回复：IPv4 头之后是回复的开头
+	quoted := icmptest.QuoteIPv4(near.IP, 0, mockConn.GetPackets()[0])
+	handlePacketTooBig(&net.IPAddr{IP: net.ParseIP("192.0.2.254")}, 1000, quoted)
+
+	if mss, want := sess.MSS(), protocol.IPv4.ChunkSize(1000)-tunnel.PacketOverhead; mss != want {
+		t.Errorf("MSS = %d, want %d for a 1000-byte MTU", mss, want)
+	}
+	if mss := otherSess.MSS(); mss != before {
+		t.Errorf("session to another address changed MSS from %d to %d", before, mss)
+	}
+}
+
+// TestHandlePacketTooBigZone 验证带区域的链路本地 IPv6 客户端也能匹配报文过大通知，引用的报文头中没有区域
+func TestHandlePacketTooBigZone(t *testing.T) {
+	family = protocol.IPv6
+	defer func() { family = protocol.IPv4 }()
+
+	addr := &net.IPAddr{IP: net.ParseIP("fe80::7"), Zone: "eth0"}
+	mockConn := &mockIcmpConn{}
+	client := dialTestSession(t, mockConn, addr, 4343)
+	defer client.Close()
+	client.Write([]byte("GET "))
+
+	var sess *session
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if sess, _ = sessions.Get(sessionKey(addr, 4343)); sess != nil && len(mockConn.GetPackets()) > 0 {
+			break
+		}
+	}
+	if sess == nil {
+		t.Fatal("session was not created")
+	}
+
+	quoted := icmptest.QuoteIPv6(addr.IP, mockConn.GetPackets()[0])
+	// 会话从 IPv6 的最小 MTU 开始，通知报告一个比它更小的 MTU 才能看出是否生效
+	handlePacketTooBig(&net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0"}, 1100, quoted)
+
+	if mss, want := sess.MSS(), protocol.IPv6.ChunkSize(1100)-tunnel.PacketOverhead; mss != want {
+		t.Errorf("MSS = %d, want %d for a 1100-byte MTU", mss, want)
+	}
 }
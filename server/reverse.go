@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"icmptun/pkg/compress"
+	"icmptun/pkg/logging"
+	"icmptun/pkg/tunnel"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// pendingMap 保存反向转发中已接受、等待客户端用 ACCEPT 会话接管的连接，按令牌索引
+type pendingMap struct {
+	sync.Mutex
+	m map[string]net.Conn
+}
+
+func (p *pendingMap) Put(token string, c net.Conn) {
+	p.Lock()
+	defer p.Unlock()
+	p.m[token] = c
+}
+
+// Take 取出并删除令牌对应的连接，令牌不存在时返回 nil
+func (p *pendingMap) Take(token string) net.Conn {
+	p.Lock()
+	defer p.Unlock()
+	c := p.m[token]
+	delete(p.m, token)
+	return c
+}
+
+var pending = &pendingMap{m: make(map[string]net.Conn)}
+
+// newToken 生成一个不可猜测的令牌，只有收到通知的客户端才能接管连接
+func newToken() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// handleBind 在 addr 上监听，每接受一个连接就把它放进等待表，并在会话中写入一行令牌通知客户端。
+// 客户端关闭会话后停止监听；超过 UpstreamTimeout 仍未被接管的连接会被关闭。
+func handleBind(session *compress.Conn, br *bufio.Reader, key, addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("为会话 %s 监听 %s 失败: %v", key, addr, err)
+		session.CloseWithError(tunnel.ErrCodeUpstream, err.Error())
+		return
+	}
+	defer ln.Close()
+
+	if _, err := session.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+		return
+	}
+	log.Printf("反向转发 %s 已在 %s 监听", key, ln.Addr())
+
+	// 控制会话不承载上行数据，读到结束说明客户端已关闭或会话失败
+	go func() {
+		io.Copy(io.Discard, br)
+		ln.Close()
+	}()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			break
+		}
+		token := newToken()
+		pending.Put(token, c)
+		time.AfterFunc(conf.UpstreamTimeout, func() {
+			if c := pending.Take(token); c != nil {
+				logging.Infof("反向转发 %s 的连接 %s 未被客户端接管，已关闭", key, c.RemoteAddr())
+				c.Close()
+			}
+		})
+		logging.Infof("反向转发 %s 接受连接 %s", key, c.RemoteAddr())
+		if _, err := fmt.Fprintf(session, "%s\n", token); err != nil {
+			break
+		}
+	}
+	log.Printf("反向转发 %s 已停止监听 %s", key, ln.Addr())
+}
+
+// handleAccept 把令牌对应的已接受连接交给这个会话，之后双向转发字节
+func handleAccept(session *compress.Conn, br *bufio.Reader, key, token string) {
+	c := pending.Take(token)
+	if c == nil {
+		session.CloseWithError(tunnel.ErrCodeBadRequest, "未知或已过期的反向转发令牌")
+		return
+	}
+	defer c.Close()
+
+	if _, err := session.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+		return
+	}
+	logging.Infof("隧道 %s 已接管反向转发连接 %s", key, c.RemoteAddr())
+	relayTCP(session, br, key, c)
+}
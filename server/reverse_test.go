@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"icmptun/pkg/compress"
+	"icmptun/pkg/tunnel"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openReverse 在新会话中发送反向转发请求并确认服务端回复 200
+func openReverse(t *testing.T, id int, method, host string) (*compress.Conn, *bufio.Reader) {
+	session := dialTestSession(t, &mockIcmpConn{}, localClient, id)
+	session.Write([]byte(method + " * HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+	br := bufio.NewReader(session)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s %s failed: %v %v", method, host, resp, err)
+	}
+	return session, br
+}
+
+// TestHandleBind 验证服务端监听 BIND 的地址，通过令牌把接受的连接交给 ACCEPT 会话，
+// 控制会话关闭后停止监听
+func TestHandleBind(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	control, cbr := openReverse(t, 5001, "BIND", addr)
+
+	// 1. 外部连接到达后，控制会话上应出现一个令牌
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial bound address: %v", err)
+	}
+	defer c.Close()
+	c.Write([]byte("hello"))
+	token, err := cbr.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read token: %v", err)
+	}
+
+	// 2. 用令牌接管连接后双向转发
+	accepted, abr := openReverse(t, 5002, "ACCEPT", strings.TrimSpace(token))
+	defer accepted.Close()
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(abr, got); err != nil || string(got) != "hello" {
+		t.Fatalf("expected 'hello' from accepted connection, got %q %v", got, err)
+	}
+	accepted.Write([]byte("world"))
+	accepted.CloseWrite()
+	back, _ := io.ReadAll(c)
+	if string(back) != "world" {
+		t.Errorf("expected 'world' on the bound connection, got %q", back)
+	}
+
+	// 3. 令牌只能使用一次
+	again := dialTestSession(t, &mockIcmpConn{}, localClient, 5003)
+	defer again.Close()
+	again.Write([]byte("ACCEPT * HTTP/1.1\r\nHost: " + strings.TrimSpace(token) + "\r\n\r\n"))
+	_, err = io.ReadAll(again)
+	var remote *tunnel.RemoteError
+	if !errors.As(err, &remote) || remote.Code != tunnel.ErrCodeBadRequest {
+		t.Errorf("expected a bad request error frame for a reused token, got %v", err)
+	}
+
+	// 4. 控制会话关闭后服务端停止监听
+	control.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("server still listening after the bind session closed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -5,9 +5,18 @@ import (
 	"errors"
 	"log"
 	"net"
+	"syscall"
 )
 
-import "golang.org/x/net/ipv4"
+import (
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Type 表示 ICMP 消息类型，ipv4.ICMPType 和 ipv6.ICMPType 都实现了它
+type Type interface {
+	Protocol() int
+}
 
 // MessageBody 定义 ICMP 消息体需要实现的接口
 type MessageBody interface {
@@ -17,7 +26,7 @@ type MessageBody interface {
 
 // Message 表示一个 ICMP 消息
 type Message struct {
-	Type ipv4.ICMPType
+	Type Type
 	Code int
 	Body MessageBody
 }
@@ -39,9 +48,25 @@ func (e *Echo) Marshal(proto int) ([]byte, error) {
 	return b, nil
 }
 
-// ListenPacket 封装 net.ListenPacket
+// ListenPacket 封装 net.ListenPacket。
+//
+// network 为 "udp4" 或 "udp6" 时不创建 UDP 套接字，而是创建 Linux 的非特权 ICMP 数据报套接字
+// （ping 套接字），不需要 root，只要进程的组在 net.ipv4.ping_group_range 之内。address 是
+// 本地 IP，可以带端口。这种套接字有几点不同于原始套接字：
+//   - 内核把发出的 Echo 请求的 ID 改写为套接字的标识，即 LocalAddr 的端口，只把 ID 与之相同的
+//     Echo Reply 交给这个套接字，收到的回复中 ID 也是这个标识；
+//   - 内核负责填写校验和，只能发送 Echo 请求，收不到其他主机发来的 Echo 请求；
+//   - 内核报告的地址是 *net.UDPAddr，返回的连接在 ReadFrom 中换成 *net.IPAddr，
+//     WriteTo 两种地址都接受，调用方不必区分两种模式。
 func ListenPacket(network, address string) (net.PacketConn, error) {
-	conn, err := net.ListenPacket(network, address)
+	var conn net.PacketConn
+	var err error
+	switch network {
+	case "udp4", "udp6":
+		conn, err = listenDatagram(network, address)
+	default:
+		conn, err = net.ListenPacket(network, address)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -49,6 +74,35 @@ func ListenPacket(network, address string) (net.PacketConn, error) {
 	return conn, nil
 }
 
+// datagramConn 把 ping 套接字的 UDP 地址转换成和原始套接字一致的 IP 地址
+type datagramConn struct {
+	net.PacketConn
+}
+
+func (c *datagramConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		addr = &net.IPAddr{IP: ua.IP, Zone: ua.Zone}
+	}
+	return n, addr, err
+}
+
+func (c *datagramConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if ia, ok := addr.(*net.IPAddr); ok {
+		addr = &net.UDPAddr{IP: ia.IP, Zone: ia.Zone}
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// SyscallConn 返回底层套接字，用于设置套接字选项
+func (c *datagramConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.PacketConn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("not a syscall.Conn")
+	}
+	return sc.SyscallConn()
+}
+
 // checksum calculates the ICMP checksum for the given data using the standard
 // one's complement sum.
 func checksum(b []byte) uint16 {
@@ -66,35 +120,89 @@ func checksum(b []byte) uint16 {
 	return ^uint16(sum)
 }
 
-// Marshal 编码 ICMP 消息并计算校验和
-func (m *Message) Marshal(_ []byte) ([]byte, error) {
+// Marshal 编码 ICMP 消息。ICMPv4 的校验和在这里计算；ICMPv6 的校验和覆盖
+// IPv6 伪首部，而源地址要到发送时才由内核选定，因此留空，由内核在原始套接字和
+// ping 套接字上发送时填写（RFC 3542 第 3.1 节）。
+func (m *Message) Marshal() ([]byte, error) {
+	var typ byte
+	switch t := m.Type.(type) {
+	case ipv4.ICMPType:
+		typ = byte(t)
+	case ipv6.ICMPType:
+		typ = byte(t)
+	default:
+		return nil, errors.New("invalid message type")
+	}
 	if m.Body == nil {
 		return nil, errors.New("nil body")
 	}
-	body, err := m.Body.Marshal(0)
+	body, err := m.Body.Marshal(m.Type.Protocol())
 	if err != nil {
 		return nil, err
 	}
 	b := make([]byte, 4+len(body))
-	b[0] = byte(m.Type)
+	b[0] = typ
 	b[1] = byte(m.Code)
 	copy(b[4:], body)
-	binary.BigEndian.PutUint16(b[2:4], 0)
-	csum := checksum(b)
-	binary.BigEndian.PutUint16(b[2:4], csum)
+	if m.Type.Protocol() != ipv6.ProtocolIPv6ICMP {
+		binary.BigEndian.PutUint16(b[2:4], checksum(b))
+	}
 	return b, nil
 }
 
-// ParseMessage 解析原始 ICMP 数据
-func ParseMessage(_ int, b []byte) (*Message, error) {
-	if len(b) < 8 {
-		return nil, errors.New("message too short")
+// errMessageTooShort 表示报文短于其类型要求的长度
+var errMessageTooShort = errors.New("message too short")
+
+// parseFns 按消息类型选择消息体的解析函数，没有列出的类型解析为 RawBody
+var parseFns = map[Type]func(proto int, typ Type, b []byte) (MessageBody, error){
+	ipv4.ICMPTypeEchoReply:              parseEcho,
+	ipv4.ICMPTypeEcho:                   parseEcho,
+	ipv4.ICMPTypeDestinationUnreachable: parseDstUnreach,
+	ipv4.ICMPTypeTimeExceeded:           parseTimeExceeded,
+	ipv4.ICMPTypeParameterProblem:       parseParamProb,
+	ipv4.ICMPTypeTimestamp:              parseTimestamp,
+	ipv4.ICMPTypeTimestampReply:         parseTimestamp,
+
+	ipv6.ICMPTypeEchoRequest:            parseEcho,
+	ipv6.ICMPTypeEchoReply:              parseEcho,
+	ipv6.ICMPTypeDestinationUnreachable: parseDstUnreach,
+	ipv6.ICMPTypePacketTooBig:           parsePacketTooBig,
+	ipv6.ICMPTypeTimeExceeded:           parseTimeExceeded,
+	ipv6.ICMPTypeParameterProblem:       parseParamProb,
+}
+
+// ParseMessage 解析原始 ICMP 数据，proto 是 ipv4.ICMPType 或 ipv6.ICMPType 的 Protocol()，
+// 决定消息类型的解释方式。消息体按类型解析：Echo、差错报文和时间戳各有对应的类型，
+// 其余类型的消息体为 *RawBody。
+func ParseMessage(proto int, b []byte) (*Message, error) {
+	if len(b) < 4 {
+		return nil, errMessageTooShort
 	}
-	typ := ipv4.ICMPType(b[0])
-	body := &Echo{
-		ID:   int(binary.BigEndian.Uint16(b[4:6])),
-		Seq:  int(binary.BigEndian.Uint16(b[6:8])),
-		Data: append([]byte(nil), b[8:]...),
+	var typ Type = ipv4.ICMPType(b[0])
+	if proto == ipv6.ProtocolIPv6ICMP {
+		typ = ipv6.ICMPType(b[0])
+	}
+	m := &Message{Type: typ, Code: int(b[1])}
+	parse, ok := parseFns[typ]
+	if !ok {
+		parse = parseRawBody
+	}
+	body, err := parse(proto, typ, b[4:])
+	if err != nil {
+		return nil, err
+	}
+	m.Body = body
+	return m, nil
+}
+
+// parseEcho 解析 Echo 请求和回复的消息体，数据会被复制
+func parseEcho(proto int, _ Type, b []byte) (MessageBody, error) {
+	if len(b) < 4 {
+		return nil, errMessageTooShort
 	}
-	return &Message{Type: typ, Code: int(b[1]), Body: body}, nil
+	return &Echo{
+		ID:   int(binary.BigEndian.Uint16(b[0:2])),
+		Seq:  int(binary.BigEndian.Uint16(b[2:4])),
+		Data: append([]byte(nil), b[4:]...),
+	}, nil
 }
@@ -3,11 +3,18 @@ package icmp
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"log"
+	"net"
+	"os"
+	"reflect"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 // manualChecksum independently calculates the ICMP checksum.
@@ -32,7 +39,7 @@ func TestMessageMarshalChecksum(t *testing.T) {
 		Code: 0,
 		Body: &Echo{ID: 0x1234, Seq: 1, Data: []byte("Hello")},
 	}
-	b, err := msg.Marshal(nil)
+	b, err := msg.Marshal()
 	if err != nil {
 		t.Fatalf("Marshal failed: %v", err)
 	}
@@ -51,10 +58,7 @@ func TestListenPacketLogging(t *testing.T) {
 	log.SetOutput(&buf)
 	defer log.SetOutput(old)
 
-	conn, err := ListenPacket("udp4", "127.0.0.1:0")
-	if err != nil {
-		t.Fatalf("ListenPacket failed: %v", err)
-	}
+	conn := listenDatagram4(t, "127.0.0.1:0")
 	conn.Close()
 
 	got := buf.String()
@@ -62,3 +66,163 @@ func TestListenPacketLogging(t *testing.T) {
 		t.Errorf("log output missing expected text: %q", got)
 	}
 }
+
+func TestMessageMarshalIPv6Checksum(t *testing.T) {
+	msg := &Message{
+		Type: ipv6.ICMPTypeEchoRequest,
+		Body: &Echo{ID: 0x1234, Seq: 1, Data: []byte("Hello")},
+	}
+	b, err := msg.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if b[0] != 128 {
+		t.Errorf("type = %d, want 128", b[0])
+	}
+	// 校验和覆盖伪首部，留给内核填写
+	if got := binary.BigEndian.Uint16(b[2:4]); got != 0 {
+		t.Errorf("ICMPv6 checksum = 0x%x, want 0", got)
+	}
+}
+
+func TestParseMessageProtocol(t *testing.T) {
+	b, err := (&Message{Type: ipv6.ICMPTypeEchoReply, Body: &Echo{ID: 7, Seq: 9, Data: []byte("x")}}).Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	msg, err := ParseMessage(ipv6.ProtocolIPv6ICMP, b)
+	if err != nil {
+		t.Fatalf("ParseMessage failed: %v", err)
+	}
+	if msg.Type != ipv6.ICMPTypeEchoReply {
+		t.Errorf("type = %v, want ICMPv6 echo reply", msg.Type)
+	}
+	echo, ok := msg.Body.(*Echo)
+	if !ok || echo.ID != 7 || echo.Seq != 9 || string(echo.Data) != "x" {
+		t.Errorf("unexpected body %+v", msg.Body)
+	}
+
+	// 同样的类型值按 IPv4 解释是另一种类型
+	msg, err = ParseMessage(ipv4.ICMPTypeEcho.Protocol(), b)
+	if err != nil {
+		t.Fatalf("ParseMessage failed: %v", err)
+	}
+	if msg.Type != ipv4.ICMPType(129) {
+		t.Errorf("type = %v, want ipv4 type 129", msg.Type)
+	}
+}
+
+// listenDatagram4 打开一个 ping 套接字，内核不允许当前用户使用时跳过测试
+func listenDatagram4(t *testing.T, address string) net.PacketConn {
+	t.Helper()
+	conn, err := ListenPacket("udp4", address)
+	if errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EPROTONOSUPPORT) {
+		t.Skipf("ping sockets unavailable (see net.ipv4.ping_group_range): %v", err)
+	}
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	return conn
+}
+
+// TestListenPacketDatagram 通过 ping 套接字 ping 本机，验证内核改写的 ID 和转换后的地址类型
+func TestListenPacketDatagram(t *testing.T) {
+	conn := listenDatagram4(t, "127.0.0.1")
+	defer conn.Close()
+	ident := conn.LocalAddr().(*net.UDPAddr).Port
+
+	msg := &Message{Type: ipv4.ICMPTypeEcho, Body: &Echo{ID: ident ^ 0xffff, Seq: 42, Data: []byte("unprivileged")}}
+	b, err := msg.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if _, err := conn.WriteTo(b, &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Skipf("no echo reply from loopback (kernel echo disabled?): %v", err)
+	}
+	if ia, ok := addr.(*net.IPAddr); !ok || !ia.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("reply address = %#v, want *net.IPAddr 127.0.0.1", addr)
+	}
+	reply, err := ParseMessage(ipv4.ICMPTypeEchoReply.Protocol(), buf[:n])
+	if err != nil {
+		t.Fatalf("ParseMessage failed: %v", err)
+	}
+	echo := reply.Body.(*Echo)
+	if reply.Type != ipv4.ICMPTypeEchoReply || echo.Seq != 42 || string(echo.Data) != "unprivileged" {
+		t.Errorf("unexpected reply %v %+v", reply.Type, echo)
+	}
+	// 内核用套接字的标识替换了请求中的 ID
+	if echo.ID != ident {
+		t.Errorf("reply ID = %d, want socket ident %d", echo.ID, ident)
+	}
+}
+
+func TestParseMessageBodies(t *testing.T) {
+	orig := []byte("original ip header and leading bytes")
+	cases := []struct {
+		name string
+		msg  *Message
+	}{
+		{"echo", &Message{Type: ipv4.ICMPTypeEcho, Body: &Echo{ID: 1, Seq: 2, Data: []byte("data")}}},
+		{"dst unreach", &Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 3, Body: &DstUnreach{Data: orig}}},
+		{"frag needed", &Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 4, Body: &DstUnreach{NextHopMTU: 1492, Data: orig}}},
+		{"time exceeded", &Message{Type: ipv4.ICMPTypeTimeExceeded, Body: &TimeExceeded{Data: orig}}},
+		{"param prob", &Message{Type: ipv4.ICMPTypeParameterProblem, Body: &ParamProb{Pointer: 9, Data: orig}}},
+		{"timestamp", &Message{Type: ipv4.ICMPTypeTimestampReply, Body: &Timestamp{ID: 3, Seq: 4, Originate: 5, Receive: 6, Transmit: 7}}},
+		{"raw", &Message{Type: ipv4.ICMPType(42), Code: 1, Body: &RawBody{Data: []byte("anything")}}},
+		{"v6 echo", &Message{Type: ipv6.ICMPTypeEchoRequest, Body: &Echo{ID: 1, Seq: 2, Data: []byte("data")}}},
+		{"v6 dst unreach", &Message{Type: ipv6.ICMPTypeDestinationUnreachable, Code: 4, Body: &DstUnreach{Data: orig}}},
+		{"v6 packet too big", &Message{Type: ipv6.ICMPTypePacketTooBig, Body: &PacketTooBig{MTU: 1280, Data: orig}}},
+		{"v6 time exceeded", &Message{Type: ipv6.ICMPTypeTimeExceeded, Body: &TimeExceeded{Data: orig}}},
+		{"v6 param prob", &Message{Type: ipv6.ICMPTypeParameterProblem, Body: &ParamProb{Pointer: 0x10203, Data: orig}}},
+		{"v6 raw", &Message{Type: ipv6.ICMPType(135), Body: &RawBody{Data: []byte("neighbor solicitation")}}},
+	}
+	for _, c := range cases {
+		b, err := c.msg.Marshal()
+		if err != nil {
+			t.Fatalf("%s: Marshal failed: %v", c.name, err)
+		}
+		if len(b) != 4+c.msg.Body.Len(c.msg.Type.Protocol()) {
+			t.Errorf("%s: marshaled %d bytes, Len reports %d", c.name, len(b), 4+c.msg.Body.Len(c.msg.Type.Protocol()))
+		}
+		got, err := ParseMessage(c.msg.Type.Protocol(), b)
+		if err != nil {
+			t.Fatalf("%s: ParseMessage failed: %v", c.name, err)
+		}
+		if !reflect.DeepEqual(got, c.msg) {
+			t.Errorf("%s: parsed %+v (body %+v), want %+v (body %+v)", c.name, got, got.Body, c.msg, c.msg.Body)
+		}
+	}
+}
+
+// TestParseMessageErrorIsNotEcho 验证差错报文不会再被当作 Echo 解析
+func TestParseMessageErrorIsNotEcho(t *testing.T) {
+	b := []byte{byte(ipv4.ICMPTypeDestinationUnreachable), 1, 0, 0, 0, 0, 0, 0, 0x45, 0, 0, 28}
+	msg, err := ParseMessage(ipv4.ProtocolICMP, b)
+	if err != nil {
+		t.Fatalf("ParseMessage failed: %v", err)
+	}
+	body, ok := msg.Body.(*DstUnreach)
+	if !ok {
+		t.Fatalf("body is %T, want *DstUnreach", msg.Body)
+	}
+	if msg.Code != 1 || !bytes.Equal(body.Data, b[8:]) {
+		t.Errorf("unexpected message %+v %+v", msg, body)
+	}
+
+	for _, short := range [][]byte{
+		{0, 0, 0},
+		{byte(ipv4.ICMPTypeEchoReply), 0, 0, 0, 1},
+		{byte(ipv4.ICMPTypeTimestamp), 0, 0, 0, 1, 2, 3, 4},
+	} {
+		if _, err := ParseMessage(ipv4.ProtocolICMP, short); err == nil {
+			t.Errorf("ParseMessage(%v) succeeded on a truncated message", short)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package icmp
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// listenDatagram 创建绑定到 address 的 ICMP 数据报套接字，端口为 0 时由内核分配 Echo ID
+func listenDatagram(network, address string) (net.PacketConn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	if network == "udp6" {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+	}
+	sa, err := sockaddr(family, address)
+	if err != nil {
+		return nil, err
+	}
+	s, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := syscall.Bind(s, sa); err != nil {
+		syscall.Close(s)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	f := os.NewFile(uintptr(s), "datagram-oriented icmp")
+	c, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &datagramConn{c}, nil
+}
+
+// sockaddr 解析 "IP" 或 "IP:端口" 形式的本地地址，IP 为空表示所有地址
+func sockaddr(family int, address string) (syscall.Sockaddr, error) {
+	host, port := address, 0
+	if h, p, err := net.SplitHostPort(address); err == nil {
+		if port, err = strconv.Atoi(p); err != nil || port < 0 || port > 0xffff {
+			return nil, &net.AddrError{Err: "invalid port", Addr: address}
+		}
+		host = h
+	}
+	network := "ip4"
+	if family == syscall.AF_INET6 {
+		network = "ip6"
+	}
+	var ip net.IP
+	var zone string
+	if host != "" {
+		a, err := net.ResolveIPAddr(network, host)
+		if err != nil {
+			return nil, err
+		}
+		ip, zone = a.IP, a.Zone
+	}
+	if family == syscall.AF_INET {
+		sa := &syscall.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], ip.To4())
+		return sa, nil
+	}
+	sa := &syscall.SockaddrInet6{Port: port}
+	copy(sa.Addr[:], ip.To16())
+	if zone != "" {
+		ifi, err := net.InterfaceByName(zone)
+		if err != nil {
+			return nil, err
+		}
+		sa.ZoneId = uint32(ifi.Index)
+	}
+	return sa, nil
+}
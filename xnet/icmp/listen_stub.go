@@ -0,0 +1,13 @@
+//go:build !linux
+
+package icmp
+
+import (
+	"errors"
+	"net"
+)
+
+// listenDatagram 在 Linux 以外的系统上不受支持
+func listenDatagram(network, address string) (net.PacketConn, error) {
+	return nil, &net.OpError{Op: "listen", Net: network, Err: errors.New("datagram-oriented ICMP sockets not supported")}
+}
@@ -0,0 +1,167 @@
+package icmp
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/net/ipv6"
+)
+
+// 差错报文（目的不可达、超时、参数问题、报文过大）的消息体都以 4 字节的类型相关字段开头，
+// 随后是引发差错的原始 IP 报文的开头部分，至少包含 IP 头和上层协议的前 8 个字节。
+
+// DstUnreach 表示目的不可达消息体
+type DstUnreach struct {
+	// NextHopMTU 是 ICMPv4 需要分片（代码 4）时路由器报告的下一跳 MTU（RFC 1191），
+	// 其他情况下为 0
+	NextHopMTU int
+	Data       []byte // 引发差错的原始报文
+}
+
+func (p *DstUnreach) Len(proto int) int { return 4 + len(p.Data) }
+
+func (p *DstUnreach) Marshal(proto int) ([]byte, error) {
+	b := make([]byte, 4+len(p.Data))
+	if proto != ipv6.ProtocolIPv6ICMP {
+		binary.BigEndian.PutUint16(b[2:4], uint16(p.NextHopMTU))
+	}
+	copy(b[4:], p.Data)
+	return b, nil
+}
+
+func parseDstUnreach(proto int, _ Type, b []byte) (MessageBody, error) {
+	if len(b) < 4 {
+		return nil, errMessageTooShort
+	}
+	p := &DstUnreach{Data: append([]byte(nil), b[4:]...)}
+	if proto != ipv6.ProtocolIPv6ICMP {
+		p.NextHopMTU = int(binary.BigEndian.Uint16(b[2:4]))
+	}
+	return p, nil
+}
+
+// PacketTooBig 表示 ICMPv6 的报文过大消息体
+type PacketTooBig struct {
+	MTU  int    // 下一跳链路的 MTU
+	Data []byte // 引发差错的原始报文
+}
+
+func (p *PacketTooBig) Len(proto int) int { return 4 + len(p.Data) }
+
+func (p *PacketTooBig) Marshal(proto int) ([]byte, error) {
+	b := make([]byte, 4+len(p.Data))
+	binary.BigEndian.PutUint32(b[:4], uint32(p.MTU))
+	copy(b[4:], p.Data)
+	return b, nil
+}
+
+func parsePacketTooBig(proto int, _ Type, b []byte) (MessageBody, error) {
+	if len(b) < 4 {
+		return nil, errMessageTooShort
+	}
+	return &PacketTooBig{
+		MTU:  int(binary.BigEndian.Uint32(b[:4])),
+		Data: append([]byte(nil), b[4:]...),
+	}, nil
+}
+
+// TimeExceeded 表示超时消息体，通常是 TTL 或跳数限制在途中耗尽
+type TimeExceeded struct {
+	Data []byte // 引发差错的原始报文
+}
+
+func (p *TimeExceeded) Len(proto int) int { return 4 + len(p.Data) }
+
+func (p *TimeExceeded) Marshal(proto int) ([]byte, error) {
+	b := make([]byte, 4+len(p.Data))
+	copy(b[4:], p.Data)
+	return b, nil
+}
+
+func parseTimeExceeded(proto int, _ Type, b []byte) (MessageBody, error) {
+	if len(b) < 4 {
+		return nil, errMessageTooShort
+	}
+	return &TimeExceeded{Data: append([]byte(nil), b[4:]...)}, nil
+}
+
+// ParamProb 表示参数问题消息体。
+// Pointer 指向原始报文中出错的字节，ICMP 中占 1 字节，ICMPv6 中占 4 字节。
+type ParamProb struct {
+	Pointer uintptr
+	Data    []byte // 引发差错的原始报文
+}
+
+func (p *ParamProb) Len(proto int) int { return 4 + len(p.Data) }
+
+func (p *ParamProb) Marshal(proto int) ([]byte, error) {
+	b := make([]byte, 4+len(p.Data))
+	if proto == ipv6.ProtocolIPv6ICMP {
+		binary.BigEndian.PutUint32(b[:4], uint32(p.Pointer))
+	} else {
+		b[0] = byte(p.Pointer)
+	}
+	copy(b[4:], p.Data)
+	return b, nil
+}
+
+func parseParamProb(proto int, _ Type, b []byte) (MessageBody, error) {
+	if len(b) < 4 {
+		return nil, errMessageTooShort
+	}
+	p := &ParamProb{Data: append([]byte(nil), b[4:]...)}
+	if proto == ipv6.ProtocolIPv6ICMP {
+		p.Pointer = uintptr(binary.BigEndian.Uint32(b[:4]))
+	} else {
+		p.Pointer = uintptr(b[0])
+	}
+	return p, nil
+}
+
+// Timestamp 表示 ICMP 时间戳请求和回复的消息体，时间为自 UTC 零点起的毫秒数
+type Timestamp struct {
+	ID        int
+	Seq       int
+	Originate uint32 // 请求方发送的时间
+	Receive   uint32 // 应答方收到的时间
+	Transmit  uint32 // 应答方回复的时间
+}
+
+func (p *Timestamp) Len(proto int) int { return 16 }
+
+func (p *Timestamp) Marshal(proto int) ([]byte, error) {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint16(b[0:2], uint16(p.ID))
+	binary.BigEndian.PutUint16(b[2:4], uint16(p.Seq))
+	binary.BigEndian.PutUint32(b[4:8], p.Originate)
+	binary.BigEndian.PutUint32(b[8:12], p.Receive)
+	binary.BigEndian.PutUint32(b[12:16], p.Transmit)
+	return b, nil
+}
+
+func parseTimestamp(proto int, _ Type, b []byte) (MessageBody, error) {
+	if len(b) < 16 {
+		return nil, errMessageTooShort
+	}
+	return &Timestamp{
+		ID:        int(binary.BigEndian.Uint16(b[0:2])),
+		Seq:       int(binary.BigEndian.Uint16(b[2:4])),
+		Originate: binary.BigEndian.Uint32(b[4:8]),
+		Receive:   binary.BigEndian.Uint32(b[8:12]),
+		Transmit:  binary.BigEndian.Uint32(b[12:16]),
+	}, nil
+}
+
+// RawBody 表示没有专门类型的消息体，Data 是 ICMP 头之后的全部字节
+type RawBody struct {
+	Data []byte
+}
+
+func (p *RawBody) Len(proto int) int { return len(p.Data) }
+
+func (p *RawBody) Marshal(proto int) ([]byte, error) {
+	return append([]byte(nil), p.Data...), nil
+}
+
+func parseRawBody(proto int, _ Type, b []byte) (MessageBody, error) {
+	return &RawBody{Data: append([]byte(nil), b...)}, nil
+}
@@ -4,10 +4,18 @@ package ipv4
 type ICMPType uint8
 
 const (
-	ICMPTypeEchoReply ICMPType = 0
-	ICMPTypeEcho      ICMPType = 8
+	ICMPTypeEchoReply              ICMPType = 0
+	ICMPTypeDestinationUnreachable ICMPType = 3
+	ICMPTypeEcho                   ICMPType = 8
+	ICMPTypeTimeExceeded           ICMPType = 11
+	ICMPTypeParameterProblem       ICMPType = 12
+	ICMPTypeTimestamp              ICMPType = 13
+	ICMPTypeTimestampReply         ICMPType = 14
 )
 
 const ProtocolICMP = 1
 
+// HeaderLen is the length of an IPv4 header without options.
+const HeaderLen = 20
+
 func (typ ICMPType) Protocol() int { return ProtocolICMP }
@@ -0,0 +1,22 @@
+package ipv6
+
+// ICMPType represents a type of ICMP message.
+type ICMPType uint8
+
+const (
+	ICMPTypeDestinationUnreachable ICMPType = 1
+	ICMPTypePacketTooBig           ICMPType = 2
+	ICMPTypeTimeExceeded           ICMPType = 3
+	ICMPTypeParameterProblem       ICMPType = 4
+	ICMPTypeEchoRequest            ICMPType = 128
+	ICMPTypeEchoReply              ICMPType = 129
+)
+
+// ProtocolIPv6ICMP is the IANA protocol number of ICMPv6.
+const ProtocolIPv6ICMP = 58
+
+// HeaderLen is the length of the fixed IPv6 header.
+const HeaderLen = 40
+
+// Protocol returns the ICMPv6 protocol number.
+func (typ ICMPType) Protocol() int { return ProtocolIPv6ICMP }